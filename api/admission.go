@@ -0,0 +1,182 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueSampleInterval = 5 * time.Second
+	admissionPollInterval      = 200 * time.Millisecond
+)
+
+// admissionQueue tracks the task queue depth of a model. The depth is the last
+// queue size sampled from the serving agent, plus the submissions that are in
+// flight or were accepted after that sample.
+type admissionQueue struct {
+	mu        sync.Mutex
+	model     string
+	config    utils.AdmissionConfig
+	sampled   int
+	submitted int
+	inflight  int
+	done      chan struct{}
+}
+
+func newAdmissionQueue(model string, config utils.AdmissionConfig) *admissionQueue {
+	return &admissionQueue{
+		model:  model,
+		config: config,
+		done:   make(chan struct{}),
+	}
+}
+
+func (queue *admissionQueue) depth() int {
+	return queue.sampled + queue.submitted + queue.inflight
+}
+
+// tryAcquire reserves a place in the queue, returning the estimated wait if the queue is full.
+func (queue *admissionQueue) tryAcquire() (bool, time.Duration) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	depth := queue.depth()
+	if depth < queue.config.MaxQueueSize {
+		queue.inflight++
+		return true, 0
+	}
+	excess := depth - queue.config.MaxQueueSize + 1
+	return false, time.Duration(excess) * queue.config.TaskDuration
+}
+
+// release frees the place reserved by tryAcquire. Accepted submissions are
+// counted in the depth until the next sample.
+func (queue *admissionQueue) release(accepted bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.inflight--
+	if accepted {
+		queue.submitted++
+	}
+}
+
+func (queue *admissionQueue) setSample(size int) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.sampled = size
+	queue.submitted = 0
+	agentQueueSize.WithLabelValues(queue.model).Set(float64(size))
+}
+
+// startQueueSampling periodically samples the queue size of every model with admission control.
+func (server *Server) startQueueSampling() {
+	for _, queue := range server.admission {
+		go func(queue *admissionQueue) {
+			interval := queue.config.SampleInterval
+			if interval <= 0 {
+				interval = defaultQueueSampleInterval
+			}
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				server.sampleQueueSize(queue)
+				select {
+				case <-queue.done:
+					return
+				case <-ticker.C:
+				}
+			}
+		}(queue)
+	}
+}
+
+func (server *Server) sampleQueueSize(queue *admissionQueue) {
+	res, requestURL, err := server.sendRequest(context.Background(), "", "GET", queue.model,
+		"v1/queue_size", nil, "", true)
+	if err != nil {
+		log.Error().Err(err).Str("model", queue.model).Str("upstream_url", requestURL).
+			Msg("failed to sample the queue size")
+		return
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil || res.StatusCode != http.StatusOK {
+		log.Error().Err(err).Str("model", queue.model).Str("upstream_url", requestURL).
+			Int("status", res.StatusCode).Msg("failed to sample the queue size")
+		return
+	}
+	size, err := parseQueueSize(body)
+	if err != nil {
+		log.Error().Err(err).Str("model", queue.model).Msg("failed to parse the queue size")
+		return
+	}
+	queue.setSample(size)
+}
+
+// parseQueueSize reads the queue size from a serving agent response,
+// either a bare number or an object with a "queue_size" or "size" field.
+func parseQueueSize(body []byte) (int, error) {
+	var outputs interface{}
+	if err := json.Unmarshal(body, &outputs); err != nil {
+		return 0, err
+	}
+	if size, ok := outputs.(float64); ok {
+		return int(size), nil
+	}
+	if fields, ok := outputs.(map[string]interface{}); ok {
+		for _, key := range []string{"queue_size", "size"} {
+			if size, ok := fields[key].(float64); ok {
+				return int(size), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unexpected queue size response: %s", string(body))
+}
+
+// admit reserves a place in the task queue of a model, waiting up to MaxDefer for room.
+// If the queue stays full, it aborts the request with 429 and returns nil. Otherwise,
+// the returned function must be called with whether the submission was accepted.
+func (server *Server) admit(ctx *gin.Context, modelName string) func(accepted bool) {
+	queue, ok := server.admission[modelName]
+	if !ok {
+		return func(bool) {}
+	}
+
+	deadline := time.Now().Add(queue.config.MaxDefer)
+	for {
+		admitted, wait := queue.tryAcquire()
+		if admitted {
+			return queue.release
+		}
+		if time.Now().Add(admissionPollInterval).After(deadline) {
+			admissionRejections.WithLabelValues(modelName).Inc()
+			seconds := int(math.Ceil(wait.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			ctx.Header("Retry-After", strconv.Itoa(seconds))
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":                  fmt.Sprintf("the task queue of model %s is full", modelName),
+				"estimated_wait_seconds": seconds,
+			})
+			return nil
+		}
+		select {
+		case <-ctx.Request.Context().Done():
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, errorResponse(
+				fmt.Errorf("the task queue of model %s is full", modelName)))
+			return nil
+		case <-time.After(admissionPollInterval):
+		}
+	}
+}
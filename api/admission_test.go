@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseQueueSize(t *testing.T) {
+	testCases := []struct {
+		name     string
+		body     string
+		expected int
+		err      bool
+	}{
+		{name: "Number", body: `3`, expected: 3},
+		{name: "QueueSize", body: `{"queue_size": 4}`, expected: 4},
+		{name: "Size", body: `{"size": 5}`, expected: 5},
+		{name: "UnknownField", body: `{"length": 5}`, err: true},
+		{name: "NotNumber", body: `{"queue_size": "5"}`, err: true},
+		{name: "InvalidJSON", body: `queue_size`, err: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			size, err := parseQueueSize([]byte(tc.body))
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, size)
+		})
+	}
+}
+
+func TestAdmissionQueue(t *testing.T) {
+	queue := newAdmissionQueue("test", utils.AdmissionConfig{MaxQueueSize: 3, TaskDuration: 10 * time.Second})
+	queue.setSample(1)
+
+	admitted, _ := queue.tryAcquire()
+	require.True(t, admitted)
+	admitted, _ = queue.tryAcquire()
+	require.True(t, admitted)
+	admitted, wait := queue.tryAcquire()
+	require.False(t, admitted)
+	require.Equal(t, 10*time.Second, wait)
+
+	// A rejected submission frees its place, an accepted one keeps it until the next sample
+	queue.release(false)
+	queue.release(true)
+	require.Equal(t, 2, queue.depth())
+	admitted, _ = queue.tryAcquire()
+	require.True(t, admitted)
+	queue.release(true)
+	require.Equal(t, 3, queue.depth())
+
+	queue.setSample(5)
+	require.Equal(t, 5, queue.depth())
+	admitted, wait = queue.tryAcquire()
+	require.False(t, admitted)
+	require.Equal(t, 30*time.Second, wait)
+}
+
+func TestAdmit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v1/queue_size" {
+			_, _ = w.Write([]byte(`{"queue_size": 2}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"task_id": "1234"}`))
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress: upstream.URL,
+		Models: map[string]utils.ModelConfig{"test": {Admission: utils.AdmissionConfig{
+			MaxQueueSize:   3,
+			SampleInterval: time.Hour,
+			TaskDuration:   10 * time.Second,
+		}}},
+	}, nil)
+	require.NoError(t, err)
+	queue := server.admission["test"]
+	// Wait for the first sample of the queue size
+	require.Eventually(t, func() bool {
+		queue.mu.Lock()
+		defer queue.mu.Unlock()
+		return queue.sampled == 2
+	}, time.Second, 10*time.Millisecond)
+
+	submit := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(http.MethodPost, "/async/v1/predict",
+			bytes.NewReader([]byte(`{"model_name": "test", "inputs": {"prompt": "a cat"}}`)))
+		require.NoError(t, err)
+		request.Header.Set("UID", "1")
+		server.router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	require.Equal(t, http.StatusOK, submit().Code)
+	recorder := submit()
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	require.Equal(t, "10", recorder.Header().Get("Retry-After"))
+	var body struct {
+		Error                string `json:"error"`
+		EstimatedWaitSeconds int    `json:"estimated_wait_seconds"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	require.Equal(t, "the task queue of model test is full", body.Error)
+	require.Equal(t, 10, body.EstimatedWaitSeconds)
+
+	// The next sample accounts for the accepted submission
+	server.sampleQueueSize(queue)
+	require.Equal(t, http.StatusOK, submit().Code)
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The actions of the audit events
+const (
+	auditAuthFailure      = "auth.failure"
+	auditAdminAuthFailure = "admin.auth_failure"
+	auditQueuePause       = "queue.pause"
+	auditQueueUnpause     = "queue.unpause"
+	auditOverrideSet      = "override.set"
+	auditOverrideDelete   = "override.delete"
+	auditCreditsTopUp     = "credits.topup"
+	auditTaskAccess       = "task.access"
+)
+
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+	auditDenied  = "denied"
+)
+
+const auditFilePrefix = "audit"
+
+// AuditEvent is a record of the audit log. Each record holds the hash of the previous
+// one, so that removing or editing a record breaks the chain. The hashes are keyed, so
+// that the chain cannot be rebuilt without the key.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Seq       int64     `json:"seq"`
+	ActorUID  string    `json:"actor_uid,omitempty"`
+	ClientIP  string    `json:"client_ip"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+}
+
+// hash returns the HMAC-SHA256 of the event without its own hash.
+func (event AuditEvent) hash(key []byte) (string, error) {
+	event.Hash = ""
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// AuditLog writes the security-relevant actions to a dedicated sink, separate from the
+// application logs. A nil AuditLog records nothing.
+type AuditLog struct {
+	mu       sync.Mutex
+	sink     utils.EventSink
+	key      []byte
+	seq      int64
+	prevHash string
+}
+
+// NewAuditLog creates an audit log. With a file sink, the chain continues from the last
+// record of the previous files, otherwise each process starts a new chain.
+func NewAuditLog(config utils.Config) (*AuditLog, error) {
+	if config.AuditSink == "" {
+		return nil, nil
+	}
+	if config.AuditHashKey == "" {
+		return nil, errors.New("the audit log needs a hash key")
+	}
+	audit := &AuditLog{key: []byte(config.AuditHashKey)}
+	if config.AuditSink == utils.SinkFile {
+		last, err := lastAuditEvent(config.AuditDir)
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			audit.seq, audit.prevHash = last.Seq, last.Hash
+		}
+	}
+	// The events are not buffered, so that a failed write does not leave a gap in the chain
+	sink, err := utils.NewSink(config.AuditSink, utils.SinkOptions{
+		Dir:     config.AuditDir,
+		Prefix:  auditFilePrefix,
+		MaxSize: config.AuditMaxFileSize,
+		URL:     config.AuditHTTPURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	audit.sink = sink
+	return audit, nil
+}
+
+// Record appends an event of a request to the chain, once it is written to the sink. The actor
+// is the user authenticated by the request, it is empty on the admin and unauthenticated routes.
+func (audit *AuditLog) Record(ctx *gin.Context, action string, target string, outcome string, reason string) {
+	if audit == nil {
+		return
+	}
+	event := AuditEvent{
+		Time:      time.Now().UTC(),
+		ActorUID:  ctx.GetString(auditActorKey),
+		ClientIP:  ctx.ClientIP(),
+		Action:    action,
+		Target:    target,
+		Outcome:   outcome,
+		Reason:    reason,
+		RequestID: requestIDFrom(ctx.Request.Context()),
+	}
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	event.Seq, event.PrevHash = audit.seq+1, audit.prevHash
+	hash, err := event.hash(audit.key)
+	if err == nil {
+		event.Hash = hash
+		var record []byte
+		if record, err = json.Marshal(event); err == nil {
+			err = audit.sink.Write([][]byte{record})
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("action", action).Str("target", target).Msg("failed to record an audit event")
+		return
+	}
+	audit.seq, audit.prevHash = event.Seq, event.Hash
+}
+
+// recordOutcome records an action once its handler has responded.
+func (audit *AuditLog) recordOutcome(ctx *gin.Context, action string, target string) {
+	if ctx.Writer.Status() < http.StatusMultipleChoices {
+		audit.Record(ctx, action, target, auditSuccess, "")
+		return
+	}
+	audit.Record(ctx, action, target, auditFailure, http.StatusText(ctx.Writer.Status()))
+}
+
+// Close closes the sink.
+func (audit *AuditLog) Close(ctx context.Context) error {
+	if audit == nil {
+		return nil
+	}
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	return audit.sink.Close()
+}
+
+// readAuditEvents reads the events of audit files, ordered by sequence number.
+func readAuditEvents(paths []string) ([]AuditEvent, error) {
+	var events []AuditEvent
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			var event AuditEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("invalid audit event at %s:%d: %w", path, line, err)
+			}
+			events = append(events, event)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+	return events, nil
+}
+
+// lastAuditEvent returns the last event of the newest audit file of a directory, if any.
+func lastAuditEvent(dir string) (*AuditEvent, error) {
+	// The file names start with their creation time
+	paths, err := filepath.Glob(filepath.Join(dir, auditFilePrefix+"-*.jsonl"))
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+	sort.Strings(paths)
+	events, err := readAuditEvents(paths[len(paths)-1:])
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return &events[len(events)-1], nil
+}
+
+// VerifyAuditLog checks the hash chain of the files of an audit log with its hash key, it
+// returns the number of events. The chain may start after the first event, e.g., once old
+// files are archived.
+func VerifyAuditLog(key string, paths []string) (int, error) {
+	events, err := readAuditEvents(paths)
+	if err != nil {
+		return 0, err
+	}
+	for i, event := range events {
+		hash, err := event.hash([]byte(key))
+		if err != nil {
+			return i, err
+		}
+		if hash != event.Hash {
+			return i, fmt.Errorf("audit event %d was modified", event.Seq)
+		}
+		if i == 0 {
+			continue
+		}
+		previous := events[i-1]
+		if event.Seq != previous.Seq+1 || event.PrevHash != previous.Hash {
+			return i, fmt.Errorf("audit chain broken between events %d and %d", previous.Seq, event.Seq)
+		}
+	}
+	return len(events), nil
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	mockapi "github.com/HyperGAI/serving-api/api/mock"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	config := utils.Config{AdminAPIKey: "secret", AuditSink: utils.SinkFile, AuditDir: dir, AuditHashKey: "key"}
+	// The hash key is required
+	_, err := NewServer(utils.Config{AuditSink: utils.SinkFile, AuditDir: dir}, nil)
+	require.Error(t, err)
+	server, err := NewServer(config, nil)
+	require.NoError(t, err)
+
+	send := func(method string, url string, headers map[string]string, body string) int {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(method, url, bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+		for key, value := range headers {
+			request.Header.Set(key, value)
+		}
+		server.router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	require.Equal(t, http.StatusUnauthorized, send(http.MethodPost, "/v1/predict", nil, "{}"))
+	require.Equal(t, http.StatusUnauthorized, send(http.MethodPut, "/admin/overrides/1",
+		map[string]string{"apikey": "wrong"}, `{"banned": true}`))
+	require.Equal(t, http.StatusOK, send(http.MethodPut, "/admin/overrides/1",
+		map[string]string{"apikey": "secret", requestIDHeader: "req-1"}, `{"banned": true}`))
+
+	// The events are written before the requests complete
+	paths, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+	events, err := readAuditEvents(paths)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	require.NoError(t, server.Close(context.Background()))
+	require.Equal(t, auditAuthFailure, events[0].Action)
+	require.Equal(t, auditDenied, events[0].Outcome)
+	require.Equal(t, auditAdminAuthFailure, events[1].Action)
+	require.Equal(t, auditOverrideSet, events[2].Action)
+	require.Equal(t, "1", events[2].Target)
+	require.Equal(t, auditSuccess, events[2].Outcome)
+	require.Equal(t, "req-1", events[2].RequestID)
+	require.Equal(t, events[1].Hash, events[2].PrevHash)
+
+	n, err := VerifyAuditLog("key", paths)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	// A new process continues the chain
+	server, err = NewServer(config, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/admin/overrides/1",
+		map[string]string{"apikey": "secret"}, ""))
+	require.NoError(t, server.Close(context.Background()))
+	paths, err = filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	require.NoError(t, err)
+	n, err = VerifyAuditLog("key", paths)
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+	// The hashes do not verify with another key
+	_, err = VerifyAuditLog("other", paths)
+	require.ErrorContains(t, err, "was modified")
+
+	// Tampering with a record breaks the chain
+	data, err := os.ReadFile(paths[0])
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(paths[0], []byte(strings.Replace(string(data), `"target":"1"`, `"target":"2"`, 1)), 0o644))
+	_, err = VerifyAuditLog("key", paths)
+	require.ErrorContains(t, err, "was modified")
+
+	// Removing a record too
+	lines := strings.SplitAfter(string(data), "\n")
+	require.NoError(t, os.WriteFile(paths[0], []byte(lines[0]+lines[2]), 0o644))
+	_, err = VerifyAuditLog("key", paths)
+	require.ErrorContains(t, err, "chain broken")
+}
+
+func TestAuditTaskOwnership(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	webhook := mockapi.NewMockWebhook(ctrl)
+	webhook.EXPECT().GetTaskInfo(gomock.Any(), "1234").AnyTimes().
+		Return(map[string]interface{}{"uid": "1", "status": "succeeded", "outputs": "test"}, nil)
+
+	dir := t.TempDir()
+	server, err := NewServer(utils.Config{AuditSink: utils.SinkFile, AuditDir: dir, AuditHashKey: "key"}, webhook)
+	require.NoError(t, err)
+	send := func(method string, uri string, userID string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(method, uri, bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+		// getTask reads the ID from the request URI, which is set by the servers
+		request.RequestURI = uri
+		request.Header.Set("UID", userID)
+		server.router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	require.Equal(t, http.StatusOK, send(http.MethodGet, "/task/1234", "1", "").Code)
+	require.Equal(t, http.StatusNotFound, send(http.MethodGet, "/task/1234", "2", "").Code)
+	recorder := send(http.MethodPost, "/task/batch", "2", `{"ids": ["1234"]}`)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `[]`, recorder.Body.String())
+	// The UID header of the unauthenticated routes is not recorded as the actor
+	send(http.MethodPost, "/pause/test", "1", "")
+	require.NoError(t, server.Close(context.Background()))
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	require.NoError(t, err)
+	events, err := readAuditEvents(paths)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	for _, event := range events[:2] {
+		require.Equal(t, auditTaskAccess, event.Action)
+		require.Equal(t, "1234", event.Target)
+		require.Equal(t, auditDenied, event.Outcome)
+		require.Equal(t, "2", event.ActorUID)
+	}
+	require.Equal(t, auditQueuePause, events[2].Action)
+	require.Empty(t, events[2].ActorUID)
+}
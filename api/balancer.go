@@ -0,0 +1,329 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/rs/zerolog/log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	balancerLeastOutstanding = "least_outstanding"
+	balancerPowerOfTwo       = "p2c"
+)
+
+const (
+	defaultDiscoveryInterval   = 30 * time.Second
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultFailureThreshold    = 5
+	defaultEjectionDuration    = 30 * time.Second
+)
+
+var errNoEndpoint = errors.New("no serving agent endpoint available")
+
+// upstreamEndpoint is one replica of a serving agent.
+type upstreamEndpoint struct {
+	url         string
+	outstanding int64
+	// The fields below are guarded by the pool mutex
+	unhealthy    bool
+	failures     int
+	ejectedUntil time.Time
+}
+
+// EndpointPool balances the calls of a model across its serving agent replicas.
+// Replicas are ejected when active health probes fail or when they return
+// too many consecutive errors.
+type EndpointPool struct {
+	mu        sync.RWMutex
+	model     string
+	config    utils.ModelConfig
+	endpoints []*upstreamEndpoint
+	done      chan struct{}
+}
+
+func NewEndpointPool(model string, config utils.ModelConfig) *EndpointPool {
+	pool := &EndpointPool{
+		model:  model,
+		config: config,
+		done:   make(chan struct{}),
+	}
+	pool.setEndpoints(config.Endpoints)
+	return pool
+}
+
+// Start launches the DNS discovery and active health check loops.
+func (pool *EndpointPool) Start() {
+	if pool.config.Discovery.Host != "" {
+		pool.discover()
+		go pool.loop(pool.config.Discovery.Interval, defaultDiscoveryInterval, pool.discover)
+	}
+	if pool.config.HealthCheck.Path != "" {
+		go pool.loop(pool.config.HealthCheck.Interval, defaultHealthCheckInterval, pool.probe)
+	}
+}
+
+// Stop terminates the background loops.
+func (pool *EndpointPool) Stop() {
+	close(pool.done)
+}
+
+func (pool *EndpointPool) loop(interval time.Duration, defaultInterval time.Duration, f func()) {
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pool.done:
+			return
+		case <-ticker.C:
+			f()
+		}
+	}
+}
+
+// Pick selects an endpoint for a call. The returned release function must be
+// called with the outcome of the call once it completes.
+func (pool *EndpointPool) Pick() (string, func(err error, statusCode int), error) {
+	pool.mu.RLock()
+	now := time.Now()
+	candidates := make([]*upstreamEndpoint, 0, len(pool.endpoints))
+	for _, endpoint := range pool.endpoints {
+		if !endpoint.unhealthy && now.After(endpoint.ejectedUntil) {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	if len(candidates) == 0 {
+		// When every endpoint is ejected, spread the calls over all of them
+		// rather than failing every request.
+		candidates = append(candidates, pool.endpoints...)
+	}
+	pool.mu.RUnlock()
+	upstreamEndpointsAvailable.WithLabelValues(pool.model).Set(float64(len(candidates)))
+
+	if len(candidates) == 0 {
+		return "", nil, fmt.Errorf("%w for model %s", errNoEndpoint, pool.model)
+	}
+	var endpoint *upstreamEndpoint
+	if pool.config.Balancer == balancerPowerOfTwo {
+		endpoint = pickPowerOfTwo(candidates)
+	} else {
+		endpoint = pickLeastOutstanding(candidates)
+	}
+
+	atomic.AddInt64(&endpoint.outstanding, 1)
+	release := func(err error, statusCode int) {
+		atomic.AddInt64(&endpoint.outstanding, -1)
+		pool.observe(endpoint, isEndpointFailure(err, statusCode))
+	}
+	return endpoint.url, release, nil
+}
+
+// isEndpointFailure reports whether a call counts against the health of the endpoint:
+// only transport errors and the gateway statuses do, an application error is not the
+// fault of the endpoint.
+func isEndpointFailure(err error, statusCode int) bool {
+	if err != nil {
+		return true
+	}
+	switch statusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func pickLeastOutstanding(candidates []*upstreamEndpoint) *upstreamEndpoint {
+	// Start at a random offset so that ties are not always broken in favor of the first endpoint
+	offset := rand.Intn(len(candidates))
+	best := candidates[offset]
+	for i := 1; i < len(candidates); i++ {
+		endpoint := candidates[(offset+i)%len(candidates)]
+		if atomic.LoadInt64(&endpoint.outstanding) < atomic.LoadInt64(&best.outstanding) {
+			best = endpoint
+		}
+	}
+	return best
+}
+
+func pickPowerOfTwo(candidates []*upstreamEndpoint) *upstreamEndpoint {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := candidates[i], candidates[j]
+	if atomic.LoadInt64(&b.outstanding) < atomic.LoadInt64(&a.outstanding) {
+		return b
+	}
+	return a
+}
+
+// observe implements passive error tracking.
+func (pool *EndpointPool) observe(endpoint *upstreamEndpoint, failed bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if !failed {
+		endpoint.failures = 0
+		return
+	}
+	endpoint.failures++
+	threshold := pool.config.HealthCheck.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultFailureThreshold
+	}
+	if endpoint.failures >= threshold {
+		duration := pool.config.HealthCheck.EjectionDuration
+		if duration <= 0 {
+			duration = defaultEjectionDuration
+		}
+		endpoint.failures = 0
+		endpoint.ejectedUntil = time.Now().Add(duration)
+		upstreamEndpointEjections.WithLabelValues(pool.model, "passive").Inc()
+		log.Warn().Str("model", pool.model).Str("upstream_url", endpoint.url).Dur("duration", duration).
+			Int("failures", threshold).Msg("ejected an endpoint after consecutive failures")
+	}
+}
+
+// setEndpoints replaces the endpoint list, keeping the state of known endpoints.
+func (pool *EndpointPool) setEndpoints(urls []string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	known := make(map[string]*upstreamEndpoint, len(pool.endpoints))
+	for _, endpoint := range pool.endpoints {
+		known[endpoint.url] = endpoint
+	}
+	endpoints := make([]*upstreamEndpoint, 0, len(urls))
+	for _, u := range urls {
+		if endpoint, ok := known[u]; ok {
+			endpoints = append(endpoints, endpoint)
+		} else {
+			endpoints = append(endpoints, &upstreamEndpoint{url: u})
+		}
+	}
+	pool.endpoints = endpoints
+}
+
+func (pool *EndpointPool) discover() {
+	urls, err := resolveEndpoints(pool.config.Discovery)
+	if err != nil {
+		log.Error().Err(err).Str("model", pool.model).Msg("failed to resolve the endpoints")
+		return
+	}
+	if len(urls) == 0 {
+		log.Warn().Str("model", pool.model).Msg("no endpoint resolved, keeping the previous ones")
+		return
+	}
+	endpoints := make([]string, 0, len(pool.config.Endpoints)+len(urls))
+	endpoints = append(endpoints, pool.config.Endpoints...)
+	pool.setEndpoints(append(endpoints, urls...))
+}
+
+func resolveEndpoints(config utils.DiscoveryConfig) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	scheme := config.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	urls := make([]string, 0)
+	if strings.ToLower(config.Type) == "srv" {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", config.Host)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			urls = append(urls, fmt.Sprintf("%s://%s",
+				scheme, net.JoinHostPort(host, strconv.Itoa(int(record.Port)))))
+		}
+		return urls, nil
+	}
+
+	if config.Port == 0 {
+		return nil, errors.New("the port is required for A record discovery")
+	}
+	addresses, err := net.DefaultResolver.LookupHost(ctx, config.Host)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		urls = append(urls, fmt.Sprintf("%s://%s",
+			scheme, net.JoinHostPort(address, strconv.Itoa(config.Port))))
+	}
+	return urls, nil
+}
+
+// probe runs the active health checks of all endpoints.
+func (pool *EndpointPool) probe() {
+	pool.mu.RLock()
+	endpoints := append([]*upstreamEndpoint(nil), pool.endpoints...)
+	pool.mu.RUnlock()
+
+	timeout := pool.config.HealthCheck.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	// Cancel the pending probes when the pool is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-pool.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	client := http.Client{Timeout: timeout}
+	for _, endpoint := range endpoints {
+		healthy := false
+		probeURL, err := url.JoinPath(endpoint.url, pool.config.HealthCheck.Path)
+		if err == nil {
+			var req *http.Request
+			req, err = http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+			if err == nil {
+				res, e := client.Do(req)
+				if e == nil {
+					res.Body.Close()
+					healthy = res.StatusCode < 300
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			// Stopped, keep the last known state
+			return
+		}
+
+		pool.mu.Lock()
+		if endpoint.unhealthy != !healthy {
+			if healthy {
+				log.Info().Str("model", pool.model).Str("upstream_url", endpoint.url).
+					Msg("endpoint is healthy again")
+			} else {
+				upstreamEndpointEjections.WithLabelValues(pool.model, "active").Inc()
+				log.Warn().Str("model", pool.model).Str("upstream_url", endpoint.url).
+					Msg("endpoint failed its health check")
+			}
+		}
+		endpoint.unhealthy = !healthy
+		pool.mu.Unlock()
+	}
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEndpointPoolLeastOutstanding(t *testing.T) {
+	pool := NewEndpointPool("test", utils.ModelConfig{
+		Endpoints: []string{"http://a", "http://b"},
+	})
+
+	first, releaseFirst, err := pool.Pick()
+	require.NoError(t, err)
+	second, releaseSecond, err := pool.Pick()
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+
+	releaseFirst(nil, http.StatusOK)
+	third, releaseThird, err := pool.Pick()
+	require.NoError(t, err)
+	require.Equal(t, first, third)
+	releaseSecond(nil, http.StatusOK)
+	releaseThird(nil, http.StatusOK)
+}
+
+func TestEndpointPoolPassiveEjection(t *testing.T) {
+	pool := NewEndpointPool("test", utils.ModelConfig{
+		Endpoints: []string{"http://a", "http://b"},
+		Balancer:  balancerPowerOfTwo,
+		HealthCheck: utils.HealthCheckConfig{
+			FailureThreshold: 2,
+			EjectionDuration: time.Minute,
+		},
+	})
+
+	// Fail "http://a" twice
+	for failures := 0; failures < 2; {
+		endpoint, release, err := pool.Pick()
+		require.NoError(t, err)
+		if endpoint == "http://a" {
+			release(errors.New("connection refused"), 0)
+			failures++
+		} else {
+			release(nil, http.StatusOK)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		endpoint, release, err := pool.Pick()
+		require.NoError(t, err)
+		require.Equal(t, "http://b", endpoint)
+		release(nil, http.StatusOK)
+	}
+}
+
+func TestIsEndpointFailure(t *testing.T) {
+	testCases := []struct {
+		name       string
+		err        error
+		statusCode int
+		failure    bool
+	}{
+		{name: "ok", statusCode: http.StatusOK},
+		{name: "bad request", statusCode: http.StatusBadRequest},
+		{name: "internal error", statusCode: http.StatusInternalServerError},
+		{name: "bad gateway", statusCode: http.StatusBadGateway, failure: true},
+		{name: "unavailable", statusCode: http.StatusServiceUnavailable, failure: true},
+		{name: "gateway timeout", statusCode: http.StatusGatewayTimeout, failure: true},
+		{name: "transport error", err: errors.New("connection refused"), failure: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.failure, isEndpointFailure(tc.err, tc.statusCode))
+		})
+	}
+}
+
+func TestEndpointPoolDiscovery(t *testing.T) {
+	urls, err := resolveEndpoints(utils.DiscoveryConfig{Host: "localhost", Port: 8080})
+	require.NoError(t, err)
+	require.Contains(t, urls, "http://127.0.0.1:8080")
+	_, err = resolveEndpoints(utils.DiscoveryConfig{Host: "localhost"})
+	require.Error(t, err)
+
+	pool := NewEndpointPool("test", utils.ModelConfig{
+		Endpoints: []string{"http://static"},
+		Discovery: utils.DiscoveryConfig{Host: "localhost", Port: 8080, Scheme: "https"},
+	})
+	pool.discover()
+	endpoints := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		endpoint, release, err := pool.Pick()
+		require.NoError(t, err)
+		endpoints[endpoint] = true
+		// Keep the endpoints busy, so that the calls spread over all of them
+		defer release(nil, http.StatusOK)
+	}
+	require.True(t, endpoints["http://static"])
+	require.True(t, endpoints["https://127.0.0.1:8080"])
+
+	// The previous endpoints are kept when the discovery fails
+	pool.config.Discovery.Host = "unknown.invalid"
+	pool.discover()
+	require.Len(t, pool.endpoints, len(endpoints))
+}
+
+func TestEndpointPoolActiveProbe(t *testing.T) {
+	healthy := true
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/health", r.URL.Path)
+		if healthy {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer flaky.Close()
+	alwaysHealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer alwaysHealthy.Close()
+
+	pool := NewEndpointPool("test", utils.ModelConfig{
+		Endpoints:   []string{flaky.URL, alwaysHealthy.URL},
+		HealthCheck: utils.HealthCheckConfig{Path: "/health"},
+	})
+	picked := func() map[string]bool {
+		endpoints := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			endpoint, release, err := pool.Pick()
+			require.NoError(t, err)
+			endpoints[endpoint] = true
+			release(nil, http.StatusOK)
+		}
+		return endpoints
+	}
+
+	healthy = false
+	pool.probe()
+	require.Equal(t, map[string]bool{alwaysHealthy.URL: true}, picked())
+
+	healthy = true
+	pool.probe()
+	endpoints := picked()
+	require.True(t, endpoints[flaky.URL])
+}
+
+func TestEndpointPoolProbeStopped(t *testing.T) {
+	blocked := make(chan struct{})
+	defer close(blocked)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-blocked:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	pool := NewEndpointPool("test", utils.ModelConfig{
+		Endpoints:   []string{slow.URL},
+		HealthCheck: utils.HealthCheckConfig{Path: "/health", Timeout: time.Minute},
+	})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pool.Stop()
+	}()
+	start := time.Now()
+	pool.probe()
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.False(t, pool.endpoints[0].unhealthy)
+}
+
+func TestStreamEndpointError(t *testing.T) {
+	upstreamErr := &streamError{reason: streamAbortUpstream, err: errors.New("connection reset")}
+	testCases := []struct {
+		name   string
+		err    error
+		failed bool
+	}{
+		{name: "OK", err: nil},
+		{name: "Upstream", err: upstreamErr, failed: true},
+		{name: "UpstreamStatus", err: &streamError{reason: streamAbortUpstreamStatus,
+			err: fmt.Errorf("status-code: %d", 502)}, failed: true},
+		{name: "Client", err: &streamError{reason: streamAbortClient, err: errors.New("client stopped listening")}},
+		{name: "Policy", err: &streamError{reason: streamAbortPolicy, err: errors.New("blocked")}},
+		{name: "Other", err: errors.New("failed")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := streamEndpointError(context.Background(), tc.err)
+			if tc.failed {
+				require.Equal(t, tc.err, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	// The upstream errors caused by the cancellation of the stream, on shutdown or
+	// when the client disconnects, are not failures of the endpoint
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, streamEndpointError(ctx, upstreamErr))
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultBlobTTL    = 24 * time.Hour
+	defaultBlobURLTTL = time.Hour
+)
+
+// setupBlobs creates the blob store and its garbage collector, and checks the file inputs
+// and the output offload of the models.
+func (server *Server) setupBlobs() error {
+	if server.config.BlobStore != "" {
+		if server.config.BlobSigningKey == "" {
+			return errors.New("the blob store needs a signing key")
+		}
+		blobs, err := utils.NewBlobStore(server.config.BlobStore, server.config.BlobDir)
+		if err != nil {
+			return err
+		}
+		server.blobs = blobs
+		server.blobSigner = utils.NewBlobSigner(server.config.BlobSigningKey, server.config.BlobBaseURL)
+		server.blobGC = utils.NewBlobCollector(blobs, server.config.BlobGCInterval)
+		server.blobGC.Start()
+	} else if server.config.OutputOffloadThreshold > 0 {
+		return errors.New("the output offload needs the blob store")
+	}
+	for modelName, model := range server.config.Models {
+		if server.blobs == nil && (model.Offload.Threshold > 0 || len(model.Offload.Binary) > 0) {
+			return fmt.Errorf("the outputs of model %s are offloaded, but the blob store is disabled", modelName)
+		}
+		for field, input := range model.Inputs {
+			switch input.Type {
+			case utils.InputImage, utils.InputAudio, utils.InputVideo, utils.InputFile:
+			default:
+				return fmt.Errorf("invalid type %q of input %s of model %s", input.Type, field, modelName)
+			}
+			switch input.Encoding {
+			case "", utils.InputEncodingBase64:
+			case utils.InputEncodingURL:
+				if server.blobs == nil {
+					return fmt.Errorf("input %s of model %s is passed by url, but the blob store is disabled",
+						field, modelName)
+				}
+			default:
+				return fmt.Errorf("invalid encoding %q of input %s of model %s", input.Encoding, field, modelName)
+			}
+		}
+	}
+	return nil
+}
+
+func (server *Server) blobTTL() time.Duration {
+	if server.config.BlobTTL > 0 {
+		return server.config.BlobTTL
+	}
+	return defaultBlobTTL
+}
+
+func (server *Server) blobURLTTL() time.Duration {
+	if server.config.BlobURLTTL > 0 {
+		return server.config.BlobURLTTL
+	}
+	return defaultBlobURLTTL
+}
+
+// inlineBlobTypes are the media types shown by the browsers, the other blobs, e.g., HTML or
+// SVG which can run scripts, are downloaded as attachments.
+var inlineBlobTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"audio/mpeg": true,
+	"audio/wav":  true,
+	"audio/ogg":  true,
+	"video/mp4":  true,
+	"video/webm": true,
+}
+
+// blobDisposition returns the Content-Disposition of a blob of a content type.
+func blobDisposition(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil && inlineBlobTypes[mediaType] {
+		return "inline"
+	}
+	return "attachment"
+}
+
+// downloadBlob serves a blob to the holders of a signed URL. The content type is not sniffed,
+// and the blobs are sandboxed, so that an uploaded blob cannot run scripts on the origin.
+func (server *Server) downloadBlob(ctx *gin.Context) {
+	if server.blobs == nil {
+		ctx.JSON(http.StatusNotFound, errorResponse(utils.ErrBlobNotFound))
+		return
+	}
+	key := strings.TrimPrefix(ctx.Param("key"), "/")
+	err := server.blobSigner.Verify(key, ctx.Query("expires"), ctx.Query("signature"), time.Now())
+	if err != nil {
+		ctx.JSON(http.StatusForbidden, errorResponse(err))
+		return
+	}
+	reader, info, err := server.blobs.Get(ctx.Request.Context(), key)
+	if errors.Is(err, utils.ErrBlobNotFound) || errors.Is(err, utils.ErrInvalidBlobKey) {
+		ctx.JSON(http.StatusNotFound, errorResponse(utils.ErrBlobNotFound))
+		return
+	}
+	if err != nil {
+		requestLogger(ctx.Request.Context()).Error().Err(err).Str("key", key).Msg("failed to read a blob")
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+	defer reader.Close()
+	ctx.Header("Content-Type", info.ContentType)
+	ctx.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+	ctx.Header("Cache-Control", "private, max-age=300")
+	ctx.Header("Content-Disposition", blobDisposition(info.ContentType))
+	ctx.Header("X-Content-Type-Options", "nosniff")
+	ctx.Header("Content-Security-Policy", "sandbox")
+	ctx.Status(http.StatusOK)
+	_, _ = io.Copy(ctx.Writer, reader)
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	goredis "github.com/redis/go-redis/v9"
+	"sync"
+	"time"
+)
+
+const (
+	cacheBackendRedis  = "redis"
+	cacheBackendMemory = "memory"
+	cacheKeyPrefix     = "predict_cache"
+)
+
+// ResponseCache stores the encoded outputs of successful predictions.
+type ResponseCache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// NewResponseCache creates the cache backend selected by CACHE_BACKEND. The redis backend
+// shares the client of the server, its errors are handled as cache misses.
+func NewResponseCache(config utils.Config, client *goredis.Client, health *utils.RedisHealth) (ResponseCache, error) {
+	switch config.CacheBackend {
+	case cacheBackendRedis:
+		if client == nil {
+			return nil, errors.New("the redis cache backend requires REDIS_ADDRESS")
+		}
+		return NewRedisResponseCache(client, health), nil
+	case cacheBackendMemory, "":
+		return NewMemoryResponseCache(config.CacheMemorySize), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %s", config.CacheBackend)
+	}
+}
+
+// predictionCacheKey scopes a request hash to its model, and to its user
+// when the outputs of the model are private.
+func predictionCacheKey(modelName string, userID string, private bool, requestKey string) string {
+	if private {
+		return fmt.Sprintf("%s:%s:user:%s:%s", cacheKeyPrefix, modelName, userID, requestKey)
+	}
+	return fmt.Sprintf("%s:%s:%s", cacheKeyPrefix, modelName, requestKey)
+}
+
+// RedisResponseCache misses while Redis is unavailable.
+type RedisResponseCache struct {
+	client *goredis.Client
+	health *utils.RedisHealth
+}
+
+func NewRedisResponseCache(client *goredis.Client, health *utils.RedisHealth) ResponseCache {
+	return &RedisResponseCache{client: client, health: health}
+}
+
+func (cache *RedisResponseCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	if !cache.health.Available() {
+		return nil, false, nil
+	}
+	value, err := cache.client.Get(ctx, key).Bytes()
+	if err == goredis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		cache.health.Fail(err)
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (cache *RedisResponseCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if !cache.health.Available() {
+		return nil
+	}
+	err := cache.client.Set(ctx, key, value, ttl).Err()
+	cache.health.Fail(err)
+	return err
+}
+
+type memoryCacheEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// MemoryResponseCache is a per-instance LRU cache.
+type MemoryResponseCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+func NewMemoryResponseCache(capacity int) ResponseCache {
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	return &MemoryResponseCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (cache *MemoryResponseCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return nil, false, nil
+	}
+	cache.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+func (cache *MemoryResponseCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*memoryCacheEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		cache.order.MoveToFront(element)
+		return nil
+	}
+	cache.entries[key] = cache.order.PushFront(&memoryCacheEntry{
+		key:       key,
+		value:     value,
+		expiresAt: expiresAt,
+	})
+	for cache.order.Len() > cache.capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPredictionCache(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"outputs": "test"}`))
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress: upstream.URL,
+		Models: map[string]utils.ModelConfig{
+			"shared":  {Cache: utils.CacheConfig{Enabled: true, TTL: time.Minute}},
+			"private": {Cache: utils.CacheConfig{Enabled: true, TTL: time.Minute, Private: true}},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		modelName     string
+		userID        string
+		cacheControl  string
+		expectedCache string
+		expectedCalls int32
+	}{
+		{name: "SharedMiss", modelName: "shared", userID: "1", expectedCache: "MISS", expectedCalls: 1},
+		{name: "SharedHit", modelName: "shared", userID: "2", expectedCache: "HIT", expectedCalls: 1},
+		{name: "NoCache", modelName: "shared", userID: "2", cacheControl: "no-cache", expectedCache: "MISS", expectedCalls: 2},
+		{name: "PrivateMiss", modelName: "private", userID: "1", expectedCache: "MISS", expectedCalls: 3},
+		{name: "PrivateOtherUser", modelName: "private", userID: "2", expectedCache: "MISS", expectedCalls: 4},
+		{name: "PrivateHit", modelName: "private", userID: "1", expectedCache: "HIT", expectedCalls: 4},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := json.Marshal(gin.H{
+				"model_name": tc.modelName,
+				"inputs":     gin.H{"prompt": "a cat"},
+			})
+			require.NoError(t, err)
+
+			recorder := httptest.NewRecorder()
+			request, err := http.NewRequest(http.MethodPost, "/v1/predict", bytes.NewReader(data))
+			require.NoError(t, err)
+			request.Header.Set("UID", tc.userID)
+			if tc.cacheControl != "" {
+				request.Header.Set("Cache-Control", tc.cacheControl)
+			}
+			server.router.ServeHTTP(recorder, request)
+
+			require.Equal(t, http.StatusOK, recorder.Code)
+			require.JSONEq(t, `{"outputs": "test"}`, recorder.Body.String())
+			require.Equal(t, tc.expectedCache, recorder.Header().Get("X-Cache"))
+			require.Equal(t, tc.expectedCalls, atomic.LoadInt32(&calls))
+		})
+	}
+}
+
+func TestRedisCacheUnavailable(t *testing.T) {
+	_, err := NewServer(utils.Config{CacheBackend: cacheBackendRedis}, nil)
+	require.Error(t, err)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"outputs": "test"}`))
+	}))
+	defer upstream.Close()
+	// The server starts while Redis is down, and the predictions miss the cache
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress: upstream.URL,
+		CacheBackend:        cacheBackendRedis,
+		RedisAddress:        "127.0.0.1:1",
+		Models: map[string]utils.ModelConfig{
+			"test": {Cache: utils.CacheConfig{Enabled: true, TTL: time.Minute}},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(http.MethodPost, "/v1/predict",
+			bytes.NewReader([]byte(`{"model_name": "test", "inputs": {"prompt": "a cat"}}`)))
+		require.NoError(t, err)
+		request.Header.Set("UID", "1")
+		server.router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, "MISS", recorder.Header().Get("X-Cache"))
+	}
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync"
+)
+
+// coalescedResult is the outcome of a serving agent call shared by all its waiters.
+type coalescedResult struct {
+	statusCode int
+	outputs    map[string]interface{}
+	err        error
+}
+
+type coalescedCall struct {
+	wg      sync.WaitGroup
+	waiters int
+	result  coalescedResult
+}
+
+// Coalescer merges identical concurrent calls into one, so that only the first
+// caller reaches the serving agent and the others wait for its result.
+type Coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+func NewCoalescer() *Coalescer {
+	return &Coalescer{calls: make(map[string]*coalescedCall)}
+}
+
+// Do runs fn once for all the concurrent callers with the same key.
+// The returned outputs are shared and must not be modified. A panic of fn is returned
+// as an error to all the callers, so that the waiters are never left blocked.
+func (coalescer *Coalescer) Do(modelName string, key string, fn func() coalescedResult) (result coalescedResult) {
+	coalescer.mu.Lock()
+	if call, ok := coalescer.calls[key]; ok {
+		call.waiters++
+		coalescer.mu.Unlock()
+		coalescedRequests.WithLabelValues(modelName, "hit").Inc()
+		call.wg.Wait()
+		return call.result
+	}
+	call := &coalescedCall{waiters: 1}
+	call.wg.Add(1)
+	coalescer.calls[key] = call
+	coalescer.mu.Unlock()
+	coalescedRequests.WithLabelValues(modelName, "miss").Inc()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().Str("model", modelName).Interface("panic", r).Msg("a coalesced call panicked")
+			call.result = coalescedResult{
+				statusCode: http.StatusInternalServerError,
+				err:        fmt.Errorf("the prediction failed: %v", r),
+			}
+		}
+		coalescer.mu.Lock()
+		delete(coalescer.calls, key)
+		waiters := call.waiters
+		coalescer.mu.Unlock()
+		coalescedWaiters.WithLabelValues(modelName).Observe(float64(waiters))
+		call.wg.Done()
+		result = call.result
+	}()
+	call.result = fn()
+	return call.result
+}
+
+// inferRequestKey returns a canonical hash of a prediction request.
+// Object keys are sorted by json.Marshal, so equal inputs give equal keys.
+func inferRequestKey(req InferRequest) (string, error) {
+	data, err := json.Marshal(struct {
+		ModelName string                 `json:"model_name"`
+		Inputs    map[string]interface{} `json:"inputs"`
+	}{req.ModelName, req.Inputs})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescePredict(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"outputs": "test"}`))
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress: upstream.URL,
+		Models: map[string]utils.ModelConfig{
+			"deterministic": {Deterministic: true},
+			"private":       {Deterministic: true, Cache: utils.CacheConfig{Private: true}},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name           string
+		modelName      string
+		users          int
+		idempotencyKey bool
+		expectedCalls  int32
+	}{
+		{name: "Deterministic", modelName: "deterministic", users: 2, expectedCalls: 1},
+		{name: "NotDeterministic", modelName: "other", users: 1, expectedCalls: 6},
+		// The requests are only coalesced per user
+		{name: "Private", modelName: "private", users: 2, expectedCalls: 2},
+		// Each idempotency key reaches the agent
+		{name: "IdempotencyKey", modelName: "deterministic", users: 1, idempotencyKey: true, expectedCalls: 6},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			data, err := json.Marshal(gin.H{
+				"model_name": tc.modelName,
+				"inputs":     gin.H{"prompt": "a cat", "steps": 4},
+			})
+			require.NoError(t, err)
+
+			var wg sync.WaitGroup
+			for n := 0; n < 6; n++ {
+				wg.Add(1)
+				userID := strconv.Itoa(n % tc.users)
+				idempotencyKey := ""
+				if tc.idempotencyKey {
+					idempotencyKey = "key-" + strconv.Itoa(n)
+				}
+				go func() {
+					defer wg.Done()
+					recorder := httptest.NewRecorder()
+					request, err := http.NewRequest(http.MethodPost, "/v1/predict", bytes.NewReader(data))
+					require.NoError(t, err)
+					request.Header.Set("UID", userID)
+					if idempotencyKey != "" {
+						request.Header.Set(idempotencyKeyHeader, idempotencyKey)
+					}
+					server.router.ServeHTTP(recorder, request)
+					require.Equal(t, http.StatusOK, recorder.Code)
+					require.JSONEq(t, `{"outputs": "test"}`, recorder.Body.String())
+				}()
+			}
+			wg.Wait()
+			require.Equal(t, tc.expectedCalls, atomic.LoadInt32(&calls))
+		})
+	}
+}
+
+func TestCoalescerPanic(t *testing.T) {
+	coalescer := NewCoalescer()
+	waiting := func() bool {
+		coalescer.mu.Lock()
+		defer coalescer.mu.Unlock()
+		call, ok := coalescer.calls["key"]
+		return ok && call.waiters == 2
+	}
+
+	waiter := make(chan coalescedResult)
+	leader := coalescer.Do("test", "key", func() coalescedResult {
+		go func() {
+			waiter <- coalescer.Do("test", "key", func() coalescedResult {
+				return coalescedResult{statusCode: http.StatusOK}
+			})
+		}()
+		require.Eventually(t, waiting, time.Second, time.Millisecond)
+		panic("failed")
+	})
+	require.Equal(t, http.StatusInternalServerError, leader.statusCode)
+	require.ErrorContains(t, leader.err, "failed")
+	require.Equal(t, leader, <-waiter)
+	require.Empty(t, coalescer.calls)
+}
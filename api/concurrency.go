@@ -0,0 +1,304 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	goredis "github.com/redis/go-redis/v9"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	concurrencyLeaseTTL       = 30 * time.Second
+	concurrencyRenewInterval  = 10 * time.Second
+	concurrencyPollInterval   = 100 * time.Millisecond
+	defaultConcurrencyWaiters = 10
+)
+
+// acquireLeaseScript drops the expired leases of a user, then adds a lease if a slot is free.
+// KEYS[1]: the lease set, ARGV: now (ms), lease expiry (ms), limit, lease ID, set TTL (ms).
+var acquireLeaseScript = goredis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if redis.call('ZCARD', KEYS[1]) < tonumber(ARGV[3]) then
+	redis.call('ZADD', KEYS[1], ARGV[2], ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], ARGV[5])
+	return 1
+end
+return 0
+`)
+
+// slotStore holds the leases of the in-flight requests of the users.
+type slotStore interface {
+	acquire(ctx context.Context, key string, lease string, limit int, ttl time.Duration) (bool, error)
+	renew(ctx context.Context, key string, lease string, ttl time.Duration) error
+	release(ctx context.Context, key string, lease string) error
+}
+
+type redisSlotStore struct {
+	client *goredis.Client
+}
+
+func (store *redisSlotStore) acquire(
+	ctx context.Context,
+	key string,
+	lease string,
+	limit int,
+	ttl time.Duration,
+) (bool, error) {
+	now := time.Now()
+	acquired, err := acquireLeaseScript.Run(ctx, store.client, []string{key},
+		now.UnixMilli(), now.Add(ttl).UnixMilli(), limit, lease, ttl.Milliseconds()).Int()
+	return acquired == 1, err
+}
+
+func (store *redisSlotStore) renew(ctx context.Context, key string, lease string, ttl time.Duration) error {
+	expiresAt := time.Now().Add(ttl)
+	pipe := store.client.TxPipeline()
+	pipe.ZAddXX(ctx, key, goredis.Z{Score: float64(expiresAt.UnixMilli()), Member: lease})
+	pipe.PExpire(ctx, key, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (store *redisSlotStore) release(ctx context.Context, key string, lease string) error {
+	return store.client.ZRem(ctx, key, lease).Err()
+}
+
+// memorySlotStore counts the slots per instance, it is used while Redis is unavailable.
+type memorySlotStore struct {
+	mu     sync.Mutex
+	leases map[string]map[string]time.Time
+}
+
+func newMemorySlotStore() *memorySlotStore {
+	return &memorySlotStore{leases: make(map[string]map[string]time.Time)}
+}
+
+func (store *memorySlotStore) acquire(
+	_ context.Context,
+	key string,
+	lease string,
+	limit int,
+	ttl time.Duration,
+) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	leases, ok := store.leases[key]
+	if !ok {
+		leases = make(map[string]time.Time)
+		store.leases[key] = leases
+	}
+	for id, expiresAt := range leases {
+		if now.After(expiresAt) {
+			delete(leases, id)
+		}
+	}
+	if len(leases) >= limit {
+		return false, nil
+	}
+	leases[lease] = now.Add(ttl)
+	return true, nil
+}
+
+func (store *memorySlotStore) renew(_ context.Context, key string, lease string, ttl time.Duration) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if leases, ok := store.leases[key]; ok {
+		if _, ok = leases[lease]; ok {
+			leases[lease] = time.Now().Add(ttl)
+		}
+	}
+	return nil
+}
+
+func (store *memorySlotStore) release(_ context.Context, key string, lease string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if leases, ok := store.leases[key]; ok {
+		delete(leases, lease)
+		if len(leases) == 0 {
+			delete(store.leases, key)
+		}
+	}
+	return nil
+}
+
+// ConcurrencyLimiter caps the in-flight requests of each user. Slots are leases in
+// Redis that are renewed while the request runs, so that the slots held by a crashed
+// replica expire. While Redis is unavailable, the slots are counted per instance.
+type ConcurrencyLimiter struct {
+	policies  []utils.ConcurrencyPolicy
+	plans     *PlanResolver
+	overrides *OverrideStore
+	redis     slotStore
+	health    *utils.RedisHealth
+	memory    slotStore
+	mu        sync.Mutex
+	waiting   map[string]int
+}
+
+func NewConcurrencyLimiter(
+	policies []utils.ConcurrencyPolicy,
+	client *goredis.Client,
+	health *utils.RedisHealth,
+	plans *PlanResolver,
+	overrides *OverrideStore,
+) *ConcurrencyLimiter {
+	limiter := &ConcurrencyLimiter{
+		policies:  policies,
+		plans:     plans,
+		overrides: overrides,
+		health:    health,
+		memory:    newMemorySlotStore(),
+		waiting:   make(map[string]int),
+	}
+	if client != nil {
+		limiter.redis = &redisSlotStore{client: client}
+	}
+	return limiter
+}
+
+func (limiter *ConcurrencyLimiter) match(plan string, group string) *utils.ConcurrencyPolicy {
+	var best *utils.ConcurrencyPolicy
+	bestScore := -1
+	for i := range limiter.policies {
+		policy := &limiter.policies[i]
+		score := policySpecificity([]string{policy.Plan, policy.Group}, []string{plan, group})
+		if score > bestScore {
+			best, bestScore = policy, score
+		}
+	}
+	return best
+}
+
+// tryAcquire takes a slot from Redis, or from the memory store while Redis is unavailable.
+func (limiter *ConcurrencyLimiter) tryAcquire(
+	ctx context.Context,
+	key string,
+	lease string,
+	limit int,
+) (slotStore, bool) {
+	if limiter.redis != nil && limiter.health.Available() {
+		acquired, err := limiter.redis.acquire(ctx, key, lease, limit, concurrencyLeaseTTL)
+		if err == nil {
+			return limiter.redis, acquired
+		}
+		limiter.health.Fail(err)
+		requestLogger(ctx).Error().Err(err).Msg("failed to acquire a concurrency slot in redis")
+	}
+	acquired, _ := limiter.memory.acquire(ctx, key, lease, limit, concurrencyLeaseTTL)
+	return limiter.memory, acquired
+}
+
+// acquire takes a slot, waiting up to the queue timeout of the policy for one to be freed.
+func (limiter *ConcurrencyLimiter) acquire(
+	ctx context.Context,
+	key string,
+	lease string,
+	policy *utils.ConcurrencyPolicy,
+) (slotStore, bool) {
+	store, acquired := limiter.tryAcquire(ctx, key, lease, policy.Limit)
+	if acquired || policy.QueueTimeout <= 0 {
+		return store, acquired
+	}
+
+	maxWaiters := policy.QueueSize
+	if maxWaiters <= 0 {
+		maxWaiters = defaultConcurrencyWaiters
+	}
+	limiter.mu.Lock()
+	if limiter.waiting[key] >= maxWaiters {
+		limiter.mu.Unlock()
+		return nil, false
+	}
+	limiter.waiting[key]++
+	limiter.mu.Unlock()
+	defer func() {
+		limiter.mu.Lock()
+		limiter.waiting[key]--
+		if limiter.waiting[key] == 0 {
+			delete(limiter.waiting, key)
+		}
+		limiter.mu.Unlock()
+	}()
+
+	timeout := time.NewTimer(policy.QueueTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-timeout.C:
+			return nil, false
+		case <-time.After(concurrencyPollInterval):
+			if store, acquired = limiter.tryAcquire(ctx, key, lease, policy.Limit); acquired {
+				return store, true
+			}
+		}
+	}
+}
+
+// Middleware caps the in-flight requests of a user in a route group.
+func (limiter *ConcurrencyLimiter) Middleware(group string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userID := ctx.Request.Header.Get("UID")
+		if limiter.overrides.Allowlisted(userID) {
+			ctx.Next()
+			return
+		}
+		policy := limiter.match(limiter.plans.Plan(ctx.Request.Context(), userID), group)
+		if policy == nil || policy.Limit <= 0 {
+			ctx.Next()
+			return
+		}
+
+		key := fmt.Sprintf("concurrency:%s:%s", wildcard(policy.Group), userID)
+		lease := newLeaseID()
+		store, acquired := limiter.acquire(ctx.Request.Context(), key, lease, policy)
+		if !acquired {
+			concurrencyRejections.WithLabelValues(group).Inc()
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error": fmt.Sprintf("too many concurrent requests, the limit is %d", policy.Limit),
+			})
+			return
+		}
+
+		// Renew the lease until the request completes, e.g., for long streams
+		done := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(concurrencyRenewInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if err := store.renew(context.Background(), key, lease, concurrencyLeaseTTL); err != nil {
+						requestLogger(ctx.Request.Context()).Error().Err(err).
+							Msg("failed to renew a concurrency slot")
+					}
+				}
+			}
+		}()
+		defer func() {
+			close(done)
+			if err := store.release(context.Background(), key, lease); err != nil {
+				requestLogger(ctx.Request.Context()).Error().Err(err).
+					Msg("failed to release a concurrency slot")
+			}
+		}()
+		ctx.Next()
+	}
+}
+
+func newLeaseID() string {
+	data := make([]byte, 16)
+	_, _ = rand.Read(data)
+	return hex.EncodeToString(data)
+}
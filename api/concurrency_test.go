@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemorySlotStore(t *testing.T) {
+	store := newMemorySlotStore()
+	ctx := context.Background()
+
+	acquired, err := store.acquire(ctx, "key", "a", 2, time.Minute)
+	require.NoError(t, err)
+	require.True(t, acquired)
+	acquired, err = store.acquire(ctx, "key", "b", 2, time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, acquired)
+	acquired, err = store.acquire(ctx, "key", "c", 2, time.Minute)
+	require.NoError(t, err)
+	require.False(t, acquired)
+
+	// The expired leases free their slots
+	time.Sleep(5 * time.Millisecond)
+	acquired, err = store.acquire(ctx, "key", "c", 2, time.Minute)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	require.NoError(t, store.renew(ctx, "key", "a", time.Millisecond))
+	require.NoError(t, store.release(ctx, "key", "c"))
+	time.Sleep(5 * time.Millisecond)
+	acquired, err = store.acquire(ctx, "key", "d", 1, time.Minute)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	require.NoError(t, store.release(ctx, "key", "d"))
+	require.Empty(t, store.leases)
+}
+
+func TestConcurrencyLimiterMatch(t *testing.T) {
+	limiter := NewConcurrencyLimiter([]utils.ConcurrencyPolicy{
+		{Limit: 10},
+		{Plan: "free", Limit: 1},
+		{Plan: "free", Group: rateLimitGroupAsync, Limit: 2},
+	}, nil, nil, nil, nil)
+
+	require.Equal(t, 10, limiter.match("pro", rateLimitGroupSync).Limit)
+	require.Equal(t, 1, limiter.match("free", rateLimitGroupSync).Limit)
+	require.Equal(t, 2, limiter.match("free", rateLimitGroupAsync).Limit)
+	require.Nil(t, NewConcurrencyLimiter(nil, nil, nil, nil, nil).match("pro", rateLimitGroupSync))
+}
+
+func TestConcurrencyMiddleware(t *testing.T) {
+	started := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"outputs": "test"}`))
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress: upstream.URL,
+		// Redis is unreachable, the slots are counted in memory
+		RedisAddress: "127.0.0.1:1",
+		RateLimits: utils.RateLimitConfig{
+			Users: map[string]string{"2": "patient"},
+			Concurrency: []utils.ConcurrencyPolicy{
+				{Limit: 1},
+				{Plan: "patient", Limit: 1, QueueTimeout: 5 * time.Second},
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, server.Close(context.Background()))
+	}()
+
+	predict := func(userID string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(http.MethodPost, "/v1/predict",
+			bytes.NewReader([]byte(`{"model_name": "test", "inputs": {"prompt": "a cat"}}`)))
+		require.NoError(t, err)
+		request.Header.Set("UID", userID)
+		server.router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	var wg sync.WaitGroup
+	codes := make(map[string]int)
+	var mu sync.Mutex
+	run := func(name string, userID string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code := predict(userID).Code
+			mu.Lock()
+			codes[name] = code
+			mu.Unlock()
+		}()
+	}
+
+	run("first", "1")
+	run("patientFirst", "2")
+	<-started
+	<-started
+	// The slots of the users are taken
+	require.Equal(t, http.StatusTooManyRequests, predict("1").Code)
+	// The patient user waits for its slot
+	run("patientSecond", "2")
+	time.Sleep(2 * concurrencyPollInterval)
+	close(unblock)
+	wg.Wait()
+	require.Equal(t, map[string]int{
+		"first":         http.StatusOK,
+		"patientFirst":  http.StatusOK,
+		"patientSecond": http.StatusOK,
+	}, codes)
+}
@@ -0,0 +1,431 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	goredis "github.com/redis/go-redis/v9"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	creditTopUp   = "topup"
+	creditReserve = "reserve"
+	creditCommit  = "commit"
+	creditRefund  = "refund"
+)
+
+const (
+	defaultTransactionCount = 50
+	maxTransactionCount     = 500
+)
+
+var (
+	ErrInsufficientCredits = errors.New("insufficient credits")
+	errCreditsUnavailable  = errors.New("the credit ledger is unavailable")
+	ErrInvalidReservation  = errors.New("the reserved amount must be positive")
+)
+
+// CreditTransaction is an entry of the append-only credit ledger of a user.
+type CreditTransaction struct {
+	ID        string  `json:"id"`
+	Type      string  `json:"type"`
+	Amount    float64 `json:"amount"`
+	Balance   float64 `json:"balance"`
+	Reference string  `json:"reference"`
+	Time      int64   `json:"time"`
+}
+
+// Ledger holds the credit balances of the users and their transactions.
+type Ledger interface {
+	Balance(ctx context.Context, userID string) (float64, error)
+	// Reserve holds a positive amount from the balance, or fails with ErrInsufficientCredits.
+	Reserve(ctx context.Context, userID string, amount float64, reference string) (float64, error)
+	// Commit settles a reservation at its actual amount, returning the difference to the balance.
+	Commit(ctx context.Context, userID string, reserved float64, actual float64, reference string) error
+	Refund(ctx context.Context, userID string, amount float64, reference string) error
+	TopUp(ctx context.Context, userID string, amount float64, reference string) (float64, error)
+	// Transactions returns the latest transactions first.
+	Transactions(ctx context.Context, userID string, count int) ([]CreditTransaction, error)
+}
+
+// reserveCreditsScript holds a positive amount from a balance if it is sufficient, and appends it to the ledger.
+// KEYS: the balance and the ledger stream, ARGV: amount, reference, time.
+var reserveCreditsScript = goredis.NewScript(`
+local amount = tonumber(ARGV[1])
+local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+if not amount or amount <= 0 then
+	return {-1, tostring(balance)}
+end
+if balance < amount then
+	return {0, tostring(balance)}
+end
+balance = redis.call('INCRBYFLOAT', KEYS[1], -amount)
+redis.call('XADD', KEYS[2], '*', 'type', 'reserve', 'amount', ARGV[1], 'balance', balance,
+	'reference', ARGV[2], 'time', ARGV[3])
+return {1, balance}
+`)
+
+// applyCreditsScript changes a balance and appends the transaction to the ledger.
+// KEYS: the balance and the ledger stream, ARGV: type, amount, balance change, reference, time.
+var applyCreditsScript = goredis.NewScript(`
+local balance = redis.call('INCRBYFLOAT', KEYS[1], ARGV[3])
+redis.call('XADD', KEYS[2], '*', 'type', ARGV[1], 'amount', ARGV[2], 'balance', balance,
+	'reference', ARGV[4], 'time', ARGV[5])
+return balance
+`)
+
+// RedisLedger keeps the balances in Redis and the transactions in Redis streams.
+// The reservations fail fast while Redis is unavailable, the settlements are always tried.
+type RedisLedger struct {
+	client *goredis.Client
+	health *utils.RedisHealth
+}
+
+func NewRedisLedger(client *goredis.Client, health *utils.RedisHealth) Ledger {
+	return &RedisLedger{client: client, health: health}
+}
+
+func creditKeys(userID string) []string {
+	return []string{
+		fmt.Sprintf("credits:%s:balance", userID),
+		fmt.Sprintf("credits:%s:ledger", userID),
+	}
+}
+
+func (ledger *RedisLedger) Balance(ctx context.Context, userID string) (float64, error) {
+	balance, err := ledger.client.Get(ctx, creditKeys(userID)[0]).Float64()
+	if err == goredis.Nil {
+		return 0, nil
+	}
+	return balance, err
+}
+
+func (ledger *RedisLedger) Reserve(
+	ctx context.Context,
+	userID string,
+	amount float64,
+	reference string,
+) (float64, error) {
+	if !(amount > 0) {
+		return 0, ErrInvalidReservation
+	}
+	if !ledger.health.Available() {
+		return 0, errCreditsUnavailable
+	}
+	result, err := reserveCreditsScript.Run(ctx, ledger.client, creditKeys(userID),
+		amount, reference, time.Now().Unix()).Slice()
+	if err != nil {
+		ledger.health.Fail(err)
+		return 0, err
+	}
+	balance, _ := strconv.ParseFloat(fmt.Sprint(result[1]), 64)
+	switch result[0].(int64) {
+	case -1:
+		return balance, ErrInvalidReservation
+	case 0:
+		return balance, ErrInsufficientCredits
+	}
+	return balance, nil
+}
+
+func (ledger *RedisLedger) apply(
+	ctx context.Context,
+	userID string,
+	transactionType string,
+	amount float64,
+	change float64,
+	reference string,
+) (float64, error) {
+	balance, err := applyCreditsScript.Run(ctx, ledger.client, creditKeys(userID),
+		transactionType, amount, change, reference, time.Now().Unix()).Float64()
+	ledger.health.Fail(err)
+	return balance, err
+}
+
+func (ledger *RedisLedger) Commit(
+	ctx context.Context,
+	userID string,
+	reserved float64,
+	actual float64,
+	reference string,
+) error {
+	_, err := ledger.apply(ctx, userID, creditCommit, actual, reserved-actual, reference)
+	return err
+}
+
+func (ledger *RedisLedger) Refund(ctx context.Context, userID string, amount float64, reference string) error {
+	_, err := ledger.apply(ctx, userID, creditRefund, amount, amount, reference)
+	return err
+}
+
+func (ledger *RedisLedger) TopUp(ctx context.Context, userID string, amount float64, reference string) (float64, error) {
+	return ledger.apply(ctx, userID, creditTopUp, amount, amount, reference)
+}
+
+func (ledger *RedisLedger) Transactions(ctx context.Context, userID string, count int) ([]CreditTransaction, error) {
+	messages, err := ledger.client.XRevRangeN(ctx, creditKeys(userID)[1], "+", "-", int64(count)).Result()
+	if err != nil {
+		return nil, err
+	}
+	transactions := make([]CreditTransaction, 0, len(messages))
+	for _, message := range messages {
+		transaction := CreditTransaction{ID: message.ID}
+		transaction.Type, _ = message.Values["type"].(string)
+		transaction.Reference, _ = message.Values["reference"].(string)
+		transaction.Amount, _ = strconv.ParseFloat(fmt.Sprint(message.Values["amount"]), 64)
+		transaction.Balance, _ = strconv.ParseFloat(fmt.Sprint(message.Values["balance"]), 64)
+		transaction.Time, _ = strconv.ParseInt(fmt.Sprint(message.Values["time"]), 10, 64)
+		transactions = append(transactions, transaction)
+	}
+	return transactions, nil
+}
+
+// MemoryLedger keeps the ledger in memory, it is only meant for development and tests.
+type MemoryLedger struct {
+	mu           sync.Mutex
+	balances     map[string]float64
+	transactions map[string][]CreditTransaction
+	sequence     int
+}
+
+func NewMemoryLedger() Ledger {
+	return &MemoryLedger{
+		balances:     make(map[string]float64),
+		transactions: make(map[string][]CreditTransaction),
+	}
+}
+
+func (ledger *MemoryLedger) Balance(_ context.Context, userID string) (float64, error) {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	return ledger.balances[userID], nil
+}
+
+func (ledger *MemoryLedger) Reserve(_ context.Context, userID string, amount float64, reference string) (float64, error) {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	if !(amount > 0) {
+		return ledger.balances[userID], ErrInvalidReservation
+	}
+	if ledger.balances[userID] < amount {
+		return ledger.balances[userID], ErrInsufficientCredits
+	}
+	return ledger.apply(userID, creditReserve, amount, -amount, reference), nil
+}
+
+func (ledger *MemoryLedger) apply(
+	userID string,
+	transactionType string,
+	amount float64,
+	change float64,
+	reference string,
+) float64 {
+	ledger.sequence++
+	ledger.balances[userID] += change
+	ledger.transactions[userID] = append(ledger.transactions[userID], CreditTransaction{
+		ID:        strconv.Itoa(ledger.sequence),
+		Type:      transactionType,
+		Amount:    amount,
+		Balance:   ledger.balances[userID],
+		Reference: reference,
+		Time:      time.Now().Unix(),
+	})
+	return ledger.balances[userID]
+}
+
+func (ledger *MemoryLedger) Commit(_ context.Context, userID string, reserved float64, actual float64, reference string) error {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	ledger.apply(userID, creditCommit, actual, reserved-actual, reference)
+	return nil
+}
+
+func (ledger *MemoryLedger) Refund(_ context.Context, userID string, amount float64, reference string) error {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	ledger.apply(userID, creditRefund, amount, amount, reference)
+	return nil
+}
+
+func (ledger *MemoryLedger) TopUp(_ context.Context, userID string, amount float64, reference string) (float64, error) {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	return ledger.apply(userID, creditTopUp, amount, amount, reference), nil
+}
+
+func (ledger *MemoryLedger) Transactions(_ context.Context, userID string, count int) ([]CreditTransaction, error) {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	history := ledger.transactions[userID]
+	transactions := make([]CreditTransaction, 0, count)
+	for i := len(history) - 1; i >= 0 && len(transactions) < count; i-- {
+		transactions = append(transactions, history[i])
+	}
+	return transactions, nil
+}
+
+// CreditManager charges the predictions of the users of the pay-as-you-go plans to their credits.
+type CreditManager struct {
+	ledger     Ledger
+	plans      *PlanResolver
+	models     map[string]utils.ModelConfig
+	transforms map[string]*Transform
+	// Plans whose users pay with credits
+	creditPlans map[string]bool
+}
+
+func NewCreditManager(
+	config utils.Config,
+	ledger Ledger,
+	plans *PlanResolver,
+	transforms map[string]*Transform,
+) *CreditManager {
+	creditPlans := make(map[string]bool)
+	for _, plan := range config.CreditPlans {
+		creditPlans[plan] = true
+	}
+	return &CreditManager{
+		ledger:      ledger,
+		plans:       plans,
+		models:      config.Models,
+		transforms:  transforms,
+		creditPlans: creditPlans,
+	}
+}
+
+// Middleware reserves the estimated cost of a prediction before proxying it. The reservation
+// is committed at the cost reported by the serving agent if any, and refunded if the call
+// fails or the client cancels it.
+func (manager *CreditManager) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if len(manager.creditPlans) == 0 {
+			ctx.Next()
+			return
+		}
+		userID := ctx.Request.Header.Get("UID")
+		if !manager.creditPlans[manager.plans.Plan(ctx.Request.Context(), userID)] {
+			ctx.Next()
+			return
+		}
+		req, ok := peekInferRequest(ctx)
+		if !ok {
+			// The handler rejects the invalid request
+			ctx.Next()
+			return
+		}
+		estimated, err := requestCost(manager.models[req.ModelName].Cost, manager.transforms[req.ModelName], req.Inputs)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, errorResponse(err))
+			return
+		}
+
+		reference := newLeaseID()
+		balance, err := manager.ledger.Reserve(ctx.Request.Context(), userID, estimated, reference)
+		if errors.Is(err, ErrInsufficientCredits) {
+			ctx.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{
+				"error":    err.Error(),
+				"balance":  balance,
+				"required": estimated,
+			})
+			return
+		}
+		if err != nil {
+			requestLogger(ctx.Request.Context()).Error().Err(err).Msg("failed to reserve credits")
+			ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, errorResponse(
+				errors.New("credits are unavailable")))
+			return
+		}
+
+		ctx.Next()
+
+		// The client context may be cancelled, so the ledger is updated in the background context
+		failed := ctx.Writer.Status() >= http.StatusBadRequest || len(ctx.Errors) > 0 ||
+			ctx.Request.Context().Err() != nil
+		if failed {
+			err = manager.ledger.Refund(context.Background(), userID, estimated, reference)
+		} else {
+			actual := estimated
+			if reported, ok := ctx.Get(reportedCostKey); ok {
+				// A negative reported cost would credit the user
+				actual = max(reported.(float64), 0)
+			}
+			err = manager.ledger.Commit(context.Background(), userID, estimated, actual, reference)
+		}
+		if err != nil {
+			requestLogger(ctx.Request.Context()).Error().Err(err).Str("reference", reference).
+				Msg("failed to settle credits")
+		}
+	}
+}
+
+type TopUpRequest struct {
+	Amount    float64 `json:"amount" binding:"required,gt=0"`
+	Reference string  `json:"reference"`
+}
+
+type UserRequest struct {
+	UserID string `uri:"uid" binding:"required"`
+}
+
+type TransactionRequest struct {
+	Limit int `form:"limit"`
+}
+
+func (server *Server) getCredits(ctx *gin.Context) {
+	userID := ctx.Request.Header.Get("UID")
+	balance, err := server.credits.ledger.Balance(ctx.Request.Context(), userID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"balance": balance})
+}
+
+func (server *Server) getCreditTransactions(ctx *gin.Context) {
+	var req TransactionRequest
+	if err := ctx.ShouldBindQuery(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultTransactionCount
+	}
+	if req.Limit > maxTransactionCount {
+		req.Limit = maxTransactionCount
+	}
+	userID := ctx.Request.Header.Get("UID")
+	transactions, err := server.credits.ledger.Transactions(ctx.Request.Context(), userID, req.Limit)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, transactions)
+}
+
+func (server *Server) topUpCredits(ctx *gin.Context) {
+	defer server.audit.recordOutcome(ctx, auditCreditsTopUp, ctx.Param("uid"))
+	var user UserRequest
+	if err := ctx.ShouldBindUri(&user); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	var req TopUpRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	balance, err := server.credits.ledger.TopUp(ctx.Request.Context(), user.UserID, req.Amount, req.Reference)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+	requestLogger(ctx.Request.Context()).Info().Str("uid", user.UserID).Float64("amount", req.Amount).
+		Str("reference", req.Reference).Msg("topped up credits")
+	ctx.JSON(http.StatusOK, gin.H{"balance": balance})
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCredits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req InferRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		if req.Inputs["fail"] == true {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error": "failed"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"outputs": "test", "usage": {"cost": 2}}`))
+	}))
+	defer upstream.Close()
+
+	config := utils.Config{
+		ServingAgentAddress: upstream.URL,
+		AdminAPIKey:         "secret",
+		Models: map[string]utils.ModelConfig{
+			"test":      {Cost: utils.CostConfig{Base: 5}},
+			"expensive": {Cost: utils.CostConfig{Base: 100}},
+		},
+	}
+	server, err := NewServer(config, nil)
+	require.NoError(t, err)
+	// The credit plans require Redis, the tests use the memory ledger instead
+	config.CreditPlans = []string{"default"}
+	*server.credits = *NewCreditManager(config, NewMemoryLedger(), server.plans, server.transforms)
+
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest(http.MethodPost, "/admin/credits/1/topup",
+		bytes.NewReader([]byte(`{"amount": 10, "reference": "invoice-1"}`)))
+	require.NoError(t, err)
+	request.Header.Set("apikey", "secret")
+	server.router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `{"balance": 10}`, recorder.Body.String())
+
+	testCases := []struct {
+		name            string
+		modelName       string
+		inputs          gin.H
+		expectedStatus  int
+		expectedBalance float64
+	}{
+		{name: "CommitReportedCost", modelName: "test", inputs: gin.H{"prompt": "a cat"},
+			expectedStatus: http.StatusOK, expectedBalance: 8},
+		{name: "RefundFailure", modelName: "test", inputs: gin.H{"fail": true},
+			expectedStatus: http.StatusInternalServerError, expectedBalance: 8},
+		{name: "InsufficientCredits", modelName: "expensive", inputs: gin.H{"prompt": "a cat"},
+			expectedStatus: http.StatusPaymentRequired, expectedBalance: 8},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := json.Marshal(gin.H{"model_name": tc.modelName, "inputs": tc.inputs})
+			require.NoError(t, err)
+
+			recorder := httptest.NewRecorder()
+			request, err := http.NewRequest(http.MethodPost, "/v1/predict", bytes.NewReader(data))
+			require.NoError(t, err)
+			request.Header.Set("UID", "1")
+			server.router.ServeHTTP(recorder, request)
+			require.Equal(t, tc.expectedStatus, recorder.Code)
+
+			recorder = httptest.NewRecorder()
+			request, err = http.NewRequest(http.MethodGet, "/v1/credits", nil)
+			require.NoError(t, err)
+			request.Header.Set("UID", "1")
+			server.router.ServeHTTP(recorder, request)
+			require.Equal(t, http.StatusOK, recorder.Code)
+
+			var balance struct {
+				Balance float64 `json:"balance"`
+			}
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &balance))
+			require.Equal(t, tc.expectedBalance, balance.Balance)
+		})
+	}
+
+	recorder = httptest.NewRecorder()
+	request, err = http.NewRequest(http.MethodGet, "/v1/credits/transactions?limit=3", nil)
+	require.NoError(t, err)
+	request.Header.Set("UID", "1")
+	server.router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var transactions []CreditTransaction
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &transactions))
+	require.Len(t, transactions, 3)
+	require.Equal(t, creditRefund, transactions[0].Type)
+	require.Equal(t, creditReserve, transactions[1].Type)
+	require.Equal(t, creditCommit, transactions[2].Type)
+	require.Equal(t, 8.0, transactions[2].Balance)
+}
+
+func TestCreditsRequireRedis(t *testing.T) {
+	_, err := NewServer(utils.Config{CreditPlans: []string{"default"}}, nil)
+	require.Error(t, err)
+	server, err := NewServer(utils.Config{CreditPlans: []string{"default"}, RedisAddress: "127.0.0.1:1"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, server.Close(context.Background()))
+}
+
+func TestMemoryLedgerReserve(t *testing.T) {
+	ledger := NewMemoryLedger()
+	ctx := context.Background()
+	_, err := ledger.TopUp(ctx, "1", 10, "invoice-1")
+	require.NoError(t, err)
+
+	// The non-positive reservations would mint credits
+	for _, amount := range []float64{0, -5} {
+		balance, err := ledger.Reserve(ctx, "1", amount, "reservation")
+		require.ErrorIs(t, err, ErrInvalidReservation)
+		require.Equal(t, 10.0, balance)
+	}
+	balance, err := ledger.Reserve(ctx, "1", 11, "reservation")
+	require.ErrorIs(t, err, ErrInsufficientCredits)
+	require.Equal(t, 10.0, balance)
+
+	balance, err = ledger.Reserve(ctx, "1", 4, "reservation")
+	require.NoError(t, err)
+	require.Equal(t, 6.0, balance)
+	require.NoError(t, ledger.Commit(ctx, "1", 4, 1, "reservation"))
+	balance, err = ledger.Balance(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, 9.0, balance)
+
+	transactions, err := ledger.Transactions(ctx, "1", 10)
+	require.NoError(t, err)
+	require.Len(t, transactions, 3)
+}
+
+func TestRedisLedgerReserve(t *testing.T) {
+	client := utils.NewRedisClient("127.0.0.1:1")
+	health := utils.NewRedisHealth(client)
+	health.Start(time.Hour)
+	defer health.Stop()
+
+	// The invalid amounts are rejected before reaching Redis
+	ledger := NewRedisLedger(client, health)
+	_, err := ledger.Reserve(context.Background(), "1", -5, "reservation")
+	require.ErrorIs(t, err, ErrInvalidReservation)
+	// The reservations fail fast while Redis is unavailable
+	_, err = ledger.Reserve(context.Background(), "1", 5, "reservation")
+	require.ErrorIs(t, err, errCreditsUnavailable)
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	server, err := NewServer(utils.Config{}, nil)
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest(http.MethodPost, "/admin/credits/1/topup",
+		bytes.NewReader([]byte(`{"amount": 10}`)))
+	require.NoError(t, err)
+	server.router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
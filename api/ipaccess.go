@@ -0,0 +1,297 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ipDeniedByList       = "deny_list"
+	ipNotAllowed         = "not_allowed"
+	ipDeniedByCountry    = "deny_country"
+	ipCountryNotAllowed  = "country_not_allowed"
+	defaultIPAccessCheck = 10 * time.Second
+)
+
+// ipRules are the compiled allow and deny lists of a scope.
+type ipRules struct {
+	allow          []*net.IPNet
+	deny           []*net.IPNet
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+}
+
+func compileIPRules(config utils.IPRules) (*ipRules, error) {
+	rules := &ipRules{
+		allowCountries: make(map[string]bool),
+		denyCountries:  make(map[string]bool),
+	}
+	var err error
+	if rules.allow, err = utils.ParseCIDRs(config.Allow); err != nil {
+		return nil, err
+	}
+	if rules.deny, err = utils.ParseCIDRs(config.Deny); err != nil {
+		return nil, err
+	}
+	for _, country := range config.AllowCountries {
+		rules.allowCountries[strings.ToUpper(country)] = true
+	}
+	for _, country := range config.DenyCountries {
+		rules.denyCountries[strings.ToUpper(country)] = true
+	}
+	return rules, nil
+}
+
+func (rules *ipRules) usesCountries() bool {
+	return len(rules.allowCountries) > 0 || len(rules.denyCountries) > 0
+}
+
+// check returns why an IP is denied, or an empty string if it is allowed.
+func (rules *ipRules) check(ip net.IP, country func() string) string {
+	if utils.ContainsIP(rules.deny, ip) {
+		return ipDeniedByList
+	}
+	if rules.usesCountries() {
+		code := country()
+		if rules.denyCountries[code] {
+			return ipDeniedByCountry
+		}
+		// An IP of an unknown country is not allowed by a country allow list
+		if len(rules.allowCountries) > 0 && !rules.allowCountries[code] {
+			return ipCountryNotAllowed
+		}
+	}
+	if len(rules.allow) > 0 && !utils.ContainsIP(rules.allow, ip) {
+		return ipNotAllowed
+	}
+	return ""
+}
+
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// IPAccessControl applies the IP allow and deny lists to the resolved client IPs. The lists and
+// the GeoIP database are reloaded when their files change.
+type IPAccessControl struct {
+	path     string
+	geoPath  string
+	interval time.Duration
+
+	mu     sync.RWMutex
+	global *ipRules
+	models map[string]*ipRules
+	geo    *maxminddb.Reader
+	// The modification times of the files when last loaded
+	modTime    time.Time
+	geoModTime time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewIPAccessControl loads the lists of a YAML file, and optionally a MaxMind database
+// for the country rules. It allows everything if the path is empty.
+func NewIPAccessControl(path string, geoPath string, interval time.Duration) (*IPAccessControl, error) {
+	if interval <= 0 {
+		interval = defaultIPAccessCheck
+	}
+	control := &IPAccessControl{
+		path:     path,
+		geoPath:  geoPath,
+		interval: interval,
+		global:   &ipRules{},
+		stop:     make(chan struct{}),
+	}
+	if err := control.reload(); err != nil {
+		return nil, err
+	}
+	return control, nil
+}
+
+// reload loads the files that changed since they were last loaded.
+func (control *IPAccessControl) reload() error {
+	if control.path != "" {
+		info, err := os.Stat(control.path)
+		if err != nil {
+			return err
+		}
+		control.mu.RLock()
+		changed := !info.ModTime().Equal(control.modTime)
+		control.mu.RUnlock()
+		if changed {
+			if err := control.loadRules(info.ModTime()); err != nil {
+				return err
+			}
+		}
+	}
+	if control.geoPath != "" {
+		info, err := os.Stat(control.geoPath)
+		if err != nil {
+			return err
+		}
+		control.mu.RLock()
+		changed := !info.ModTime().Equal(control.geoModTime)
+		control.mu.RUnlock()
+		if changed {
+			reader, err := maxminddb.Open(control.geoPath)
+			if err != nil {
+				return fmt.Errorf("failed to open the geoip database: %w", err)
+			}
+			control.mu.Lock()
+			previous := control.geo
+			control.geo, control.geoModTime = reader, info.ModTime()
+			control.mu.Unlock()
+			if previous != nil {
+				_ = previous.Close()
+			}
+			log.Info().Str("path", control.geoPath).Msg("loaded the geoip database")
+		}
+	}
+	return nil
+}
+
+func (control *IPAccessControl) loadRules(modTime time.Time) error {
+	config, err := utils.LoadIPAccessConfig(control.path)
+	if err != nil {
+		return fmt.Errorf("failed to load the ip access lists: %w", err)
+	}
+	global, err := compileIPRules(config.IPRules)
+	if err != nil {
+		return fmt.Errorf("invalid ip access lists: %w", err)
+	}
+	models := make(map[string]*ipRules, len(config.Models))
+	for modelName, modelConfig := range config.Models {
+		if models[modelName], err = compileIPRules(modelConfig); err != nil {
+			return fmt.Errorf("invalid ip access lists of model %s: %w", modelName, err)
+		}
+	}
+	control.mu.Lock()
+	control.global, control.models, control.modTime = global, models, modTime
+	control.mu.Unlock()
+	log.Info().Str("path", control.path).Int("models", len(models)).Msg("loaded the ip access lists")
+	return nil
+}
+
+// Start reloads the files when they change, the current lists stay in effect if a reload fails.
+func (control *IPAccessControl) Start() {
+	if control.path == "" && control.geoPath == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(control.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-control.stop:
+				return
+			case <-ticker.C:
+				if err := control.reload(); err != nil {
+					log.Error().Err(err).Str("path", control.path).Msg("failed to reload the ip access lists")
+				}
+			}
+		}
+	}()
+}
+
+func (control *IPAccessControl) Stop() {
+	control.stopOnce.Do(func() {
+		close(control.stop)
+	})
+}
+
+// country looks up the country code of an IP, it is empty if unknown.
+func (control *IPAccessControl) country(ip net.IP) string {
+	control.mu.RLock()
+	defer control.mu.RUnlock()
+	if control.geo == nil {
+		return ""
+	}
+	var record geoRecord
+	if err := control.geo.Lookup(ip, &record); err != nil {
+		log.Error().Err(err).Str("ip", ip.String()).Msg("failed to look up the country")
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+func (control *IPAccessControl) deny(ctx *gin.Context, scope string, reason string, err error) {
+	ipAccessDenials.WithLabelValues(scope, reason).Inc()
+	requestLogger(ctx.Request.Context()).Warn().Str("client_ip", ctx.ClientIP()).Str("scope", scope).
+		Str("reason", reason).Msg("denied the client ip")
+	ctx.AbortWithStatusJSON(http.StatusForbidden, errorResponse(err))
+}
+
+func (control *IPAccessControl) check(rules *ipRules, ip net.IP) string {
+	return rules.check(ip, func() string {
+		return control.country(ip)
+	})
+}
+
+// Middleware applies the global lists to every request.
+func (control *IPAccessControl) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ip := net.ParseIP(ctx.ClientIP())
+		control.mu.RLock()
+		rules := control.global
+		control.mu.RUnlock()
+		if ip != nil {
+			if reason := control.check(rules, ip); reason != "" {
+				control.deny(ctx, "global", reason, errors.New("access denied from this ip"))
+				return
+			}
+		}
+		ctx.Next()
+	}
+}
+
+// modelDenial returns why the client IP is denied access to a model, or an empty string.
+func (control *IPAccessControl) modelDenial(ctx *gin.Context, modelName string) string {
+	control.mu.RLock()
+	rules, ok := control.models[modelName]
+	control.mu.RUnlock()
+	ip := net.ParseIP(ctx.ClientIP())
+	if !ok || ip == nil {
+		return ""
+	}
+	return control.check(rules, ip)
+}
+
+// AllowModel applies the lists of a model once the handler knows it, e.g., the model of
+// a task. It aborts the request with 403 if the client IP is denied.
+func (control *IPAccessControl) AllowModel(ctx *gin.Context, modelName string) bool {
+	if reason := control.modelDenial(ctx, modelName); reason != "" {
+		control.deny(ctx, "model", reason, fmt.Errorf("access to model %s denied from this ip", modelName))
+		return false
+	}
+	return true
+}
+
+// ModelMiddleware applies the lists of the model of a request.
+func (control *IPAccessControl) ModelMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		control.mu.RLock()
+		hasRules := len(control.models) > 0
+		control.mu.RUnlock()
+		if !hasRules {
+			ctx.Next()
+			return
+		}
+		if !control.AllowModel(ctx, requestModelName(ctx)) {
+			return
+		}
+		ctx.Next()
+	}
+}
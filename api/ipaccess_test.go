@@ -0,0 +1,165 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	mockapi "github.com/HyperGAI/serving-api/api/mock"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIPAccessControl(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"outputs": "test"}`))
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "ipaccess.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+deny: [192.0.2.0/24]
+models:
+  enterprise:
+    allow: [203.0.113.0/24]
+`), 0o644))
+
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress: upstream.URL,
+		IPAccessConfigFile:  path,
+		TrustedProxies:      []string{"10.0.0.1"},
+		ClientIPHeaders:     []string{"X-Real-IP"},
+	}, nil)
+	require.NoError(t, err)
+	defer server.Close(context.Background())
+
+	testCases := []struct {
+		name           string
+		clientIP       string
+		modelName      string
+		expectedStatus int
+	}{
+		{name: "Allowed", clientIP: "198.51.100.1", modelName: "test", expectedStatus: http.StatusOK},
+		{name: "Denied", clientIP: "192.0.2.10", modelName: "test", expectedStatus: http.StatusForbidden},
+		{name: "ModelAllowed", clientIP: "203.0.113.5", modelName: "enterprise", expectedStatus: http.StatusOK},
+		{name: "ModelNotAllowed", clientIP: "198.51.100.1", modelName: "enterprise",
+			expectedStatus: http.StatusForbidden},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request, err := http.NewRequest(http.MethodPost, "/v1/predict",
+				bytes.NewReader([]byte(`{"model_name": "`+tc.modelName+`", "inputs": {"prompt": "a cat"}}`)))
+			require.NoError(t, err)
+			request.RemoteAddr = "10.0.0.1:1234"
+			request.Header.Set("X-Real-IP", tc.clientIP)
+			request.Header.Set("UID", "1")
+			server.router.ServeHTTP(recorder, request)
+			require.Equal(t, tc.expectedStatus, recorder.Code)
+		})
+	}
+
+	// The probes and the metrics are not subject to the rules
+	for _, path := range []string{"/live", "/metrics"} {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(http.MethodGet, path, nil)
+		require.NoError(t, err)
+		request.RemoteAddr = "192.0.2.10:1234"
+		server.router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code, path)
+	}
+
+	// The lists are reloaded when the file changes
+	require.NoError(t, os.WriteFile(path, []byte(`deny: [198.51.100.0/24]`), 0o644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	require.NoError(t, server.ipAccess.reload())
+	rules := server.ipAccess.global
+	require.Equal(t, ipDeniedByList, server.ipAccess.check(rules, net.ParseIP("198.51.100.1")))
+	require.Empty(t, server.ipAccess.check(rules, net.ParseIP("192.0.2.10")))
+}
+
+func TestIPRulesCountries(t *testing.T) {
+	rules, err := compileIPRules(utils.IPRules{
+		AllowCountries: []string{"de", "fr"},
+		DenyCountries:  []string{"FR"},
+	})
+	require.NoError(t, err)
+	ip := net.ParseIP("198.51.100.1")
+
+	require.Empty(t, rules.check(ip, func() string { return "DE" }))
+	require.Equal(t, ipDeniedByCountry, rules.check(ip, func() string { return "FR" }))
+	require.Equal(t, ipCountryNotAllowed, rules.check(ip, func() string { return "" }))
+
+	_, err = compileIPRules(utils.IPRules{Deny: []string{"not-an-ip"}})
+	require.Error(t, err)
+}
+
+func TestIPAccessControlTasks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	webhook := mockapi.NewMockWebhook(ctrl)
+	webhook.EXPECT().
+		GetTaskInfo(gomock.Any(), "1").
+		Return(map[string]interface{}{"model_name": "enterprise", "status": "succeeded"}, nil).
+		AnyTimes()
+	webhook.EXPECT().
+		GetTaskInfo(gomock.Any(), "2").
+		Return(map[string]interface{}{"model_name": "test", "status": "succeeded"}, nil).
+		AnyTimes()
+
+	path := filepath.Join(t.TempDir(), "ipaccess.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+models:
+  enterprise:
+    allow: [203.0.113.0/24]
+`), 0o644))
+	server, err := NewServer(utils.Config{IPAccessConfigFile: path}, webhook)
+	require.NoError(t, err)
+	defer server.Close(context.Background())
+
+	testCases := []struct {
+		name           string
+		clientIP       string
+		expectedStatus int
+		expectedTasks  int
+	}{
+		{name: "Allowed", clientIP: "203.0.113.5", expectedStatus: http.StatusOK, expectedTasks: 2},
+		{name: "Denied", clientIP: "198.51.100.1", expectedStatus: http.StatusForbidden, expectedTasks: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request, err := http.NewRequest(http.MethodGet, "/task/1", nil)
+			require.NoError(t, err)
+			request.RequestURI = "/task/1"
+			request.RemoteAddr = tc.clientIP + ":1234"
+			request.Header.Set("UID", "1")
+			server.router.ServeHTTP(recorder, request)
+			require.Equal(t, tc.expectedStatus, recorder.Code)
+
+			// The batches skip the tasks of the denied models
+			recorder = httptest.NewRecorder()
+			request, err = http.NewRequest(http.MethodPost, "/task/batch",
+				bytes.NewReader([]byte(`{"ids": ["1", "2"]}`)))
+			require.NoError(t, err)
+			request.RemoteAddr = tc.clientIP + ":1234"
+			request.Header.Set("UID", "1")
+			server.router.ServeHTTP(recorder, request)
+			require.Equal(t, http.StatusOK, recorder.Code)
+			var tasks []map[string]interface{}
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &tasks))
+			require.Len(t, tasks, tc.expectedTasks)
+		})
+	}
+}
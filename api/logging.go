@@ -0,0 +1,64 @@
+package api
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 128
+)
+
+type requestIDContextKey struct{}
+
+// validRequestID accepts the request IDs of the callers made of printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// assignRequestID gives every request an ID, the one sent by the caller in X-Request-ID or a new one.
+// The ID is returned in the response, forwarded upstream and attached to the logger of the request.
+func assignRequestID() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = newLeaseID()
+		}
+		ctx.Header(requestIDHeader, id)
+		requestCtx := context.WithValue(ctx.Request.Context(), requestIDContextKey{}, id)
+		logger := log.With().Str("request_id", id).Logger()
+		ctx.Request = ctx.Request.WithContext(logger.WithContext(requestCtx))
+		ctx.Next()
+	}
+}
+
+// requestIDFrom returns the ID of the request of a context, if any.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// requestLogger returns the logger of the request of a context, or the global logger.
+func requestLogger(ctx context.Context) *zerolog.Logger {
+	if logger := zerolog.Ctx(ctx); logger.GetLevel() != zerolog.Disabled {
+		return logger
+	}
+	return &log.Logger
+}
+
+// addLogFields adds fields to the logger of a request, e.g., the user ID once authenticated.
+func addLogFields(ctx *gin.Context, fields func(c zerolog.Context) zerolog.Context) {
+	logger := fields(requestLogger(ctx.Request.Context()).With()).Logger()
+	ctx.Request = ctx.Request.WithContext(logger.WithContext(ctx.Request.Context()))
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"bytes"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var upstreamID string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get(requestIDHeader)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"outputs": "test"}`))
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer(utils.Config{ServingAgentAddress: upstream.URL}, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		requestID string
+		generated bool
+	}{
+		{name: "Forwarded", requestID: "req-1234"},
+		{name: "Missing", requestID: "", generated: true},
+		{name: "Invalid", requestID: "req 1234", generated: true},
+		{name: "TooLong", requestID: strings.Repeat("a", maxRequestIDLength+1), generated: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			upstreamID = ""
+			recorder := httptest.NewRecorder()
+			request, err := http.NewRequest(http.MethodPost, "/v1/predict",
+				bytes.NewReader([]byte(`{"model_name": "test", "inputs": {"prompt": "a cat"}}`)))
+			require.NoError(t, err)
+			request.Header.Set("UID", "1")
+			if tc.requestID != "" {
+				request.Header.Set(requestIDHeader, tc.requestID)
+			}
+			server.router.ServeHTTP(recorder, request)
+			require.Equal(t, http.StatusOK, recorder.Code)
+
+			responseID := recorder.Header().Get(requestIDHeader)
+			require.True(t, validRequestID(responseID))
+			if tc.generated {
+				require.NotEqual(t, tc.requestID, responseID)
+			} else {
+				require.Equal(t, tc.requestID, responseID)
+			}
+			require.Equal(t, responseID, upstreamID)
+		})
+	}
+}
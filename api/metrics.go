@@ -3,8 +3,18 @@ package api
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
 )
 
+// The label of the requests of models missing from the model config, which bounds the cardinality
+const otherModelLabel = "other"
+
+// The default buckets of the latency histograms, in seconds, suited to multi-second inference
+var defaultLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+
+// The sizes of the requests and the responses, from 256B to 64MB
+var sizeBuckets = prometheus.ExponentialBuckets(256, 4, 10)
+
 var totalRequests = promauto.NewCounterVec(
 	prometheus.CounterOpts{
 		Name: "http_requests_total",
@@ -26,6 +36,207 @@ var httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 	Help: "Duration of HTTP requests",
 }, []string{"path"})
 
+var upstreamAttempts = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "upstream_attempts_total",
+		Help: "Number of attempts of upstream calls",
+	},
+	[]string{"target", "result"},
+)
+
+var upstreamRetries = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "upstream_retries_total",
+		Help: "Number of retried or budget-rejected upstream calls",
+	},
+	[]string{"target", "reason"},
+)
+
+var upstreamEndpointsAvailable = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "upstream_endpoints_available",
+		Help: "Number of serving agent endpoints eligible for load balancing",
+	},
+	[]string{"model"},
+)
+
+var upstreamEndpointEjections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "upstream_endpoint_ejections_total",
+		Help: "Number of serving agent endpoint ejections",
+	},
+	[]string{"model", "check"},
+)
+
+var agentQueueSize = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "agent_queue_size",
+		Help: "Last sampled task queue size of the serving agents",
+	},
+	[]string{"model"},
+)
+
+var admissionRejections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "admission_rejections_total",
+		Help: "Number of async submissions rejected because the task queue is full",
+	},
+	[]string{"model"},
+)
+
+var coalescedRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "coalesced_requests_total",
+		Help: "Number of predictions of deterministic models by coalescing result",
+	},
+	[]string{"model", "result"},
+)
+
+var coalescedWaiters = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "coalesced_waiters",
+	Help:    "Number of requests sharing one upstream prediction",
+	Buckets: []float64{1, 2, 4, 8, 16, 32, 64},
+}, []string{"model"})
+
+var rateLimiterMode = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "rate_limiter_mode",
+		Help: "Current mode of the rate limiter, 1 for the active mode",
+	},
+	[]string{"mode"},
+)
+
+var concurrencyRejections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "concurrency_rejections_total",
+		Help: "Number of requests rejected by the per-user concurrency limits",
+	},
+	[]string{"group"},
+)
+
+var quotaRejections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "quota_rejections_total",
+		Help: "Number of requests rejected because a usage budget is exhausted",
+	},
+	[]string{"period"},
+)
+
+var ipAccessDenials = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ip_access_denials_total",
+		Help: "Number of requests denied by the IP allow and deny lists",
+	},
+	[]string{"scope", "reason"},
+)
+
+var modelRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "model_requests_total",
+		Help: "Number of requests by model, route and status",
+	},
+	[]string{"model", "route", "status"},
+)
+
+var requestsInFlight = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "Number of requests being served",
+	},
+	[]string{"route"},
+)
+
+var upstreamInFlight = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "upstream_requests_in_flight",
+		Help: "Number of calls to the serving agents in progress",
+	},
+	[]string{"model"},
+)
+
+var requestSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "http_request_size_bytes",
+	Help:    "Size of the HTTP request bodies",
+	Buckets: sizeBuckets,
+}, []string{"route"})
+
+var responseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "http_response_size_bytes",
+	Help:    "Size of the HTTP response bodies",
+	Buckets: sizeBuckets,
+}, []string{"route"})
+
+var streamChunks = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "stream_chunks",
+	Help:    "Number of chunks per streamed response",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+}, []string{"model"})
+
+var streamAborts = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "stream_aborts_total",
+		Help: "Number of streamed responses ended before completion",
+	},
+	[]string{"model", "reason"},
+)
+
+var moderationDecisions = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "moderation_decisions_total",
+		Help: "Number of texts flagged or blocked by the moderation plugins",
+	},
+	[]string{"model", "stage", "plugin", "action"},
+)
+
+// The latency histograms, registered by initMetrics with the configured buckets.
+var (
+	metricsOnce            sync.Once
+	modelRequestDuration   *prometheus.HistogramVec
+	upstreamDuration       *prometheus.HistogramVec
+	streamTimeToFirstChunk *prometheus.HistogramVec
+	streamDuration         *prometheus.HistogramVec
+)
+
+// initMetrics registers the latency histograms, the buckets of the first call are kept.
+func initMetrics(buckets []float64) {
+	metricsOnce.Do(func() {
+		if len(buckets) == 0 {
+			buckets = defaultLatencyBuckets
+		}
+		modelRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "model_request_duration_seconds",
+			Help:    "Duration of requests by model and route",
+			Buckets: buckets,
+		}, []string{"model", "route"})
+		upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "upstream_request_duration_seconds",
+			Help:    "Duration of the calls to the serving agents, until the response headers of streams",
+			Buckets: buckets,
+		}, []string{"model", "target"})
+		streamTimeToFirstChunk = promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "stream_time_to_first_chunk_seconds",
+			Help:    "Time until the first chunk of streamed responses",
+			Buckets: buckets,
+		}, []string{"model"})
+		streamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "stream_duration_seconds",
+			Help:    "Duration of streamed responses",
+			Buckets: buckets,
+		}, []string{"model"})
+	})
+}
+
+// modelLabel returns the metric label of a model, models without config share one label.
+func (server *Server) modelLabel(modelName string) string {
+	if modelName == "" {
+		return ""
+	}
+	if _, ok := server.config.Models[modelName]; ok {
+		return modelName
+	}
+	return otherModelLabel
+}
+
 /*
 func init() {
 	if err := prometheus.Register(totalRequests); err != nil {
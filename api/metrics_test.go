@@ -0,0 +1,88 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	var metric dto.Metric
+	require.NoError(t, observer.(prometheus.Metric).Write(&metric))
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestModelMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "generate") {
+			for i := 0; i < 3; i++ {
+				_, _ = w.Write([]byte(`{"id": 1, "data": "a"}` + "\n"))
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"outputs": "test"}`))
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress: upstream.URL,
+		Models:              map[string]utils.ModelConfig{"metrics": {}},
+	}, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		path      string
+		modelName string
+		label     string
+	}{
+		{name: "KnownModel", path: "/v1/predict", modelName: "metrics", label: "metrics"},
+		{name: "UnknownModel", path: "/v1/predict", modelName: "unknown", label: otherModelLabel},
+		{name: "Stream", path: "/v1/generate", modelName: "metrics", label: "metrics"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			requests := modelRequests.WithLabelValues(tc.label, tc.path, "200")
+			before := testutil.ToFloat64(requests)
+			durations := histogramCount(t, modelRequestDuration.WithLabelValues(tc.label, tc.path))
+			streams := histogramCount(t, streamChunks.WithLabelValues(tc.label))
+
+			data, err := json.Marshal(gin.H{"model_name": tc.modelName, "inputs": gin.H{"prompt": "a cat"}})
+			require.NoError(t, err)
+			recorder := httptest.NewRecorder()
+			request, err := http.NewRequest(http.MethodPost, tc.path, bytes.NewReader(data))
+			require.NoError(t, err)
+			request.Header.Set("UID", "1")
+			server.router.ServeHTTP(recorder, request)
+			require.Equal(t, http.StatusOK, recorder.Code)
+
+			require.Equal(t, before+1, testutil.ToFloat64(requests))
+			require.Equal(t, durations+1, histogramCount(t, modelRequestDuration.WithLabelValues(tc.label, tc.path)))
+			require.Zero(t, testutil.ToFloat64(requestsInFlight.WithLabelValues(tc.path)))
+			require.Zero(t, testutil.ToFloat64(upstreamInFlight.WithLabelValues(tc.label)))
+			if tc.path == "/v1/generate" {
+				require.Equal(t, streams+1, histogramCount(t, streamChunks.WithLabelValues(tc.label)))
+				require.Equal(t, 3, strings.Count(recorder.Body.String(), "\n"))
+			}
+		})
+	}
+	require.Zero(t, testutil.ToFloat64(modelRequests.WithLabelValues("unknown", "/v1/predict", "200")))
+}
+
+func TestStreamAbortReason(t *testing.T) {
+	err := &streamError{reason: streamAbortClient, err: errors.New("client stopped listening")}
+	require.Equal(t, streamAbortClient, streamAbortReason(fmt.Errorf("failed to stream: %w", err)))
+	require.Equal(t, streamAbortOther, streamAbortReason(errors.New("moderation")))
+}
@@ -1,12 +1,17 @@
 package api
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/HyperGAI/serving-api/utils"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/codes"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -14,15 +19,23 @@ import (
 )
 
 const (
-	userIDKey = "UID"
+	userIDKey          = "UID"
+	inferRequestCtxKey = "inferRequest"
+	// The authenticated user of a request, recorded as the actor of its audit events
+	auditActorKey      = "auditActor"
+	trueClientIPHeader = "True-Client-IP"
 )
 
-func authenticateRequest() gin.HandlerFunc {
+func authenticateRequest(audit *AuditLog) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
+		_, span := startSpan(ctx.Request.Context(), "auth")
 		userHeader := ctx.GetHeader(userIDKey)
 
 		if len(userHeader) == 0 {
 			err := errors.New("user-id header is not provided")
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+			audit.Record(ctx, auditAuthFailure, ctx.FullPath(), auditDenied, err.Error())
 			ctx.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse(err))
 			return
 		}
@@ -30,30 +43,61 @@ func authenticateRequest() gin.HandlerFunc {
 		fields := strings.Fields(userHeader)
 		if len(fields) != 1 {
 			err := errors.New("invalid user-id header format")
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+			audit.Record(ctx, auditAuthFailure, ctx.FullPath(), auditDenied, err.Error())
 			ctx.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse(err))
 			return
 		}
 		ctx.Request.Header.Set("UID", fields[0])
+		ctx.Set(auditActorKey, fields[0])
+		addLogFields(ctx, func(c zerolog.Context) zerolog.Context {
+			return c.Str("uid", fields[0])
+		})
+		span.End()
+		ctx.Next()
+	}
+}
+
+// authenticateAdmin checks the API key of the admin endpoints, which are disabled if no key is set.
+func authenticateAdmin(apiKey string, audit *AuditLog) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if apiKey == "" || subtle.ConstantTimeCompare([]byte(ctx.GetHeader("apikey")), []byte(apiKey)) != 1 {
+			err := errors.New("invalid admin api key")
+			audit.Record(ctx, auditAdminAuthFailure, ctx.FullPath(), auditDenied, err.Error())
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse(err))
+			return
+		}
 		ctx.Next()
 	}
 }
 
 func traceRequest() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
+		span := startRequestSpan(ctx)
+		if span.SpanContext().HasTraceID() {
+			addLogFields(ctx, func(c zerolog.Context) zerolog.Context {
+				return c.Str("trace_id", span.SpanContext().TraceID().String())
+			})
+		}
 		beforeRequest(ctx)
 		// Call the next middleware or endpoint handler
 		ctx.Next()
 		// Do some request tracing after request is processed
 		afterRequest(ctx)
+		endRequestSpan(ctx, span)
 	}
 }
 
 func beforeRequest(ctx *gin.Context) {
 	start := time.Now()
 	// Log the request start time
-	userID := ctx.Request.Header.Get("UID")
-	log.Info().Msgf("user-id %s, started %s %s",
-		userID, ctx.Request.Method, ctx.Request.URL.Path)
+	requestLogger(ctx.Request.Context()).Info().
+		Str("uid", ctx.Request.Header.Get("UID")).
+		Str("client_ip", ctx.ClientIP()).
+		Str("method", ctx.Request.Method).
+		Str("route", ctx.Request.URL.Path).
+		Msg("request started")
 	// Add start time to the request context
 	ctx.Set("startTime", start)
 }
@@ -66,50 +110,115 @@ func afterRequest(ctx *gin.Context) {
 	}
 	duration := time.Since(startTime.(time.Time))
 	// Log the request completion time and duration
-	userID := ctx.Request.Header.Get("UID")
-	log.Info().Msgf("user-id %s, completed %s %s in %v",
-		userID, ctx.Request.Method, ctx.Request.URL.Path, duration)
+	// The logger has the user ID once the request is authenticated
+	requestLogger(ctx.Request.Context()).Info().
+		Str("method", ctx.Request.Method).
+		Str("route", ctx.Request.URL.Path).
+		Int("status", ctx.Writer.Status()).
+		Dur("latency", duration).
+		Msg("request completed")
 }
 
-func setTrueClientIP() gin.HandlerFunc {
+// setTrueClientIP resolves the IP of the client, which gin then returns from ClientIP.
+// It overwrites the header set by the client, if any.
+func setTrueClientIP(resolver *utils.ClientIPResolver) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		ip := utils.GetTrueClientIP(ctx)
-		ctx.Header("True-Client-IP", ip)
-		ctx.Request.Header.Set("True-Client-IP", ip)
-		log.Info().Msgf("X-Forwarded-For: %s", ctx.GetHeader("X-Forwarded-For"))
-		log.Info().Msgf("client IP: %s", ip)
+		ip := resolver.Resolve(ctx.Request.RemoteAddr, ctx.Request.Header)
+		ctx.Request.Header.Set(trueClientIPHeader, ip)
 		ctx.Next()
 	}
 }
 
-func rateLimitByUser(config utils.Config, formattedRate string, prefix string) gin.HandlerFunc {
-	if config.RedisAddress != "" {
-		middleware, err := utils.NewRateLimiterMiddleware(
-			formattedRate,
-			config.RedisAddress,
-			fmt.Sprintf("rate_limiter_%s", prefix),
-			"UID",
-		)
-		if err != nil {
-			log.Fatal().Err(err).Msg("cannot create rate-limit middleware")
+// rateLimit limits the requests of a route group by user, if Redis is configured.
+func (server *Server) rateLimit(group string) gin.HandlerFunc {
+	if server.rateLimiter == nil {
+		return func(ctx *gin.Context) {
+			ctx.Next()
 		}
-		return middleware
-	} else {
+	}
+	return server.rateLimiter.Middleware(group)
+}
+
+// rateLimitIP limits the requests of the unauthenticated routes by client IP, if Redis is configured.
+func (server *Server) rateLimitIP() gin.HandlerFunc {
+	if server.rateLimiter == nil {
 		return func(ctx *gin.Context) {
 			ctx.Next()
 		}
 	}
+	return server.rateLimiter.IPMiddleware()
 }
 
-func prometheusMiddleware() gin.HandlerFunc {
+// requestModelName returns the model of a request, from the URI or the JSON body.
+func requestModelName(ctx *gin.Context) string {
+	if modelName := ctx.Param("model"); modelName != "" {
+		return modelName
+	}
+	req, _ := peekInferRequest(ctx)
+	return req.ModelName
+}
+
+// peekInferRequest decodes the JSON body of a prediction request for middlewares.
+// The body is restored so that handlers can bind it again.
+func peekInferRequest(ctx *gin.Context) (InferRequest, bool) {
+	if req, ok := ctx.Get(inferRequestCtxKey); ok {
+		return req.(InferRequest), true
+	}
+	var req InferRequest
+	// Clients may omit the content type, which handlers accept as JSON
+	if ctx.Request.Body == nil ||
+		(ctx.ContentType() != "" && ctx.ContentType() != binding.MIMEJSON && !isMultipart(ctx)) {
+		return req, false
+	}
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		// The handlers get the error too, e.g., to respond 413 to a too large body
+		ctx.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errorReader{err}))
+		return req, false
+	}
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if isMultipart(ctx) {
+		// The files are only added to the inputs by the handlers
+		if req, _, err = parseMultipartRequest(ctx.GetHeader("Content-Type"), body); err != nil {
+			return req, false
+		}
+	} else if json.Unmarshal(body, &req) != nil {
+		return req, false
+	}
+	ctx.Set(inferRequestCtxKey, req)
+	return req, true
+}
+
+// errorReader fails its reads with an error.
+type errorReader struct {
+	err error
+}
+
+func (reader errorReader) Read([]byte) (int, error) {
+	return 0, reader.err
+}
+
+func (server *Server) prometheusMiddleware() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		path := ctx.FullPath()
+		model := server.modelLabel(requestModelName(ctx))
 		timer := prometheus.NewTimer(httpDuration.WithLabelValues(path))
+		start := time.Now()
+		inFlight := requestsInFlight.WithLabelValues(path)
+		inFlight.Inc()
+		if ctx.Request.ContentLength >= 0 {
+			requestSize.WithLabelValues(path).Observe(float64(ctx.Request.ContentLength))
+		}
 		// Call the next middleware or endpoint handler
 		ctx.Next()
 		// Update metrics
+		inFlight.Dec()
+		status := strconv.Itoa(ctx.Writer.Status())
 		totalRequests.WithLabelValues(path).Inc()
-		responseStatus.WithLabelValues(path, strconv.Itoa(ctx.Writer.Status())).Inc()
+		responseStatus.WithLabelValues(path, status).Inc()
 		timer.ObserveDuration()
+		modelRequests.WithLabelValues(model, path, status).Inc()
+		modelRequestDuration.WithLabelValues(model, path).Observe(time.Since(start).Seconds())
+		responseSize.WithLabelValues(path).Observe(float64(max(ctx.Writer.Size(), 0)))
 	}
 }
@@ -5,6 +5,7 @@
 package mockapi
 
 import (
+	context "context"
 	reflect "reflect"
 
 	gomock "go.uber.org/mock/gomock"
@@ -34,16 +35,16 @@ func (m *MockWebhook) EXPECT() *MockWebhookMockRecorder {
 }
 
 // GetTaskInfo mocks base method.
-func (m *MockWebhook) GetTaskInfo(arg0 string) (interface{}, error) {
+func (m *MockWebhook) GetTaskInfo(arg0 context.Context, arg1 string) (interface{}, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetTaskInfo", arg0)
+	ret := m.ctrl.Call(m, "GetTaskInfo", arg0, arg1)
 	ret0, _ := ret[0].(interface{})
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetTaskInfo indicates an expected call of GetTaskInfo.
-func (mr *MockWebhookMockRecorder) GetTaskInfo(arg0 interface{}) *gomock.Call {
+func (mr *MockWebhookMockRecorder) GetTaskInfo(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTaskInfo", reflect.TypeOf((*MockWebhook)(nil).GetTaskInfo), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTaskInfo", reflect.TypeOf((*MockWebhook)(nil).GetTaskInfo), arg0, arg1)
 }
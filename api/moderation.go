@@ -0,0 +1,456 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The names of the moderation plugins
+const (
+	moderationKeywords   = "keywords"
+	moderationPatterns   = "patterns"
+	moderationClassifier = "classifier"
+)
+
+// The stages of the moderation
+const (
+	moderationInput  = "input"
+	moderationOutput = "output"
+)
+
+const (
+	defaultClassifierTimeout = 2 * time.Second
+	// The streamed text checked again with the next messages, so that words split
+	// across messages are matched
+	moderationOverlap = 128
+	// The strings at least this long which decode as base64 are binary data, e.g., images
+	minBinaryLength = 64
+)
+
+var errModerationUnavailable = errors.New("the content moderation is unavailable")
+
+// Moderator is a moderation plugin, it screens the texts of the inputs or of the outputs of a model.
+type Moderator interface {
+	Name() string
+	Moderate(ctx context.Context, modelName string, stage string, text string) (ModerationResult, error)
+}
+
+// ModerationResult is the verdict of a plugin, with the categories of the violation, if any.
+type ModerationResult struct {
+	Flagged    bool
+	Categories []string
+}
+
+// policyError is returned for the texts blocked by the content policy.
+type policyError struct {
+	stage      string
+	plugin     string
+	categories []string
+}
+
+func (e *policyError) Error() string {
+	message := fmt.Sprintf("the %ss violate the content policy", e.stage)
+	if len(e.categories) > 0 {
+		message += ": " + strings.Join(e.categories, ", ")
+	}
+	return message
+}
+
+// KeywordModerator flags the texts containing one of the words, ignoring the case.
+type KeywordModerator struct {
+	re *regexp.Regexp
+}
+
+func NewKeywordModerator(keywords []string) (*KeywordModerator, error) {
+	var quoted []string
+	for _, keyword := range keywords {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			quoted = append(quoted, regexp.QuoteMeta(keyword))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil, errors.New("the keywords plugin needs MODERATION_KEYWORDS")
+	}
+	re, err := regexp.Compile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	if err != nil {
+		return nil, err
+	}
+	return &KeywordModerator{re: re}, nil
+}
+
+func (moderator *KeywordModerator) Name() string {
+	return moderationKeywords
+}
+
+func (moderator *KeywordModerator) Moderate(_ context.Context, _ string, _ string, text string) (ModerationResult, error) {
+	return ModerationResult{Flagged: moderator.re.MatchString(text)}, nil
+}
+
+// PatternModerator flags the texts matching one of the regular expressions.
+type PatternModerator struct {
+	patterns []*regexp.Regexp
+}
+
+// NewPatternModerator reads the regular expressions of a file, one per line. The empty
+// lines and the lines starting with "#" are skipped.
+func NewPatternModerator(path string) (*PatternModerator, error) {
+	if path == "" {
+		return nil, errors.New("the patterns plugin needs MODERATION_PATTERNS_FILE")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	moderator := &PatternModerator{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		re, err := regexp.Compile(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern on line %d of %s: %w", line, path, err)
+		}
+		moderator.patterns = append(moderator.patterns, re)
+	}
+	return moderator, scanner.Err()
+}
+
+func (moderator *PatternModerator) Name() string {
+	return moderationPatterns
+}
+
+func (moderator *PatternModerator) Moderate(_ context.Context, _ string, _ string, text string) (ModerationResult, error) {
+	for _, re := range moderator.patterns {
+		if re.MatchString(text) {
+			return ModerationResult{Flagged: true}, nil
+		}
+	}
+	return ModerationResult{}, nil
+}
+
+// ClassifierModerator calls an HTTP classifier. It receives {"model", "stage", "text"}
+// and responds {"flagged": bool, "categories": [...]}.
+type ClassifierModerator struct {
+	url    string
+	client http.Client
+}
+
+func NewClassifierModerator(url string, timeout time.Duration) (*ClassifierModerator, error) {
+	if url == "" {
+		return nil, errors.New("the classifier plugin needs MODERATION_CLASSIFIER_URL")
+	}
+	if timeout <= 0 {
+		timeout = defaultClassifierTimeout
+	}
+	return &ClassifierModerator{url: url, client: http.Client{Timeout: timeout}}, nil
+}
+
+func (moderator *ClassifierModerator) Name() string {
+	return moderationClassifier
+}
+
+func (moderator *ClassifierModerator) Moderate(
+	ctx context.Context,
+	modelName string,
+	stage string,
+	text string,
+) (result ModerationResult, err error) {
+	ctx, span := startUpstreamSpan(ctx, moderationClassifier, "POST", moderator.url)
+	statusCode := 0
+	defer func() {
+		endUpstreamSpan(span, statusCode, err)
+	}()
+	data, err := json.Marshal(map[string]string{"model": modelName, "stage": stage, "text": text})
+	if err != nil {
+		return result, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, moderator.url, bytes.NewReader(data))
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	forwardRequestContext(ctx, req.Header)
+	res, err := moderator.client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+	statusCode = res.StatusCode
+	if res.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("the classifier returned status %d", res.StatusCode)
+	}
+	var response struct {
+		Flagged    bool     `json:"flagged"`
+		Categories []string `json:"categories"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return result, fmt.Errorf("invalid classifier response: %w", err)
+	}
+	return ModerationResult{Flagged: response.Flagged, Categories: response.Categories}, nil
+}
+
+// ModerationChain runs the moderation plugins in order, with the actions set by the
+// policies of the models. A nil chain allows everything.
+type ModerationChain struct {
+	moderators    []Moderator
+	models        map[string]utils.ModerationConfig
+	defaultAction string
+	failOpen      bool
+}
+
+// NewModerationChain creates the configured plugins, it returns nil if there are none.
+func NewModerationChain(config utils.Config) (*ModerationChain, error) {
+	if len(config.ModerationPlugins) == 0 {
+		return nil, nil
+	}
+	chain := &ModerationChain{
+		models:        make(map[string]utils.ModerationConfig),
+		defaultAction: config.ModerationDefaultAction,
+		failOpen:      config.ModerationFailOpen,
+	}
+	if chain.defaultAction == "" {
+		chain.defaultAction = utils.ModerationAllow
+	}
+	if !validModerationAction(chain.defaultAction) {
+		return nil, fmt.Errorf("invalid moderation action %q", chain.defaultAction)
+	}
+	names := make(map[string]bool)
+	for _, name := range config.ModerationPlugins {
+		var moderator Moderator
+		var err error
+		switch name = strings.TrimSpace(name); name {
+		case moderationKeywords:
+			moderator, err = NewKeywordModerator(config.ModerationKeywords)
+		case moderationPatterns:
+			moderator, err = NewPatternModerator(config.ModerationPatternsFile)
+		case moderationClassifier:
+			moderator, err = NewClassifierModerator(config.ModerationClassifierURL, config.ModerationClassifierTimeout)
+		default:
+			err = fmt.Errorf("unknown moderation plugin %q", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		names[name] = true
+		chain.moderators = append(chain.moderators, moderator)
+	}
+	for modelName, model := range config.Models {
+		for _, actions := range []map[string]string{model.Moderation.Input, model.Moderation.Output} {
+			for plugin, action := range actions {
+				if !names[plugin] || !validModerationAction(action) {
+					return nil, fmt.Errorf("invalid moderation action %q of plugin %q of model %s",
+						action, plugin, modelName)
+				}
+			}
+		}
+		chain.models[modelName] = model.Moderation
+	}
+	return chain, nil
+}
+
+func validModerationAction(action string) bool {
+	return action == utils.ModerationAllow || action == utils.ModerationFlag || action == utils.ModerationBlock
+}
+
+// action returns the action of a plugin on a stage of a model.
+func (chain *ModerationChain) action(modelName string, stage string, plugin string) string {
+	policy := chain.models[modelName]
+	actions := policy.Input
+	if stage == moderationOutput {
+		actions = policy.Output
+	}
+	if action, ok := actions[plugin]; ok {
+		return action
+	}
+	return chain.defaultAction
+}
+
+// modelLabel bounds the model label of the metrics, like Server.modelLabel.
+func (chain *ModerationChain) modelLabel(modelName string) string {
+	if _, ok := chain.models[modelName]; ok || modelName == "" {
+		return modelName
+	}
+	return otherModelLabel
+}
+
+// Check screens a text. It returns a *policyError if a plugin blocks it, or
+// errModerationUnavailable if a plugin fails and the chain does not fail open.
+// The plugins already in flagged are not reported again, e.g., for the messages of a stream.
+func (chain *ModerationChain) Check(
+	ctx context.Context,
+	modelName string,
+	stage string,
+	text string,
+	flagged map[string]bool,
+) error {
+	if chain == nil || strings.TrimSpace(text) == "" {
+		return nil
+	}
+	logger := requestLogger(ctx)
+	for _, moderator := range chain.moderators {
+		plugin := moderator.Name()
+		action := chain.action(modelName, stage, plugin)
+		if action == utils.ModerationAllow {
+			continue
+		}
+		result, err := moderator.Moderate(ctx, modelName, stage, text)
+		if err != nil {
+			logger.Error().Err(err).Str("model", modelName).Str("stage", stage).Str("plugin", plugin).
+				Bool("fail_open", chain.failOpen).Msg("failed to moderate")
+			if chain.failOpen {
+				continue
+			}
+			return errModerationUnavailable
+		}
+		if !result.Flagged {
+			continue
+		}
+		moderationDecisions.WithLabelValues(chain.modelLabel(modelName), stage, plugin, action).Inc()
+		if action == utils.ModerationBlock {
+			logger.Warn().Str("model", modelName).Str("stage", stage).Str("plugin", plugin).
+				Strs("categories", result.Categories).Msg("blocked by the content policy")
+			return &policyError{stage: stage, plugin: plugin, categories: result.Categories}
+		}
+		if flagged == nil || !flagged[plugin] {
+			logger.Warn().Str("model", modelName).Str("stage", stage).Str("plugin", plugin).
+				Strs("categories", result.Categories).Msg("flagged by the content policy")
+		}
+		if flagged != nil {
+			flagged[plugin] = true
+		}
+	}
+	return nil
+}
+
+// moderationText returns the strings of the inputs or of the outputs to screen, one per line.
+// The binary data, e.g., base64 images, is skipped.
+func moderationText(value interface{}) string {
+	var texts []string
+	var collect func(value interface{})
+	collect = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for _, key := range sortedKeys(v) {
+				collect(v[key])
+			}
+		case []interface{}:
+			for _, child := range v {
+				collect(child)
+			}
+		case string:
+			if len(v) >= minBinaryLength {
+				if _, _, ok := decodeBinaryOutput(v); ok {
+					return
+				}
+			}
+			texts = append(texts, v)
+		}
+	}
+	collect(value)
+	return strings.Join(texts, "\n")
+}
+
+// moderationStatus returns the status code of the responses to a moderation error.
+func moderationStatus(err error, stage string) int {
+	var policyErr *policyError
+	switch {
+	case !errors.As(err, &policyErr):
+		return http.StatusServiceUnavailable
+	case stage == moderationInput:
+		return http.StatusBadRequest
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
+
+// moderate screens the inputs or the outputs of a model. On error, the returned status
+// code is the one to respond with.
+func (server *Server) moderate(ctx context.Context, modelName string, stage string, value interface{}) (int, error) {
+	if server.moderation == nil {
+		return http.StatusOK, nil
+	}
+	if err := server.moderation.Check(ctx, modelName, stage, moderationText(value), nil); err != nil {
+		return moderationStatus(err, stage), err
+	}
+	return http.StatusOK, nil
+}
+
+// streamModerator screens the messages of a stream as they arrive. The messages are held
+// until their text is checked, so that no blocked text reaches the client.
+type streamModerator struct {
+	chain     *ModerationChain
+	modelName string
+	interval  int
+	held      []StreamingMessage
+	pending   strings.Builder
+	checked   string
+	flagged   map[string]bool
+}
+
+func (server *Server) newStreamModerator(modelName string) *streamModerator {
+	if server.moderation == nil {
+		return nil
+	}
+	return &streamModerator{
+		chain:     server.moderation,
+		modelName: modelName,
+		interval:  server.config.ModerationStreamInterval,
+		flagged:   make(map[string]bool),
+	}
+}
+
+// add holds a message, and returns the held messages once the unchecked text reaches the
+// interval and passes the moderation. The stream ends with the returned error.
+func (moderator *streamModerator) add(ctx context.Context, m *StreamingMessage) ([]StreamingMessage, error) {
+	if moderator == nil {
+		return []StreamingMessage{*m}, nil
+	}
+	moderator.held = append(moderator.held, *m)
+	moderator.pending.WriteString(m.Data)
+	if moderator.pending.Len() > 0 && moderator.pending.Len() < moderator.interval {
+		return nil, nil
+	}
+	return moderator.release(ctx)
+}
+
+// flush checks the text left unchecked at the end of the stream, and returns the held messages.
+func (moderator *streamModerator) flush(ctx context.Context) ([]StreamingMessage, error) {
+	if moderator == nil {
+		return nil, nil
+	}
+	return moderator.release(ctx)
+}
+
+// release checks the pending text with the end of the text checked before, as a blocked
+// phrase may span several messages.
+func (moderator *streamModerator) release(ctx context.Context) ([]StreamingMessage, error) {
+	if moderator.pending.Len() > 0 {
+		text := moderator.checked + moderator.pending.String()
+		moderator.pending.Reset()
+		moderator.checked = text[max(0, len(text)-moderationOverlap):]
+		err := moderator.chain.Check(ctx, moderator.modelName, moderationOutput, text, moderator.flagged)
+		var policyErr *policyError
+		if errors.As(err, &policyErr) {
+			return nil, &streamError{reason: streamAbortPolicy, err: err}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	held := moderator.held
+	moderator.held = nil
+	return held, nil
+}
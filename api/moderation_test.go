@@ -0,0 +1,280 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFakeClassifier flags the texts containing "violence", and fails on the texts containing "crash".
+func newFakeClassifier(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+			Stage string `json:"stage"`
+			Text  string `json:"text"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if strings.Contains(req.Text, "crash") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		flagged := strings.Contains(req.Text, "violence")
+		response := map[string]interface{}{"flagged": flagged}
+		if flagged {
+			response["categories"] = []string{"violence"}
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+}
+
+func TestModerationChain(t *testing.T) {
+	classifier := newFakeClassifier(t)
+	defer classifier.Close()
+	patternsFile := filepath.Join(t.TempDir(), "patterns.txt")
+	require.NoError(t, os.WriteFile(patternsFile, []byte("# Card numbers\n\\b\\d{4}-\\d{4}-\\d{4}-\\d{4}\\b\n"), 0o644))
+
+	config := utils.Config{
+		ModerationPlugins:       []string{moderationKeywords, moderationPatterns, moderationClassifier},
+		ModerationDefaultAction: utils.ModerationBlock,
+		ModerationKeywords:      []string{"forbidden", "top secret"},
+		ModerationPatternsFile:  patternsFile,
+		ModerationClassifierURL: classifier.URL,
+		Models: map[string]utils.ModelConfig{"lenient": {Moderation: utils.ModerationConfig{
+			Input:  map[string]string{moderationKeywords: utils.ModerationFlag},
+			Output: map[string]string{moderationClassifier: utils.ModerationAllow},
+		}}},
+	}
+	chain, err := NewModerationChain(config)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		model     string
+		stage     string
+		text      string
+		blockedBy string
+		err       error
+	}{
+		{name: "Clean", model: "test", stage: moderationInput, text: "a cat on a mat"},
+		{name: "Keyword", model: "test", stage: moderationInput, text: "a FORBIDDEN cat", blockedBy: moderationKeywords},
+		{name: "Phrase", model: "test", stage: moderationOutput, text: "the top secret plan", blockedBy: moderationKeywords},
+		{name: "NotWord", model: "test", stage: moderationInput, text: "unforbiddenly"},
+		{name: "Pattern", model: "test", stage: moderationInput, text: "card 1234-5678-1234-5678", blockedBy: moderationPatterns},
+		{name: "Classifier", model: "test", stage: moderationOutput, text: "some violence", blockedBy: moderationClassifier},
+		{name: "Flag", model: "lenient", stage: moderationInput, text: "a forbidden cat"},
+		{name: "Allow", model: "lenient", stage: moderationOutput, text: "some violence"},
+		{name: "FailClosed", model: "test", stage: moderationInput, text: "crash", err: errModerationUnavailable},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := chain.Check(context.Background(), tc.model, tc.stage, tc.text, nil)
+			switch {
+			case tc.blockedBy != "":
+				var policyErr *policyError
+				require.ErrorAs(t, err, &policyErr)
+				require.Equal(t, tc.blockedBy, policyErr.plugin)
+				require.Equal(t, tc.stage, policyErr.stage)
+			case tc.err != nil:
+				require.ErrorIs(t, err, tc.err)
+			default:
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	config.ModerationFailOpen = true
+	chain, err = NewModerationChain(config)
+	require.NoError(t, err)
+	require.NoError(t, chain.Check(context.Background(), "test", moderationInput, "crash", nil))
+
+	// A nil chain allows everything
+	chain, err = NewModerationChain(utils.Config{})
+	require.NoError(t, err)
+	require.Nil(t, chain)
+	require.NoError(t, chain.Check(context.Background(), "test", moderationInput, "forbidden", nil))
+
+	for _, invalid := range []utils.Config{
+		{ModerationPlugins: []string{"unknown"}},
+		{ModerationPlugins: []string{moderationKeywords}},
+		{ModerationPlugins: []string{moderationKeywords}, ModerationKeywords: []string{"a"}, ModerationDefaultAction: "deny"},
+		{ModerationPlugins: []string{moderationKeywords}, ModerationKeywords: []string{"a"},
+			Models: map[string]utils.ModelConfig{"test": {Moderation: utils.ModerationConfig{
+				Input: map[string]string{moderationClassifier: utils.ModerationBlock},
+			}}}},
+	} {
+		_, err := NewModerationChain(invalid)
+		require.Error(t, err)
+	}
+}
+
+func TestModerationText(t *testing.T) {
+	var outputs map[string]interface{}
+	image := strings.Repeat("iVBORw0K", 16)
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"text": "a cat",
+		"images": ["`+image+`"],
+		"nested": {"caption": "on a mat", "seed": 42}
+	}`), &outputs))
+	require.Equal(t, "on a mat\na cat", moderationText(outputs))
+}
+
+func TestPredictModeration(t *testing.T) {
+	upstreamCalls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		var req InferRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		w.Header().Set("Content-Type", "application/json")
+		// The agent echoes the prompt
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"outputs": "an image of " + req.Inputs["prompt"].(string)})
+	}))
+	defer upstream.Close()
+	classifier := newFakeClassifier(t)
+	defer classifier.Close()
+
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress:     upstream.URL,
+		ModerationPlugins:       []string{moderationKeywords, moderationClassifier},
+		ModerationDefaultAction: utils.ModerationBlock,
+		ModerationKeywords:      []string{"forbidden"},
+		ModerationClassifierURL: classifier.URL,
+		Models: map[string]utils.ModelConfig{"test": {Moderation: utils.ModerationConfig{
+			// Only the outputs are classified
+			Input: map[string]string{moderationClassifier: utils.ModerationAllow},
+		}}},
+	}, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		prompt        string
+		status        int
+		upstreamCalls int
+	}{
+		{name: "OK", prompt: "a cat", status: http.StatusOK, upstreamCalls: 1},
+		{name: "BlockedInput", prompt: "a forbidden cat", status: http.StatusBadRequest, upstreamCalls: 0},
+		{name: "BlockedOutput", prompt: "violence", status: http.StatusUnprocessableEntity, upstreamCalls: 1},
+		{name: "Unavailable", prompt: "crash", status: http.StatusServiceUnavailable, upstreamCalls: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			upstreamCalls = 0
+			data, err := json.Marshal(map[string]interface{}{"model_name": "test", "inputs": map[string]string{"prompt": tc.prompt}})
+			require.NoError(t, err)
+			recorder := httptest.NewRecorder()
+			request, err := http.NewRequest(http.MethodPost, "/v1/predict", strings.NewReader(string(data)))
+			require.NoError(t, err)
+			request.Header.Set("UID", "1")
+			server.router.ServeHTTP(recorder, request)
+			require.Equal(t, tc.status, recorder.Code, recorder.Body.String())
+			require.Equal(t, tc.upstreamCalls, upstreamCalls)
+			if tc.status != http.StatusOK {
+				require.NotContains(t, recorder.Body.String(), "an image of")
+			}
+		})
+	}
+}
+
+func TestGenerateModeration(t *testing.T) {
+	var messages []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i, data := range messages {
+			_ = json.NewEncoder(w).Encode(StreamingMessage{Id: i, Data: data})
+		}
+	}))
+	defer upstream.Close()
+
+	testCases := []struct {
+		name     string
+		interval int
+		messages []string
+		expected []string
+		blocked  bool
+	}{
+		{
+			// The blocked word is split across the messages, the messages up to the
+			// blocked one are sent
+			name:     "EveryMessage",
+			messages: []string{"a cat ", "is forb", "idden", " on a mat"},
+			expected: []string{"a cat ", "is forb"},
+			blocked:  true,
+		},
+		{
+			// No message is sent before its text is checked
+			name:     "Interval",
+			interval: 20,
+			messages: []string{"a cat ", "is forb", "idden", " on a mat"},
+			blocked:  true,
+		},
+		{
+			name:     "IntervalClean",
+			interval: 10,
+			messages: []string{"a cat ", "is ", "on a mat", "", " indeed"},
+			expected: []string{"a cat ", "is ", "on a mat", "", " indeed"},
+		},
+		{
+			// The text left at the end of the stream is checked
+			name:     "IntervalEnd",
+			interval: 20,
+			messages: []string{"a cat on a mat is a ", "forbidden"},
+			expected: []string{"a cat on a mat is a "},
+			blocked:  true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			messages = tc.messages
+			server, err := NewServer(utils.Config{
+				ServingAgentAddress:      upstream.URL,
+				ModerationPlugins:        []string{moderationKeywords},
+				ModerationDefaultAction:  utils.ModerationBlock,
+				ModerationKeywords:       []string{"forbidden"},
+				ModerationStreamInterval: tc.interval,
+			}, nil)
+			require.NoError(t, err)
+			gateway := httptest.NewServer(server.Handler())
+			defer gateway.Close()
+
+			request, err := http.NewRequest(http.MethodPost, gateway.URL+"/v1/generate",
+				strings.NewReader(`{"model_name": "test", "inputs": {"prompt": "a cat"}}`))
+			require.NoError(t, err)
+			request.Header.Set("UID", "1")
+			res, err := http.DefaultClient.Do(request)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			require.Equal(t, http.StatusOK, res.StatusCode)
+
+			var data []string
+			var errorEvent string
+			decoder := json.NewDecoder(res.Body)
+			for decoder.More() {
+				var event map[string]interface{}
+				require.NoError(t, decoder.Decode(&event))
+				if message, ok := event["error"]; ok {
+					errorEvent = message.(string)
+					continue
+				}
+				require.Empty(t, errorEvent, "a message was sent after the error")
+				data = append(data, event["data"].(string))
+			}
+			if len(tc.expected) == 0 {
+				require.Empty(t, data)
+			} else {
+				require.Equal(t, tc.expected, data)
+			}
+			if tc.blocked {
+				require.Equal(t, "the outputs violate the content policy", errorEvent)
+			} else {
+				require.Empty(t, errorEvent)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/HyperGAI/serving-api/utils"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// offloadPolicy tells which outputs of a model are moved to the blob store.
+type offloadPolicy struct {
+	threshold int
+	binary    []string
+}
+
+func (server *Server) offloadPolicy(modelName string) (offloadPolicy, bool) {
+	model := server.config.Model(modelName)
+	policy := offloadPolicy{threshold: model.Offload.Threshold, binary: model.Offload.Binary}
+	if policy.threshold <= 0 {
+		policy.threshold = server.config.OutputOffloadThreshold
+	}
+	return policy, server.blobs != nil && (policy.threshold > 0 || len(policy.binary) > 0)
+}
+
+// offloadOutputs returns the outputs with the binary fields and the strings longer than the
+// threshold replaced by signed URLs of the blob store. The outputs of the caller are unchanged.
+// An output which cannot be stored stays inline.
+func (server *Server) offloadOutputs(ctx context.Context, modelName string, outputs interface{}) interface{} {
+	policy, ok := server.offloadPolicy(modelName)
+	if !ok || outputs == nil {
+		return outputs
+	}
+	return server.offloadValue(ctx, modelName, policy, "", copyValue(outputs))
+}
+
+func (server *Server) offloadValue(
+	ctx context.Context,
+	modelName string,
+	policy offloadPolicy,
+	field string,
+	value interface{},
+) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			v[key] = server.offloadValue(ctx, modelName, policy, key, child)
+		}
+		return v
+	case []interface{}:
+		// The elements of an array are offloaded like the array, e.g., a list of images
+		for i, child := range v {
+			v[i] = server.offloadValue(ctx, modelName, policy, field, child)
+		}
+		return v
+	case string:
+		binary := slices.Contains(policy.binary, field)
+		if !binary && (policy.threshold <= 0 || len(v) <= policy.threshold) {
+			return v
+		}
+		data, contentType, ok := decodeBinaryOutput(v)
+		if !ok {
+			if binary && (policy.threshold <= 0 || len(v) <= policy.threshold) {
+				return v
+			}
+			data, contentType = []byte(v), "text/plain; charset=utf-8"
+		}
+		signedURL, err := server.storeOutput(ctx, data, contentType)
+		if err != nil {
+			requestLogger(ctx).Error().Err(err).Str("model", modelName).Str("field", field).
+				Msg("failed to offload an output")
+			return v
+		}
+		return signedURL
+	default:
+		return value
+	}
+}
+
+// decodeBinaryOutput decodes a data URL, e.g., "data:image/png;base64,...", or a base64 string.
+func decodeBinaryOutput(value string) ([]byte, string, bool) {
+	contentType := ""
+	if rest, ok := strings.CutPrefix(value, "data:"); ok {
+		header, encoded, found := strings.Cut(rest, ",")
+		mediaType, isBase64 := strings.CutSuffix(header, ";base64")
+		if !found || !isBase64 {
+			return nil, "", false
+		}
+		contentType, value = mediaType, encoded
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, "", false
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return data, contentType, true
+}
+
+// storeOutput writes an output to the blob store and returns its signed URL. The key is
+// the hash of the data, so that identical outputs, e.g., of cached predictions or polled
+// tasks, share a blob. A stored blob is not rewritten, its expiry is only extended when
+// it would expire before the URL.
+func (server *Server) storeOutput(ctx context.Context, data []byte, contentType string) (string, error) {
+	sum := sha256.Sum256(data)
+	key := "outputs/" + hex.EncodeToString(sum[:])
+	now := time.Now()
+	urlExpiresAt := now.Add(server.blobURLTTL())
+	info, err := server.blobs.Stat(ctx, key)
+	switch {
+	case err == nil && (info.ExpiresAt.IsZero() || !info.ExpiresAt.Before(urlExpiresAt)):
+	case err == nil:
+		err = server.blobs.Extend(ctx, key, now.Add(server.blobTTL()))
+	case errors.Is(err, utils.ErrBlobNotFound):
+		err = server.blobs.Put(ctx, key, bytes.NewReader(data), utils.BlobInfo{
+			ContentType: contentType,
+			ExpiresAt:   now.Add(server.blobTTL()),
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	return server.blobSigner.URL(key, urlExpiresAt), nil
+}
+
+// taskOwner returns the user who submitted a task, if its info has one.
+func taskOwner(info interface{}) string {
+	if task, ok := info.(map[string]interface{}); ok {
+		if userID, ok := task["uid"].(string); ok {
+			return userID
+		}
+	}
+	return ""
+}
+
+// taskModelName returns the model of a task, if its info has one.
+func taskModelName(info interface{}) string {
+	if task, ok := info.(map[string]interface{}); ok {
+		if modelName, ok := task["model_name"].(string); ok {
+			return modelName
+		}
+	}
+	return ""
+}
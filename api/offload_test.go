@@ -0,0 +1,190 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	mockapi "github.com/HyperGAI/serving-api/api/mock"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\n0000")
+
+func TestDecodeBinaryOutput(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(testPNG)
+	testCases := []struct {
+		name        string
+		value       string
+		ok          bool
+		contentType string
+	}{
+		{name: "Base64", value: encoded, ok: true, contentType: "image/png"},
+		{name: "DataURL", value: "data:image/webp;base64," + encoded, ok: true, contentType: "image/webp"},
+		{name: "NotBase64DataURL", value: "data:text/plain,hello", ok: false},
+		{name: "Text", value: "a cat on a mat", ok: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, contentType, ok := decodeBinaryOutput(tc.value)
+			require.Equal(t, tc.ok, ok)
+			if tc.ok {
+				require.Equal(t, testPNG, data)
+				require.Equal(t, tc.contentType, contentType)
+			}
+		})
+	}
+}
+
+// download gets a blob from its signed URL.
+func download(t *testing.T, server *Server, signed string) *httptest.ResponseRecorder {
+	blobURL, err := url.Parse(signed)
+	require.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest(http.MethodGet, blobURL.RequestURI(), nil)
+	require.NoError(t, err)
+	server.router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func newOffloadTestServer(t *testing.T, agentURL string, webhook Webhook) *Server {
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress:    agentURL,
+		BlobStore:              utils.BlobStoreFile,
+		BlobDir:                t.TempDir(),
+		BlobSigningKey:         "key",
+		BlobBaseURL:            "http://localhost/blobs",
+		OutputOffloadThreshold: 64,
+		Models: map[string]utils.ModelConfig{"test": {
+			Offload: utils.OffloadConfig{Binary: []string{"image"}},
+		}},
+	}, webhook)
+	require.NoError(t, err)
+	return server
+}
+
+func TestPredictOffload(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(testPNG)
+	long := strings.Repeat("a", 65)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(gin.H{"outputs": gin.H{
+			"images": []string{encoded},
+			"image":  "data:image/png;base64," + encoded,
+			"text":   long,
+			"seed":   "42",
+		}})
+	}))
+	defer upstream.Close()
+	server := newOffloadTestServer(t, upstream.URL, nil)
+
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest(http.MethodPost, "/v1/predict",
+		strings.NewReader(`{"model_name": "test", "inputs": {"prompt": "a cat"}}`))
+	require.NoError(t, err)
+	request.Header.Set("UID", "1")
+	server.router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var response struct {
+		Outputs struct {
+			Images []string `json:"images"`
+			Image  string   `json:"image"`
+			Text   string   `json:"text"`
+			Seed   string   `json:"seed"`
+		} `json:"outputs"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	outputs := response.Outputs
+	require.Equal(t, "42", outputs.Seed)
+	// The base64 of the image is shorter than the threshold, it is only offloaded as a binary field
+	require.Equal(t, []string{encoded}, outputs.Images)
+
+	require.True(t, strings.HasPrefix(outputs.Image, "http://localhost/blobs/outputs/"))
+	blob := download(t, server, outputs.Image)
+	require.Equal(t, http.StatusOK, blob.Code)
+	require.Equal(t, "image/png", blob.Header().Get("Content-Type"))
+	require.Equal(t, "inline", blob.Header().Get("Content-Disposition"))
+	require.Equal(t, "nosniff", blob.Header().Get("X-Content-Type-Options"))
+	require.Equal(t, testPNG, blob.Body.Bytes())
+
+	blob = download(t, server, outputs.Text)
+	require.Equal(t, http.StatusOK, blob.Code)
+	require.Equal(t, "text/plain; charset=utf-8", blob.Header().Get("Content-Type"))
+	require.Equal(t, "attachment", blob.Header().Get("Content-Disposition"))
+	require.Equal(t, long, blob.Body.String())
+}
+
+func TestGetTaskOffload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	encoded := base64.StdEncoding.EncodeToString(testPNG)
+	webhook := mockapi.NewMockWebhook(ctrl)
+	webhook.EXPECT().
+		GetTaskInfo(gomock.Any(), "1234").
+		Return(map[string]interface{}{
+			"model_name": "test",
+			"status":     "succeeded",
+			"outputs":    map[string]interface{}{"image": encoded},
+		}, nil)
+	server := newOffloadTestServer(t, "", webhook)
+
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest(http.MethodGet, "/task/1234", nil)
+	require.NoError(t, err)
+	// getTask reads the ID from the request URI, which is set by the servers
+	request.RequestURI = "/task/1234"
+	request.Header.Set("UID", "1")
+	server.router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var task struct {
+		Status  string            `json:"status"`
+		Outputs map[string]string `json:"outputs"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &task))
+	require.Equal(t, "succeeded", task.Status)
+	blob := download(t, server, task.Outputs["image"])
+	require.Equal(t, http.StatusOK, blob.Code)
+	require.Equal(t, testPNG, blob.Body.Bytes())
+}
+
+func TestStoreOutput(t *testing.T) {
+	server := newOffloadTestServer(t, "", nil)
+	server.config.BlobTTL = 2 * time.Hour
+	ctx := context.Background()
+
+	_, err := server.storeOutput(ctx, testPNG, "image/png")
+	require.NoError(t, err)
+	var key string
+	var stored utils.BlobInfo
+	require.NoError(t, server.blobs.Walk(ctx, func(k string, info utils.BlobInfo) error {
+		key, stored = k, info
+		return nil
+	}))
+
+	// The blob outlives the URL, it is left as is
+	_, err = server.storeOutput(ctx, testPNG, "image/png")
+	require.NoError(t, err)
+	info, err := server.blobs.Stat(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, stored, info)
+
+	// The blob would expire before the URL, only its expiry is extended
+	require.NoError(t, server.blobs.Extend(ctx, key, time.Now().Add(time.Minute)))
+	signed, err := server.storeOutput(ctx, testPNG, "image/png")
+	require.NoError(t, err)
+	info, err = server.blobs.Stat(ctx, key)
+	require.NoError(t, err)
+	require.True(t, info.ExpiresAt.After(time.Now().Add(time.Hour)))
+	require.Equal(t, stored.CreatedAt, info.CreatedAt)
+	require.Equal(t, testPNG, download(t, server, signed).Body.Bytes())
+}
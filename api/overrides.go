@@ -0,0 +1,290 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"github.com/ulule/limiter/v3"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	overridesKey        = "overrides"
+	overridesVersionKey = "overrides:version"
+)
+
+// UserOverride changes the limits of a user at runtime.
+type UserOverride struct {
+	UserID string `json:"uid"`
+	// A custom rate, e.g., "100-M", which replaces the policies of the user in every route group
+	Rate string `json:"rate,omitempty"`
+	// An allowlisted user is exempt from the rate and concurrency limits
+	Allowlisted bool `json:"allowlisted,omitempty"`
+	// A banned user is rejected until BannedUntil (unix), or indefinitely if it is zero
+	Banned      bool   `json:"banned,omitempty"`
+	BannedUntil int64  `json:"banned_until,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	UpdatedAt   int64  `json:"updated_at"`
+}
+
+func (override *UserOverride) banned(now time.Time) bool {
+	return override.Banned && (override.BannedUntil == 0 || now.Unix() < override.BannedUntil)
+}
+
+// OverrideStore holds the overrides of the users. They are stored in a Redis hash, and every
+// replica reloads them when the version key changes, so that updates apply within seconds.
+// Without Redis, the overrides only apply to this instance.
+type OverrideStore struct {
+	client    *goredis.Client
+	interval  time.Duration
+	mu        sync.RWMutex
+	overrides map[string]UserOverride
+	version   int64
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+func NewOverrideStore(client *goredis.Client, interval time.Duration) *OverrideStore {
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	return &OverrideStore{
+		client:    client,
+		interval:  interval,
+		overrides: make(map[string]UserOverride),
+		version:   -1,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start polls the version of the overrides in Redis.
+func (store *OverrideStore) Start() {
+	if store.client == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(store.interval)
+		defer ticker.Stop()
+		for {
+			store.refresh(context.Background())
+			select {
+			case <-store.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (store *OverrideStore) Stop() {
+	store.stopOnce.Do(func() {
+		close(store.stop)
+	})
+}
+
+// refresh reloads the overrides if their version changed. The last loaded overrides
+// stay in effect while Redis is unavailable.
+func (store *OverrideStore) refresh(ctx context.Context) {
+	version, err := store.client.Get(ctx, overridesVersionKey).Int64()
+	if err != nil && err != goredis.Nil {
+		log.Error().Err(err).Msg("failed to read the version of the overrides")
+		return
+	}
+	store.mu.RLock()
+	unchanged := version == store.version
+	store.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	values, err := store.client.HGetAll(ctx, overridesKey).Result()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to load the overrides")
+		return
+	}
+	overrides := make(map[string]UserOverride, len(values))
+	for userID, value := range values {
+		var override UserOverride
+		if err := json.Unmarshal([]byte(value), &override); err != nil {
+			log.Error().Err(err).Str("uid", userID).Msg("invalid override")
+			continue
+		}
+		overrides[userID] = override
+	}
+	store.mu.Lock()
+	store.overrides, store.version = overrides, version
+	store.mu.Unlock()
+	log.Info().Int("overrides", len(overrides)).Int64("version", version).Msg("loaded the overrides")
+}
+
+func (store *OverrideStore) Get(userID string) (UserOverride, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	override, ok := store.overrides[userID]
+	return override, ok
+}
+
+func (store *OverrideStore) List() []UserOverride {
+	store.mu.RLock()
+	overrides := make([]UserOverride, 0, len(store.overrides))
+	for _, override := range store.overrides {
+		overrides = append(overrides, override)
+	}
+	store.mu.RUnlock()
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].UserID < overrides[j].UserID })
+	return overrides
+}
+
+func (store *OverrideStore) Set(ctx context.Context, override UserOverride) error {
+	if store.client != nil {
+		value, err := json.Marshal(override)
+		if err != nil {
+			return err
+		}
+		pipe := store.client.TxPipeline()
+		pipe.HSet(ctx, overridesKey, override.UserID, value)
+		pipe.Incr(ctx, overridesVersionKey)
+		if _, err = pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	store.mu.Lock()
+	store.overrides[override.UserID] = override
+	store.mu.Unlock()
+	return nil
+}
+
+func (store *OverrideStore) Delete(ctx context.Context, userID string) error {
+	if store.client != nil {
+		pipe := store.client.TxPipeline()
+		pipe.HDel(ctx, overridesKey, userID)
+		pipe.Incr(ctx, overridesVersionKey)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	store.mu.Lock()
+	delete(store.overrides, userID)
+	store.mu.Unlock()
+	return nil
+}
+
+// Allowlisted returns if a user is exempt from the limits.
+func (store *OverrideStore) Allowlisted(userID string) bool {
+	override, ok := store.Get(userID)
+	return ok && override.Allowlisted
+}
+
+// Middleware rejects the requests of the banned users.
+func (store *OverrideStore) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userID := ctx.Request.Header.Get("UID")
+		override, ok := store.Get(userID)
+		if ok && override.banned(time.Now()) {
+			response := gin.H{"error": "user is banned"}
+			if override.BannedUntil > 0 {
+				response["until"] = override.BannedUntil
+				ctx.Header("Retry-After", fmt.Sprint(override.BannedUntil-time.Now().Unix()))
+			}
+			ctx.AbortWithStatusJSON(http.StatusForbidden, response)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+type OverrideRequest struct {
+	Rate        string `json:"rate"`
+	Allowlisted bool   `json:"allowlisted"`
+	Banned      bool   `json:"banned"`
+	// The ban expires after this duration, e.g., "24h", it is indefinite if empty
+	BanDuration string `json:"ban_duration"`
+	Reason      string `json:"reason"`
+}
+
+func (server *Server) listOverrides(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, server.overrides.List())
+}
+
+func (server *Server) getOverride(ctx *gin.Context) {
+	var user UserRequest
+	if err := ctx.ShouldBindUri(&user); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	override, ok := server.overrides.Get(user.UserID)
+	if !ok {
+		ctx.JSON(http.StatusNotFound, errorResponse(errors.New("no override")))
+		return
+	}
+	ctx.JSON(http.StatusOK, override)
+}
+
+func (server *Server) setOverride(ctx *gin.Context) {
+	defer server.audit.recordOutcome(ctx, auditOverrideSet, ctx.Param("uid"))
+	var user UserRequest
+	if err := ctx.ShouldBindUri(&user); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	var req OverrideRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	if req.Rate != "" {
+		if _, err := limiter.NewRateFromFormatted(req.Rate); err != nil {
+			ctx.JSON(http.StatusBadRequest, errorResponse(fmt.Errorf("invalid rate: %w", err)))
+			return
+		}
+	}
+	now := time.Now()
+	override := UserOverride{
+		UserID:      user.UserID,
+		Rate:        req.Rate,
+		Allowlisted: req.Allowlisted,
+		Banned:      req.Banned,
+		Reason:      req.Reason,
+		UpdatedAt:   now.Unix(),
+	}
+	if req.Banned && req.BanDuration != "" {
+		duration, err := time.ParseDuration(req.BanDuration)
+		if err != nil || duration <= 0 {
+			ctx.JSON(http.StatusBadRequest, errorResponse(fmt.Errorf("invalid ban duration %q", req.BanDuration)))
+			return
+		}
+		override.BannedUntil = now.Add(duration).Unix()
+	}
+	if err := server.overrides.Set(ctx.Request.Context(), override); err != nil {
+		requestLogger(ctx.Request.Context()).Error().Err(err).Str("uid", user.UserID).Msg("failed to set the override")
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+	requestLogger(ctx.Request.Context()).Info().Str("uid", user.UserID).Str("rate", override.Rate).
+		Bool("allowlisted", override.Allowlisted).Bool("banned", override.Banned).
+		Int64("banned_until", override.BannedUntil).Str("reason", override.Reason).Msg("set the override")
+	ctx.JSON(http.StatusOK, override)
+}
+
+func (server *Server) deleteOverride(ctx *gin.Context) {
+	defer server.audit.recordOutcome(ctx, auditOverrideDelete, ctx.Param("uid"))
+	var user UserRequest
+	if err := ctx.ShouldBindUri(&user); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	if err := server.overrides.Delete(ctx.Request.Context(), user.UserID); err != nil {
+		requestLogger(ctx.Request.Context()).Error().Err(err).Str("uid", user.UserID).Msg("failed to delete the override")
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+	requestLogger(ctx.Request.Context()).Info().Str("uid", user.UserID).Msg("deleted the override")
+	ctx.Status(http.StatusNoContent)
+}
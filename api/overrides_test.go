@@ -0,0 +1,92 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUserOverrides(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"outputs": "test"}`))
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress: upstream.URL,
+		AdminAPIKey:         "secret",
+	}, nil)
+	require.NoError(t, err)
+	defer server.Close(context.Background())
+
+	admin := func(method string, body string) int {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(method, "/admin/overrides/1", bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+		request.Header.Set("apikey", "secret")
+		server.router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	predict := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(http.MethodPost, "/v1/predict",
+			bytes.NewReader([]byte(`{"model_name": "test", "inputs": {"prompt": "a cat"}}`)))
+		require.NoError(t, err)
+		request.Header.Set("UID", "1")
+		server.router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	testCases := []struct {
+		name           string
+		method         string
+		body           string
+		expectedAdmin  int
+		expectedStatus int
+	}{
+		{name: "InvalidRate", method: http.MethodPut, body: `{"rate": "abc"}`,
+			expectedAdmin: http.StatusBadRequest, expectedStatus: http.StatusOK},
+		{name: "InvalidBanDuration", method: http.MethodPut, body: `{"banned": true, "ban_duration": "soon"}`,
+			expectedAdmin: http.StatusBadRequest, expectedStatus: http.StatusOK},
+		{name: "TemporaryBan", method: http.MethodPut, body: `{"banned": true, "ban_duration": "1h"}`,
+			expectedAdmin: http.StatusOK, expectedStatus: http.StatusForbidden},
+		{name: "Unban", method: http.MethodDelete,
+			expectedAdmin: http.StatusNoContent, expectedStatus: http.StatusOK},
+		{name: "Ban", method: http.MethodPut, body: `{"banned": true, "reason": "abuse"}`,
+			expectedAdmin: http.StatusOK, expectedStatus: http.StatusForbidden},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expectedAdmin, admin(tc.method, tc.body))
+			require.Equal(t, tc.expectedStatus, predict().Code)
+		})
+	}
+}
+
+func TestOverrideStore(t *testing.T) {
+	store := NewOverrideStore(nil, time.Second)
+	ctx := context.Background()
+	require.NoError(t, store.Set(ctx, UserOverride{UserID: "12", Allowlisted: true}))
+	require.NoError(t, store.Set(ctx, UserOverride{UserID: "3", Banned: true, BannedUntil: time.Now().Unix() - 1}))
+
+	require.NoError(t, store.Set(ctx, UserOverride{UserID: "a:12"}))
+
+	require.True(t, store.Allowlisted("12"))
+	require.False(t, store.Allowlisted("2"))
+	require.False(t, store.Allowlisted("a:12"))
+
+	// An expired ban no longer applies
+	override, ok := store.Get("3")
+	require.True(t, ok)
+	require.False(t, override.banned(time.Now()))
+	require.Len(t, store.List(), 3)
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	goredis "github.com/redis/go-redis/v9"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPlan       = "default"
+	planCacheTTL      = 30 * time.Second
+	planCacheCapacity = 10000
+)
+
+type cachedPlan struct {
+	plan      string
+	expiresAt time.Time
+}
+
+// PlanResolver maps users to their plans, from the config then from Redis if enabled.
+// While Redis is unavailable, the users get the cached or default plan.
+type PlanResolver struct {
+	config utils.RateLimitConfig
+	client *goredis.Client
+	health *utils.RedisHealth
+	mu     sync.Mutex
+	plans  map[string]cachedPlan
+}
+
+func NewPlanResolver(config utils.RateLimitConfig, client *goredis.Client, health *utils.RedisHealth) *PlanResolver {
+	return &PlanResolver{
+		config: config,
+		client: client,
+		health: health,
+		plans:  make(map[string]cachedPlan),
+	}
+}
+
+// Plan returns the plan of a user.
+func (resolver *PlanResolver) Plan(ctx context.Context, userID string) string {
+	if plan, ok := resolver.config.Users[userID]; ok {
+		return plan
+	}
+	fallback := resolver.config.DefaultPlan
+	if fallback == "" {
+		fallback = defaultPlan
+	}
+	if !resolver.config.RedisLookup || resolver.client == nil {
+		return fallback
+	}
+
+	resolver.mu.Lock()
+	cached, ok := resolver.plans[userID]
+	resolver.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.plan
+	}
+	if !resolver.health.Available() {
+		if ok {
+			return cached.plan
+		}
+		return fallback
+	}
+	plan, err := resolver.client.Get(ctx, fmt.Sprintf("plan:%s", userID)).Result()
+	if err != nil {
+		if err != goredis.Nil {
+			resolver.health.Fail(err)
+			requestLogger(ctx).Error().Err(err).Msg("failed to look up the plan")
+			return fallback
+		}
+		plan = fallback
+	}
+	resolver.mu.Lock()
+	if len(resolver.plans) >= planCacheCapacity {
+		resolver.plans = make(map[string]cachedPlan)
+	}
+	resolver.plans[userID] = cachedPlan{plan: plan, expiresAt: time.Now().Add(planCacheTTL)}
+	resolver.mu.Unlock()
+	return plan
+}
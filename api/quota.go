@@ -0,0 +1,388 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	quotaCharged          = 0
+	quotaDailyExhausted   = 1
+	quotaMonthlyExhausted = 2
+	requestCostKey        = "requestCost"
+)
+
+// chargeQuotaScript charges a cost to the daily and monthly usage of a user if both stay within budget.
+// KEYS: the daily and monthly usage, ARGV: cost, daily budget, monthly budget, daily and monthly TTLs (s).
+// A zero budget is unlimited. It returns 0 if charged, 1 if the daily or 2 if the monthly budget is exhausted.
+var chargeQuotaScript = goredis.NewScript(`
+local cost = tonumber(ARGV[1])
+local daily = tonumber(redis.call('GET', KEYS[1]) or '0')
+local monthly = tonumber(redis.call('GET', KEYS[2]) or '0')
+if tonumber(ARGV[2]) > 0 and daily + cost > tonumber(ARGV[2]) then
+	return 1
+end
+if tonumber(ARGV[3]) > 0 and monthly + cost > tonumber(ARGV[3]) then
+	return 2
+end
+redis.call('INCRBYFLOAT', KEYS[1], ARGV[1])
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+redis.call('INCRBYFLOAT', KEYS[2], ARGV[1])
+redis.call('EXPIRE', KEYS[2], ARGV[5])
+return 0
+`)
+
+var errInvalidCost = errors.New("the cost of the request must be positive")
+
+// validateCost checks the cost function of a model when the server starts, so that a
+// misconfigured cost fails the startup rather than every request. The cost of a request
+// with the default factors must be positive.
+func validateCost(config utils.CostConfig, transform *Transform) error {
+	if config.Base < 0 || config.Scale < 0 {
+		return errors.New("the base and the scale of the cost cannot be negative")
+	}
+	_, err := requestCost(config, transform, nil)
+	return err
+}
+
+// requestCost evaluates the cost function of a model over the inputs of a request, as they
+// are sent to the agent after the transforms, e.g., with the clamped values. The factors
+// are at least 0, and a cost which is not positive, e.g., of a zero input, is an error, so
+// that no request lowers the usage or raises the credits of a user.
+func requestCost(config utils.CostConfig, transform *Transform, inputs map[string]interface{}) (float64, error) {
+	if config.Base == 0 && len(config.Factors) == 0 {
+		return 1, nil
+	}
+	inputs = transform.Request(inputs)
+	cost := config.Base
+	if len(config.Factors) > 0 {
+		product := 1.0
+		for _, factor := range config.Factors {
+			value, ok := inputs[factor.Field].(float64)
+			if !ok {
+				value = factor.Default
+			}
+			product *= max(value, 0)
+		}
+		scale := config.Scale
+		if scale == 0 {
+			scale = 1
+		}
+		cost += scale * product
+	}
+	if !(cost > 0) {
+		return 0, errInvalidCost
+	}
+	return cost, nil
+}
+
+// usagePeriods returns the keys of the daily and monthly usage of a user, and when they reset.
+func usagePeriods(userID string, now time.Time) (string, string, time.Time, time.Time) {
+	now = now.UTC()
+	dailyReset := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	monthlyReset := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	return fmt.Sprintf("quota:%s:day:%s", userID, now.Format("20060102")),
+		fmt.Sprintf("quota:%s:month:%s", userID, now.Format("200601")),
+		dailyReset, monthlyReset
+}
+
+// quotaStore holds the usage of the users in cost units.
+type quotaStore interface {
+	charge(ctx context.Context, dailyKey string, monthlyKey string, cost float64,
+		policy *utils.QuotaPolicy, dailyTTL time.Duration, monthlyTTL time.Duration) (int, error)
+	refund(ctx context.Context, dailyKey string, monthlyKey string, cost float64) error
+	usage(ctx context.Context, dailyKey string, monthlyKey string) (float64, float64, error)
+}
+
+type redisQuotaStore struct {
+	client *goredis.Client
+}
+
+func (store *redisQuotaStore) charge(
+	ctx context.Context,
+	dailyKey string,
+	monthlyKey string,
+	cost float64,
+	policy *utils.QuotaPolicy,
+	dailyTTL time.Duration,
+	monthlyTTL time.Duration,
+) (int, error) {
+	return chargeQuotaScript.Run(ctx, store.client, []string{dailyKey, monthlyKey},
+		cost, policy.Daily, policy.Monthly, int(dailyTTL.Seconds()), int(monthlyTTL.Seconds())).Int()
+}
+
+func (store *redisQuotaStore) refund(ctx context.Context, dailyKey string, monthlyKey string, cost float64) error {
+	pipe := store.client.TxPipeline()
+	pipe.IncrByFloat(ctx, dailyKey, -cost)
+	pipe.IncrByFloat(ctx, monthlyKey, -cost)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (store *redisQuotaStore) usage(ctx context.Context, dailyKey string, monthlyKey string) (float64, float64, error) {
+	values, err := store.client.MGet(ctx, dailyKey, monthlyKey).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	usage := make([]float64, 2)
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			usage[i], _ = strconv.ParseFloat(s, 64)
+		}
+	}
+	return usage[0], usage[1], nil
+}
+
+// memoryQuotaStore holds the usage per instance, it is used while Redis is unavailable.
+// The entries of the past periods are pruned once they expire.
+type memoryQuotaStore struct {
+	mu      sync.Mutex
+	values  map[string]quotaEntry
+	pruneAt time.Time
+}
+
+type quotaEntry struct {
+	value     float64
+	expiresAt time.Time
+}
+
+func newMemoryQuotaStore() *memoryQuotaStore {
+	return &memoryQuotaStore{values: make(map[string]quotaEntry)}
+}
+
+// add adds to the usage of a key, it must be called with the lock held.
+func (store *memoryQuotaStore) add(key string, value float64, expiresAt time.Time) {
+	entry := store.values[key]
+	entry.value += value
+	if expiresAt.After(entry.expiresAt) {
+		entry.expiresAt = expiresAt
+	}
+	store.values[key] = entry
+}
+
+// prune deletes the expired entries at most once a minute, it must be called with the lock held.
+func (store *memoryQuotaStore) prune(now time.Time) {
+	if now.Before(store.pruneAt) {
+		return
+	}
+	store.pruneAt = now.Add(time.Minute)
+	for key, entry := range store.values {
+		if now.After(entry.expiresAt) {
+			delete(store.values, key)
+		}
+	}
+}
+
+func (store *memoryQuotaStore) charge(
+	_ context.Context,
+	dailyKey string,
+	monthlyKey string,
+	cost float64,
+	policy *utils.QuotaPolicy,
+	dailyTTL time.Duration,
+	monthlyTTL time.Duration,
+) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	store.prune(now)
+	if policy.Daily > 0 && store.values[dailyKey].value+cost > policy.Daily {
+		return quotaDailyExhausted, nil
+	}
+	if policy.Monthly > 0 && store.values[monthlyKey].value+cost > policy.Monthly {
+		return quotaMonthlyExhausted, nil
+	}
+	store.add(dailyKey, cost, now.Add(dailyTTL))
+	store.add(monthlyKey, cost, now.Add(monthlyTTL))
+	return quotaCharged, nil
+}
+
+func (store *memoryQuotaStore) refund(_ context.Context, dailyKey string, monthlyKey string, cost float64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	// The usage of the periods pruned meanwhile is not recreated
+	for _, key := range []string{dailyKey, monthlyKey} {
+		if _, ok := store.values[key]; ok {
+			store.add(key, -cost, time.Time{})
+		}
+	}
+	return nil
+}
+
+func (store *memoryQuotaStore) usage(_ context.Context, dailyKey string, monthlyKey string) (float64, float64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.values[dailyKey].value, store.values[monthlyKey].value, nil
+}
+
+// QuotaManager enforces the daily and monthly usage budgets of the users. Each request
+// is charged the cost of its model, and refunded if it fails or is rejected.
+type QuotaManager struct {
+	policies   []utils.QuotaPolicy
+	models     map[string]utils.ModelConfig
+	transforms map[string]*Transform
+	plans      *PlanResolver
+	redis      quotaStore
+	health     *utils.RedisHealth
+	memory     quotaStore
+}
+
+func NewQuotaManager(
+	config utils.Config,
+	client *goredis.Client,
+	health *utils.RedisHealth,
+	plans *PlanResolver,
+	transforms map[string]*Transform,
+) *QuotaManager {
+	manager := &QuotaManager{
+		policies:   config.RateLimits.Quotas,
+		models:     config.Models,
+		transforms: transforms,
+		plans:      plans,
+		health:     health,
+		memory:     newMemoryQuotaStore(),
+	}
+	if client != nil {
+		manager.redis = &redisQuotaStore{client: client}
+	}
+	return manager
+}
+
+func (manager *QuotaManager) match(plan string) *utils.QuotaPolicy {
+	var best *utils.QuotaPolicy
+	bestScore := -1
+	for i := range manager.policies {
+		policy := &manager.policies[i]
+		if score := policySpecificity([]string{policy.Plan}, []string{plan}); score > bestScore {
+			best, bestScore = policy, score
+		}
+	}
+	return best
+}
+
+// do runs an operation on the Redis store, or on the memory store while Redis is unavailable.
+func (manager *QuotaManager) do(f func(store quotaStore) error) {
+	if manager.redis != nil && manager.health.Available() {
+		err := f(manager.redis)
+		if err == nil {
+			return
+		}
+		manager.health.Fail(err)
+		log.Error().Err(err).Msg("failed to access the usage quotas in redis")
+	}
+	_ = f(manager.memory)
+}
+
+// Middleware charges the cost of a prediction to the budgets of the user. It responds
+// with 429 when the daily budget is exhausted, and 402 when the monthly one is.
+func (manager *QuotaManager) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req, ok := peekInferRequest(ctx)
+		if !ok {
+			// The handler rejects the invalid request
+			ctx.Next()
+			return
+		}
+		cost, err := requestCost(manager.models[req.ModelName].Cost, manager.transforms[req.ModelName], req.Inputs)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, errorResponse(err))
+			return
+		}
+		ctx.Set(requestCostKey, cost)
+
+		userID := ctx.Request.Header.Get("UID")
+		policy := manager.match(manager.plans.Plan(ctx.Request.Context(), userID))
+		if policy == nil || (policy.Daily <= 0 && policy.Monthly <= 0) {
+			ctx.Next()
+			return
+		}
+
+		now := time.Now()
+		dailyKey, monthlyKey, dailyReset, monthlyReset := usagePeriods(userID, now)
+		status := quotaCharged
+		manager.do(func(store quotaStore) (err error) {
+			status, err = store.charge(ctx.Request.Context(), dailyKey, monthlyKey, cost, policy,
+				dailyReset.Sub(now)+time.Hour, monthlyReset.Sub(now)+time.Hour)
+			return err
+		})
+		switch status {
+		case quotaDailyExhausted:
+			quotaRejections.WithLabelValues("daily").Inc()
+			ctx.Header("Retry-After", strconv.Itoa(int(dailyReset.Sub(now).Seconds())+1))
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error": fmt.Sprintf("daily usage budget of %g exhausted", policy.Daily),
+				"reset": dailyReset.Unix(),
+			})
+			return
+		case quotaMonthlyExhausted:
+			quotaRejections.WithLabelValues("monthly").Inc()
+			ctx.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{
+				"error": fmt.Sprintf("monthly usage budget of %g exhausted", policy.Monthly),
+				"reset": monthlyReset.Unix(),
+			})
+			return
+		}
+
+		ctx.Next()
+		// The rejections of the handler, e.g., by the admission control or the moderation,
+		// and the failed or abandoned predictions are refunded
+		failed := ctx.Writer.Status() >= http.StatusBadRequest || len(ctx.Errors) > 0 ||
+			ctx.Request.Context().Err() != nil
+		if failed {
+			manager.do(func(store quotaStore) error {
+				return store.refund(context.Background(), dailyKey, monthlyKey, cost)
+			})
+		}
+	}
+}
+
+// Usage returns the plan of a user, with the usage and budgets of the current periods.
+func (manager *QuotaManager) Usage(ctx context.Context, userID string) gin.H {
+	plan := manager.plans.Plan(ctx, userID)
+	policy := manager.match(plan)
+	if policy == nil {
+		policy = &utils.QuotaPolicy{}
+	}
+	now := time.Now()
+	dailyKey, monthlyKey, dailyReset, monthlyReset := usagePeriods(userID, now)
+	var daily, monthly float64
+	manager.do(func(store quotaStore) (err error) {
+		daily, monthly, err = store.usage(ctx, dailyKey, monthlyKey)
+		return err
+	})
+	return gin.H{
+		"plan":    plan,
+		"daily":   usagePeriod(daily, policy.Daily, dailyReset),
+		"monthly": usagePeriod(monthly, policy.Monthly, monthlyReset),
+	}
+}
+
+func usagePeriod(used float64, budget float64, reset time.Time) gin.H {
+	period := gin.H{
+		"used":  used,
+		"reset": reset.Unix(),
+	}
+	if budget > 0 {
+		remaining := budget - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		period["budget"] = budget
+		period["remaining"] = remaining
+	}
+	return period
+}
+
+func (server *Server) getUsage(ctx *gin.Context) {
+	userID := ctx.Request.Header.Get("UID")
+	ctx.JSON(http.StatusOK, server.quotas.Usage(ctx.Request.Context(), userID))
+}
@@ -0,0 +1,280 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRequestCost(t *testing.T) {
+	cost := utils.CostConfig{
+		Base:  1,
+		Scale: 0.01,
+		Factors: []utils.CostFactor{
+			{Field: "steps", Default: 10},
+			{Field: "width", Default: 10},
+		},
+	}
+	clamp, err := NewTransform(utils.TransformConfig{Request: utils.RequestTransform{
+		Clamp: map[string]utils.ClampRange{"steps": {Min: float(1), Max: float(50)}},
+	}})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		config    utils.CostConfig
+		transform *Transform
+		inputs    map[string]interface{}
+		expected  float64
+		err       error
+	}{
+		{name: "NoCost", config: utils.CostConfig{}, expected: 1},
+		{name: "Base", config: utils.CostConfig{Base: 3}, inputs: map[string]interface{}{"steps": 10.0}, expected: 3},
+		{name: "Defaults", config: cost, expected: 2},
+		{name: "Factors", config: cost, inputs: map[string]interface{}{"steps": 20.0, "width": 50.0}, expected: 11},
+		{name: "NotNumber", config: cost, inputs: map[string]interface{}{"steps": "many"}, expected: 2},
+		{name: "NegativeFactor", config: cost, inputs: map[string]interface{}{"steps": -100.0}, expected: 1},
+		{name: "TwoNegativeFactors", config: cost, inputs: map[string]interface{}{"steps": -100.0, "width": -100.0},
+			expected: 1},
+		{name: "ZeroCost", config: utils.CostConfig{Factors: cost.Factors}, inputs: map[string]interface{}{"steps": 0.0},
+			err: errInvalidCost},
+		{name: "NegativeBase", config: utils.CostConfig{Base: -5}, err: errInvalidCost},
+		{name: "Clamped", config: cost, transform: clamp, inputs: map[string]interface{}{"steps": 1000.0},
+			expected: 6},
+		{name: "ClampedFromZero", config: utils.CostConfig{Factors: cost.Factors}, transform: clamp,
+			inputs: map[string]interface{}{"steps": 0.0}, expected: 10},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cost, err := requestCost(tc.config, tc.transform, tc.inputs)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.InDelta(t, tc.expected, cost, 1e-9)
+		})
+	}
+}
+
+func TestUsagePeriods(t *testing.T) {
+	testCases := []struct {
+		name         string
+		now          time.Time
+		dailyKey     string
+		monthlyKey   string
+		dailyReset   time.Time
+		monthlyReset time.Time
+	}{
+		{
+			name:         "EndOfMonth",
+			now:          time.Date(2024, 1, 31, 23, 30, 0, 0, time.UTC),
+			dailyKey:     "quota:1:day:20240131",
+			monthlyKey:   "quota:1:month:202401",
+			dailyReset:   time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+			monthlyReset: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:         "EndOfYear",
+			now:          time.Date(2024, 12, 15, 12, 0, 0, 0, time.UTC),
+			dailyKey:     "quota:1:day:20241215",
+			monthlyKey:   "quota:1:month:202412",
+			dailyReset:   time.Date(2024, 12, 16, 0, 0, 0, 0, time.UTC),
+			monthlyReset: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// The periods are in UTC
+			name:         "OtherTimeZone",
+			now:          time.Date(2024, 3, 1, 1, 0, 0, 0, time.FixedZone("CET", 3600)),
+			dailyKey:     "quota:1:day:20240301",
+			monthlyKey:   "quota:1:month:202403",
+			dailyReset:   time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC),
+			monthlyReset: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dailyKey, monthlyKey, dailyReset, monthlyReset := usagePeriods("1", tc.now)
+			require.Equal(t, tc.dailyKey, dailyKey)
+			require.Equal(t, tc.monthlyKey, monthlyKey)
+			require.Equal(t, tc.dailyReset, dailyReset)
+			require.Equal(t, tc.monthlyReset, monthlyReset)
+		})
+	}
+}
+
+func TestMemoryQuotaStore(t *testing.T) {
+	store := newMemoryQuotaStore()
+	ctx := context.Background()
+	policy := &utils.QuotaPolicy{Daily: 10, Monthly: 15}
+
+	status, err := store.charge(ctx, "day", "month", 6, policy, time.Hour, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, quotaCharged, status)
+	status, err = store.charge(ctx, "day", "month", 6, policy, time.Hour, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, quotaDailyExhausted, status)
+
+	// A new day, in the same month
+	status, err = store.charge(ctx, "next-day", "month", 6, policy, time.Hour, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, quotaCharged, status)
+	status, err = store.charge(ctx, "last-day", "month", 6, policy, time.Hour, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, quotaMonthlyExhausted, status)
+
+	require.NoError(t, store.refund(ctx, "next-day", "month", 6))
+	daily, monthly, err := store.usage(ctx, "next-day", "month")
+	require.NoError(t, err)
+	require.Equal(t, 0.0, daily)
+	require.Equal(t, 6.0, monthly)
+
+	// The unlimited budgets
+	status, err = store.charge(ctx, "day", "month", 100, &utils.QuotaPolicy{}, time.Hour, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, quotaCharged, status)
+
+	// The expired periods are pruned
+	_, err = store.charge(ctx, "past-day", "past-month", 1, policy, -time.Second, -time.Second)
+	require.NoError(t, err)
+	store.pruneAt = time.Time{}
+	_, err = store.charge(ctx, "day", "month", 0, policy, time.Hour, time.Hour)
+	require.NoError(t, err)
+	require.NotContains(t, store.values, "past-day")
+	require.NotContains(t, store.values, "past-month")
+	require.Contains(t, store.values, "day")
+	// A refund does not recreate them
+	require.NoError(t, store.refund(ctx, "past-day", "past-month", 1))
+	require.NotContains(t, store.values, "past-day")
+}
+
+func TestValidateCost(t *testing.T) {
+	factors := []utils.CostFactor{{Field: "steps", Default: 10}}
+	testCases := []struct {
+		name   string
+		config utils.CostConfig
+		valid  bool
+	}{
+		{name: "NoCost", config: utils.CostConfig{}, valid: true},
+		{name: "Factors", config: utils.CostConfig{Factors: factors}, valid: true},
+		{name: "NegativeBase", config: utils.CostConfig{Base: -1, Factors: factors}},
+		{name: "NegativeScale", config: utils.CostConfig{Base: 1, Scale: -1}},
+		{name: "ZeroDefault", config: utils.CostConfig{Factors: []utils.CostFactor{{Field: "steps"}}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateCost(tc.config, nil)
+			if tc.valid {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+		})
+	}
+
+	// A misconfigured cost fails the startup
+	_, err := NewServer(utils.Config{Models: map[string]utils.ModelConfig{"test": {
+		Cost: utils.CostConfig{Base: -1},
+	}}}, nil)
+	require.ErrorContains(t, err, "invalid cost of model test")
+}
+
+func TestQuotaMiddleware(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req InferRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		if req.Inputs["reject"] == true {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": "invalid prompt"}`))
+			return
+		}
+		if req.Inputs["fail"] == true {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error": "failed"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"outputs": "test"}`))
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress: upstream.URL,
+		RateLimits: utils.RateLimitConfig{
+			Quotas: []utils.QuotaPolicy{{Plan: "*", Daily: 10}},
+		},
+		Models: map[string]utils.ModelConfig{"test": {
+			Cost: utils.CostConfig{Factors: []utils.CostFactor{{Field: "steps", Default: 1}}},
+			Transform: utils.TransformConfig{Request: utils.RequestTransform{
+				Clamp: map[string]utils.ClampRange{"steps": {Max: float(4)}},
+			}},
+		}},
+	}, nil)
+	require.NoError(t, err)
+
+	predict := func(inputs gin.H) *httptest.ResponseRecorder {
+		data, err := json.Marshal(gin.H{"model_name": "test", "inputs": inputs})
+		require.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(http.MethodPost, "/v1/predict", bytes.NewReader(data))
+		require.NoError(t, err)
+		request.Header.Set("UID", "1")
+		server.router.ServeHTTP(recorder, request)
+		return recorder
+	}
+	usage := func() float64 {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(http.MethodGet, "/v1/usage", nil)
+		require.NoError(t, err)
+		request.Header.Set("UID", "1")
+		server.router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		var usage struct {
+			Daily struct {
+				Used float64 `json:"used"`
+			} `json:"daily"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &usage))
+		return usage.Daily.Used
+	}
+
+	// The non-positive costs are rejected, so that they cannot lower the usage
+	require.Equal(t, http.StatusBadRequest, predict(gin.H{"steps": -8}).Code)
+	require.Equal(t, http.StatusBadRequest, predict(gin.H{"steps": 0}).Code)
+	require.Equal(t, 0.0, usage())
+
+	// The cost is the one of the clamped inputs
+	require.Equal(t, http.StatusOK, predict(gin.H{"steps": 1000}).Code)
+	require.Equal(t, 4.0, usage())
+
+	// Failed and rejected predictions are refunded
+	require.Equal(t, http.StatusInternalServerError, predict(gin.H{"steps": 4, "fail": true}).Code)
+	require.Equal(t, 4.0, usage())
+	require.Equal(t, http.StatusBadRequest, predict(gin.H{"steps": 4, "reject": true}).Code)
+	require.Equal(t, 4.0, usage())
+
+	require.Equal(t, http.StatusOK, predict(gin.H{"steps": 4}).Code)
+	recorder := predict(gin.H{"steps": 4})
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	retryAfter, err := strconv.Atoi(recorder.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	require.Greater(t, retryAfter, 0)
+	require.LessOrEqual(t, retryAfter, 24*60*60+1)
+	var body struct {
+		Error string `json:"error"`
+		Reset int64  `json:"reset"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	require.Equal(t, "daily usage budget of 10 exhausted", body.Error)
+	_, _, dailyReset, _ := usagePeriods("1", time.Now())
+	require.Equal(t, dailyReset.Unix(), body.Reset)
+	require.Equal(t, 8.0, usage())
+}
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"github.com/ulule/limiter/v3"
+	"net/http"
+	"sync"
+)
+
+const (
+	rateLimitGroupSync  = "sync_predict"
+	rateLimitGroupAsync = "async_predict"
+	rateLimitGroupTask  = "task"
+	rateLimitGroupQueue = "queue"
+	rateLimitGroupIP    = "ip"
+)
+
+const (
+	rateLimitRuleKey = "rateLimitRule"
+	rateLimitKeyKey  = "rateLimitKey"
+)
+
+// rateLimitRule is a rate-limit policy with its limiter.
+type rateLimitRule struct {
+	policy  utils.RateLimitPolicy
+	limiter *limiter.Limiter
+}
+
+// specificity ranks the rules matching a request, the most specific one applies.
+func (rule *rateLimitRule) specificity(plan string, model string, group string) int {
+	return policySpecificity(
+		[]string{rule.policy.Plan, rule.policy.Model, rule.policy.Group},
+		[]string{plan, model, group},
+	)
+}
+
+// policySpecificity returns -1 if the patterns of a policy do not match the values,
+// otherwise a score where the first pattern weighs more than all the next ones.
+// An empty pattern or "*" matches anything.
+func policySpecificity(patterns []string, values []string) int {
+	score := 0
+	for i, pattern := range patterns {
+		if pattern == "" || pattern == "*" {
+			continue
+		}
+		if pattern != values[i] {
+			return -1
+		}
+		score += 1 << (len(patterns) - 1 - i)
+	}
+	return score
+}
+
+// key scopes the counter of a user to the rule. A rule matching any model counts
+// the requests of all models together.
+func (rule *rateLimitRule) key(userID string, plan string, model string, group string) string {
+	if rule.policy.Plan == "" || rule.policy.Plan == "*" {
+		plan = "*"
+	}
+	if rule.policy.Model == "" || rule.policy.Model == "*" {
+		model = "*"
+	}
+	return fmt.Sprintf("%s:%s:%s:%s", plan, model, group, userID)
+}
+
+// RateLimiter applies the rate-limit policy of the (plan, model, route group) of a request.
+type RateLimiter struct {
+	rules     []*rateLimitRule
+	store     *utils.FallbackStore
+	plans     *PlanResolver
+	overrides *OverrideStore
+	// The rules of the custom rates of the overrides, by rate
+	mu            sync.Mutex
+	overrideRules map[string]*rateLimitRule
+}
+
+func NewRateLimiter(
+	config utils.Config,
+	client *goredis.Client,
+	health *utils.RedisHealth,
+	plans *PlanResolver,
+	overrides *OverrideStore,
+) (*RateLimiter, error) {
+	// The gateway starts even if Redis is down, the store falls back to the
+	// configured failure mode until Redis is reachable.
+	store := utils.NewFallbackStore(client, health, "rate_limiter",
+		config.RateLimitFailureMode, config.RateLimitReplicas)
+	store.OnModeChange = func(mode string) {
+		for _, m := range []string{utils.RateLimitModeRedis, utils.RateLimitModeMemory,
+			utils.RateLimitModeOpen, utils.RateLimitModeClosed} {
+			value := 0.0
+			if m == mode {
+				value = 1
+			}
+			rateLimiterMode.WithLabelValues(m).Set(value)
+		}
+	}
+
+	// The configured policies take precedence over the default rates of the route groups
+	policies := append([]utils.RateLimitPolicy(nil), config.RateLimits.Policies...)
+	for group, formattedRate := range map[string]string{
+		rateLimitGroupSync:  config.FormattedRateSync,
+		rateLimitGroupAsync: config.FormattedRateAsync,
+		rateLimitGroupTask:  config.FormattedRateTask,
+		rateLimitGroupQueue: config.FormattedRateTask,
+		rateLimitGroupIP:    config.FormattedRateIP,
+	} {
+		if formattedRate != "" {
+			policies = append(policies, utils.RateLimitPolicy{Group: group, Rate: formattedRate})
+		}
+	}
+
+	rules := make([]*rateLimitRule, 0, len(policies))
+	for _, policy := range policies {
+		rate, err := limiter.NewRateFromFormatted(policy.Rate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate of policy %+v: %w", policy, err)
+		}
+		rules = append(rules, &rateLimitRule{
+			policy:  policy,
+			limiter: limiter.New(store, rate),
+		})
+	}
+	store.Start()
+	return &RateLimiter{
+		rules:         rules,
+		store:         store,
+		plans:         plans,
+		overrides:     overrides,
+		overrideRules: make(map[string]*rateLimitRule),
+	}, nil
+}
+
+// overrideRule returns the rule of the custom rate of a user, the rate is validated by the admin API.
+func (rateLimiter *RateLimiter) overrideRule(formattedRate string) *rateLimitRule {
+	rateLimiter.mu.Lock()
+	defer rateLimiter.mu.Unlock()
+	if rule, ok := rateLimiter.overrideRules[formattedRate]; ok {
+		return rule
+	}
+	rate, err := limiter.NewRateFromFormatted(formattedRate)
+	if err != nil {
+		log.Error().Err(err).Str("rate", formattedRate).Msg("invalid rate of an override")
+		return nil
+	}
+	rule := &rateLimitRule{
+		policy:  utils.RateLimitPolicy{Plan: "override", Rate: formattedRate},
+		limiter: limiter.New(rateLimiter.store, rate),
+	}
+	rateLimiter.overrideRules[formattedRate] = rule
+	return rule
+}
+
+func (rateLimiter *RateLimiter) match(plan string, model string, group string) *rateLimitRule {
+	var best *rateLimitRule
+	bestScore := -1
+	for _, rule := range rateLimiter.rules {
+		if score := rule.specificity(plan, model, group); score > bestScore {
+			best, bestScore = rule, score
+		}
+	}
+	return best
+}
+
+// Middleware limits the requests of a route group by user.
+func (rateLimiter *RateLimiter) Middleware(group string) gin.HandlerFunc {
+	middleware := &utils.Middleware{
+		LimiterGetter: func(ctx *gin.Context) *limiter.Limiter {
+			return ctx.MustGet(rateLimitRuleKey).(*rateLimitRule).limiter
+		},
+		OnError:        onRateLimitError,
+		OnLimitReached: onRateLimitReached,
+		KeyGetter: func(ctx *gin.Context) string {
+			return ctx.GetString(rateLimitKeyKey)
+		},
+	}
+	return func(ctx *gin.Context) {
+		userID := ctx.Request.Header.Get("UID")
+		// The allowlisted users are exempt from the rate limits
+		if rateLimiter.overrides.Allowlisted(userID) {
+			ctx.Next()
+			return
+		}
+		if override, ok := rateLimiter.overrides.Get(userID); ok && override.Rate != "" {
+			if rule := rateLimiter.overrideRule(override.Rate); rule != nil {
+				ctx.Set(rateLimitRuleKey, rule)
+				ctx.Set(rateLimitKeyKey, fmt.Sprintf("override:%s:%s:%s", override.Rate, group, userID))
+				middleware.Handle(ctx)
+				return
+			}
+		}
+		plan := rateLimiter.plans.Plan(ctx.Request.Context(), userID)
+		model := requestModelName(ctx)
+		rule := rateLimiter.match(plan, model, group)
+		if rule == nil {
+			ctx.Next()
+			return
+		}
+		ctx.Set(rateLimitRuleKey, rule)
+		ctx.Set(rateLimitKeyKey, rule.key(userID, plan, model, group))
+		middleware.Handle(ctx)
+	}
+}
+
+// IPMiddleware limits the requests of the unauthenticated routes by client IP.
+func (rateLimiter *RateLimiter) IPMiddleware() gin.HandlerFunc {
+	middleware := &utils.Middleware{
+		LimiterGetter: func(ctx *gin.Context) *limiter.Limiter {
+			return ctx.MustGet(rateLimitRuleKey).(*rateLimitRule).limiter
+		},
+		OnError:        onRateLimitError,
+		OnLimitReached: onRateLimitReached,
+		KeyGetter: func(ctx *gin.Context) string {
+			return ctx.GetString(rateLimitKeyKey)
+		},
+	}
+	return func(ctx *gin.Context) {
+		rule := rateLimiter.match("", "", rateLimitGroupIP)
+		if rule == nil {
+			ctx.Next()
+			return
+		}
+		ctx.Set(rateLimitRuleKey, rule)
+		ctx.Set(rateLimitKeyKey, rule.key(ctx.ClientIP(), "", "", rateLimitGroupIP))
+		middleware.Handle(ctx)
+	}
+}
+
+func onRateLimitError(ctx *gin.Context, err error) {
+	if errors.Is(err, utils.ErrRateLimiterUnavailable) {
+		ctx.JSON(http.StatusServiceUnavailable, errorResponse(err))
+		return
+	}
+	requestLogger(ctx.Request.Context()).Error().Err(err).Msg("failed to apply the rate limit")
+	ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+}
+
+func onRateLimitReached(ctx *gin.Context) {
+	policy := ctx.MustGet(rateLimitRuleKey).(*rateLimitRule).policy
+	ctx.JSON(http.StatusTooManyRequests, gin.H{
+		"error": fmt.Sprintf("rate limit of %s exceeded", policy.Rate),
+		"policy": gin.H{
+			"plan":  wildcard(policy.Plan),
+			"model": wildcard(policy.Model),
+			"group": wildcard(policy.Group),
+			"rate":  policy.Rate,
+		},
+	})
+}
+
+func wildcard(pattern string) string {
+	if pattern == "" {
+		return "*"
+	}
+	return pattern
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPolicySpecificity(t *testing.T) {
+	values := []string{"pro", "sdxl", rateLimitGroupSync}
+	testCases := []struct {
+		name     string
+		patterns []string
+		expected int
+	}{
+		{name: "Any", patterns: []string{"", "*", ""}, expected: 0},
+		{name: "Group", patterns: []string{"", "", rateLimitGroupSync}, expected: 1},
+		{name: "Model", patterns: []string{"*", "sdxl", "*"}, expected: 2},
+		{name: "ModelGroup", patterns: []string{"", "sdxl", rateLimitGroupSync}, expected: 3},
+		{name: "Plan", patterns: []string{"pro", "", ""}, expected: 4},
+		{name: "All", patterns: []string{"pro", "sdxl", rateLimitGroupSync}, expected: 7},
+		{name: "OtherPlan", patterns: []string{"free", "", ""}, expected: -1},
+		{name: "OtherGroup", patterns: []string{"pro", "sdxl", rateLimitGroupTask}, expected: -1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, policySpecificity(tc.patterns, values))
+		})
+	}
+}
+
+func newTestRateLimiter(t *testing.T, config utils.Config) *RateLimiter {
+	// Redis is unreachable, the counters fall back to memory
+	client := utils.NewRedisClient("127.0.0.1:1")
+	health := utils.NewRedisHealth(client)
+	health.Start(time.Hour)
+	t.Cleanup(health.Stop)
+	rateLimiter, err := NewRateLimiter(config, client, health, NewPlanResolver(config.RateLimits, nil, nil),
+		NewOverrideStore(nil, 0))
+	require.NoError(t, err)
+	return rateLimiter
+}
+
+func TestRateLimiterMatch(t *testing.T) {
+	rateLimiter := newTestRateLimiter(t, utils.Config{
+		FormattedRateSync: "100-M",
+		RateLimits: utils.RateLimitConfig{Policies: []utils.RateLimitPolicy{
+			{Plan: "pro", Rate: "1000-M"},
+			{Plan: "pro", Model: "sdxl", Group: rateLimitGroupSync, Rate: "10-M"},
+			{Model: "sdxl", Rate: "50-M"},
+		}},
+	})
+
+	testCases := []struct {
+		name     string
+		userID   string
+		plan     string
+		model    string
+		group    string
+		rate     string
+		expected string
+	}{
+		{name: "Default", userID: "1", plan: "free", model: "other", group: rateLimitGroupSync,
+			rate: "100-M", expected: "*:*:sync_predict:1"},
+		{name: "Model", userID: "1", plan: "free", model: "sdxl", group: rateLimitGroupSync,
+			rate: "50-M", expected: "*:sdxl:sync_predict:1"},
+		{name: "Plan", userID: "2", plan: "pro", model: "other", group: rateLimitGroupAsync,
+			rate: "1000-M", expected: "pro:*:async_predict:2"},
+		{name: "MostSpecific", userID: "2", plan: "pro", model: "sdxl", group: rateLimitGroupSync,
+			rate: "10-M", expected: "pro:sdxl:sync_predict:2"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := rateLimiter.match(tc.plan, tc.model, tc.group)
+			require.NotNil(t, rule)
+			require.Equal(t, tc.rate, rule.policy.Rate)
+			require.Equal(t, tc.expected, rule.key(tc.userID, tc.plan, tc.model, tc.group))
+		})
+	}
+	require.Nil(t, rateLimiter.match("free", "other", rateLimitGroupTask))
+}
+
+func TestRateLimitReached(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"outputs": "test"}`))
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress: upstream.URL,
+		RedisAddress:        "127.0.0.1:1",
+		RateLimits: utils.RateLimitConfig{Policies: []utils.RateLimitPolicy{
+			{Model: "test", Group: rateLimitGroupSync, Rate: "2-M"},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, server.Close(context.Background()))
+	}()
+
+	predict := func(userID string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(http.MethodPost, "/v1/predict",
+			bytes.NewReader([]byte(`{"model_name": "test", "inputs": {"prompt": "a cat"}}`)))
+		require.NoError(t, err)
+		request.Header.Set("UID", userID)
+		server.router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	for remaining := 1; remaining >= 0; remaining-- {
+		recorder := predict("1")
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, "2", recorder.Header().Get("X-RateLimit-Limit"))
+		require.Equal(t, strconv.Itoa(remaining), recorder.Header().Get("X-RateLimit-Remaining"))
+	}
+	recorder := predict("1")
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	require.Equal(t, "0", recorder.Header().Get("X-RateLimit-Remaining"))
+	require.NotEmpty(t, recorder.Header().Get("X-RateLimit-Reset"))
+	require.JSONEq(t, `{
+		"error": "rate limit of 2-M exceeded",
+		"policy": {"plan": "*", "model": "test", "group": "sync_predict", "rate": "2-M"}
+	}`, recorder.Body.String())
+
+	// The counters are per user
+	require.Equal(t, http.StatusOK, predict("2").Code)
+
+	// The allowlisted users are not limited, even with a colon in their ID
+	// Redis is unreachable, set the override in memory
+	server.overrides.mu.Lock()
+	server.overrides.overrides["a:3"] = UserOverride{UserID: "a:3", Allowlisted: true}
+	server.overrides.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		recorder := predict("a:3")
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Empty(t, recorder.Header().Get("X-RateLimit-Limit"))
+	}
+}
+
+func TestPlanResolver(t *testing.T) {
+	config := utils.RateLimitConfig{
+		Users:       map[string]string{"1": "pro"},
+		DefaultPlan: "free",
+	}
+	resolver := NewPlanResolver(config, nil, nil)
+	require.Equal(t, "pro", resolver.Plan(context.Background(), "1"))
+	require.Equal(t, "free", resolver.Plan(context.Background(), "2"))
+
+	// Without a default plan, the users are on the default plan
+	resolver = NewPlanResolver(utils.RateLimitConfig{}, nil, nil)
+	require.Equal(t, defaultPlan, resolver.Plan(context.Background(), "2"))
+
+	// The users of the config do not need Redis, the others fall back while Redis is down
+	config.RedisLookup = true
+	client := utils.NewRedisClient("127.0.0.1:1")
+	health := utils.NewRedisHealth(client)
+	resolver = NewPlanResolver(config, client, health)
+	require.Equal(t, "pro", resolver.Plan(context.Background(), "1"))
+	require.Equal(t, "free", resolver.Plan(context.Background(), "2"))
+}
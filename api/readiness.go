@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultReadinessTimeout  = 2 * time.Second
+	defaultReadinessCacheTTL = 5 * time.Second
+)
+
+// ReadinessCheck probes a dependency, it returns an error if the dependency is unavailable.
+type ReadinessCheck func(ctx context.Context) error
+
+// CheckResult is the outcome of one readiness check. A failed optional check is degraded.
+type CheckResult struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// ReadinessReport is the response of /ready.
+type ReadinessReport struct {
+	Ready    bool                   `json:"ready"`
+	Draining bool                   `json:"draining,omitempty"`
+	Degraded bool                   `json:"degraded,omitempty"`
+	Checks   map[string]CheckResult `json:"checks"`
+}
+
+type namedCheck struct {
+	name     string
+	check    ReadinessCheck
+	optional bool
+}
+
+// Readiness runs the registered dependency checks concurrently, each with a timeout.
+// The report is cached so that frequent probes don't load the dependencies.
+type Readiness struct {
+	timeout  time.Duration
+	cacheTTL time.Duration
+	checks   []namedCheck
+	draining atomic.Bool
+
+	mu        sync.Mutex
+	report    ReadinessReport
+	checkedAt time.Time
+}
+
+func NewReadiness(timeout time.Duration, cacheTTL time.Duration) *Readiness {
+	if timeout <= 0 {
+		timeout = defaultReadinessTimeout
+	}
+	if cacheTTL <= 0 {
+		cacheTTL = defaultReadinessCacheTTL
+	}
+	return &Readiness{timeout: timeout, cacheTTL: cacheTTL}
+}
+
+// Register adds a check, it must be called before the server starts.
+func (readiness *Readiness) Register(name string, check ReadinessCheck) {
+	readiness.checks = append(readiness.checks, namedCheck{name: name, check: check})
+}
+
+// RegisterOptional adds a check of a dependency the server can run without, its failure
+// degrades the report without making the server not ready.
+func (readiness *Readiness) RegisterOptional(name string, check ReadinessCheck) {
+	readiness.checks = append(readiness.checks, namedCheck{name: name, check: check, optional: true})
+}
+
+// SetDraining marks the server as shutting down, after which it always reports not ready.
+func (readiness *Readiness) SetDraining(draining bool) {
+	readiness.draining.Store(draining)
+}
+
+// Check returns the cached report, or runs the checks if it has expired.
+func (readiness *Readiness) Check(ctx context.Context) ReadinessReport {
+	if readiness.draining.Load() {
+		return ReadinessReport{Ready: false, Draining: true, Checks: map[string]CheckResult{}}
+	}
+	readiness.mu.Lock()
+	defer readiness.mu.Unlock()
+	if !readiness.checkedAt.IsZero() && time.Since(readiness.checkedAt) < readiness.cacheTTL {
+		return readiness.report
+	}
+
+	// The report is shared by the probes, so it does not depend on the one which runs the checks
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readiness.timeout)
+	defer cancel()
+	results := make([]CheckResult, len(readiness.checks))
+	var wg sync.WaitGroup
+	for i, check := range readiness.checks {
+		wg.Add(1)
+		go func(i int, check ReadinessCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := check(ctx)
+			results[i] = CheckResult{Status: "ok", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				results[i].Status = "error"
+				results[i].Error = err.Error()
+			}
+		}(i, check.check)
+	}
+	wg.Wait()
+
+	report := ReadinessReport{Ready: true, Checks: make(map[string]CheckResult, len(results))}
+	for i, check := range readiness.checks {
+		if results[i].Status == "ok" {
+			report.Checks[check.name] = results[i]
+			continue
+		}
+		if check.optional {
+			results[i].Status = "degraded"
+			report.Degraded = true
+		} else {
+			report.Ready = false
+		}
+		report.Checks[check.name] = results[i]
+	}
+	readiness.report, readiness.checkedAt = report, time.Now()
+	return report
+}
+
+// registerReadinessChecks registers the checks of the dependencies the server is configured with.
+func (server *Server) registerReadinessChecks() {
+	// The features backed by Redis fall back while it is down, so that it does not fail
+	// every pod at once
+	if server.redis != nil {
+		server.readiness.RegisterOptional("redis", func(ctx context.Context) error {
+			return server.redis.Ping(ctx).Err()
+		})
+	}
+	if pinger, ok := server.webhook.(interface{ Ping(context.Context) error }); ok {
+		server.readiness.Register("webhook", pinger.Ping)
+	}
+	if server.config.ReadinessCheckAgents {
+		for modelName, pool := range server.pools {
+			if pool.config.HealthCheck.Path != "" {
+				server.readiness.Register("agent:"+modelName, pool.healthy)
+			}
+		}
+	}
+}
+
+// Ping checks that the webhook server accepts connections.
+func (webhook *InternalWebhook) Ping(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", webhook.config.WebhookServerAddress)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// healthy checks that an endpoint of the pool is neither unhealthy nor ejected. It reads the
+// state kept by the health checks and the passive ejection, so that a single bad replica
+// does not fail the readiness of the gateway.
+func (pool *EndpointPool) healthy(ctx context.Context) error {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	now := time.Now()
+	for _, endpoint := range pool.endpoints {
+		if !endpoint.unhealthy && now.After(endpoint.ejectedUntil) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no healthy serving agent endpoint for model %s", pool.model)
+}
+
+// checkReadiness responds 200 when every required dependency check passes, and 503 otherwise.
+func (server *Server) checkReadiness(ctx *gin.Context) {
+	report := server.readiness.Check(ctx.Request.Context())
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	ctx.JSON(status, report)
+}
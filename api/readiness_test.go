@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	var calls int32
+	var failing atomic.Bool
+	readiness := NewReadiness(50*time.Millisecond, time.Hour)
+	readiness.Register("ok", func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	readiness.Register("flaky", func(ctx context.Context) error {
+		if failing.Load() {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	readiness.RegisterOptional("optional", func(ctx context.Context) error {
+		if failing.Load() {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	readiness.Register("slow", func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+			return nil
+		}
+	})
+
+	report := readiness.Check(context.Background())
+	require.True(t, report.Ready)
+	require.False(t, report.Degraded)
+	require.Len(t, report.Checks, 4)
+	require.Equal(t, "ok", report.Checks["slow"].Status)
+
+	// The report is cached
+	failing.Store(true)
+	require.True(t, readiness.Check(context.Background()).Ready)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	readiness.cacheTTL = 0
+	report = readiness.Check(context.Background())
+	require.False(t, report.Ready)
+	require.Equal(t, "error", report.Checks["flaky"].Status)
+	require.Equal(t, "unavailable", report.Checks["flaky"].Error)
+	require.Equal(t, "ok", report.Checks["ok"].Status)
+	require.True(t, report.Degraded)
+	require.Equal(t, "degraded", report.Checks["optional"].Status)
+	require.Equal(t, "unavailable", report.Checks["optional"].Error)
+
+	readiness.SetDraining(true)
+	failing.Store(false)
+	report = readiness.Check(context.Background())
+	require.False(t, report.Ready)
+	require.True(t, report.Draining)
+}
+
+func TestReadyEndpoint(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+
+	// Redis is unreachable, which degrades the report without failing it
+	config := utils.Config{WebhookServerAddress: address, RedisAddress: "127.0.0.1:1"}
+	server, err := NewServer(config, NewInternalWebhook(config))
+	require.NoError(t, err)
+	require.Equal(t, defaultReadinessCacheTTL, server.readiness.cacheTTL)
+	server.readiness.cacheTTL = 0
+	defer func() {
+		require.NoError(t, server.Close(context.Background()))
+	}()
+
+	get := func(path string) (int, ReadinessReport) {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(http.MethodGet, path, nil)
+		require.NoError(t, err)
+		server.router.ServeHTTP(recorder, request)
+		var report ReadinessReport
+		if path == "/ready" {
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+		}
+		return recorder.Code, report
+	}
+
+	code, report := get("/ready")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok", report.Checks["webhook"].Status)
+	require.True(t, report.Degraded)
+	require.Equal(t, "degraded", report.Checks["redis"].Status)
+
+	// Only readiness depends on the webhook
+	require.NoError(t, listener.Close())
+	code, report = get("/ready")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "error", report.Checks["webhook"].Status)
+	code, _ = get("/live")
+	require.Equal(t, http.StatusOK, code)
+}
+
+func TestEndpointPoolHealthy(t *testing.T) {
+	pool := NewEndpointPool("test", utils.ModelConfig{Endpoints: []string{"http://a", "http://b"}})
+	require.NoError(t, pool.healthy(context.Background()))
+
+	// One healthy endpoint keeps the gateway ready
+	pool.endpoints[0].unhealthy = true
+	require.NoError(t, pool.healthy(context.Background()))
+	pool.endpoints[1].ejectedUntil = time.Now().Add(time.Minute)
+	require.ErrorContains(t, pool.healthy(context.Background()), "no healthy serving agent endpoint")
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy retries idempotent upstream calls that failed with a connect error
+// or a 502/503/504, using exponential backoff with full jitter. Retries are drawn
+// from a shared budget so that an upstream outage cannot be amplified.
+type RetryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	budget         *retryBudget
+}
+
+func NewRetryPolicy(config utils.Config) *RetryPolicy {
+	return &RetryPolicy{
+		maxAttempts:    config.RetryMaxAttempts,
+		initialBackoff: config.RetryInitialBackoff,
+		maxBackoff:     config.RetryMaxBackoff,
+		budget:         newRetryBudget(config.RetryBudgetRatio, config.RetryBudgetMinRetry),
+	}
+}
+
+// Do sends the request built by newRequest, retrying it when allowed.
+// The target is a low-cardinality name of the upstream call used in logs and metrics.
+func (policy *RetryPolicy) Do(
+	ctx context.Context,
+	client *http.Client,
+	target string,
+	newRequest func() (*http.Request, error),
+) (*http.Response, error) {
+	maxAttempts := 1
+	if policy != nil && policy.maxAttempts > 1 {
+		maxAttempts = policy.maxAttempts
+	}
+	if policy != nil {
+		policy.budget.deposit()
+	}
+
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		res, err := client.Do(req)
+		reason, retryable := retryReason(res, err)
+		upstreamAttempts.WithLabelValues(target, reason).Inc()
+		logger := requestLogger(ctx).With().Str("target", target).Int("attempt", attempt).
+			Int("max_attempts", maxAttempts).Str("result", reason).Logger()
+		logger.Debug().Msg("upstream call attempted")
+		if !retryable {
+			if attempt > 1 {
+				logger.Info().Msg("upstream call succeeded after retrying")
+			}
+			return res, err
+		}
+		if attempt >= maxAttempts {
+			logger.Warn().Msg("upstream call failed, giving up")
+			return res, err
+		}
+		if !policy.budget.withdraw() {
+			logger.Warn().Msg("upstream call failed, retry budget exhausted")
+			upstreamRetries.WithLabelValues(target, "budget_exhausted").Inc()
+			return res, err
+		}
+
+		backoff := policy.backoff(attempt)
+		logger.Warn().Dur("backoff", backoff).Msg("upstream call failed, retrying")
+		upstreamRetries.WithLabelValues(target, reason).Inc()
+		if res != nil {
+			// Drain the body so that the connection can be reused
+			_, _ = io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("retry of %s cancelled: %w", target, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns a random duration in [0, min(maxBackoff, initialBackoff * 2^(attempt-1))].
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := policy.initialBackoff << (attempt - 1)
+	if ceiling <= 0 || (policy.maxBackoff > 0 && ceiling > policy.maxBackoff) {
+		ceiling = policy.maxBackoff
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// retryReason classifies the result of an attempt for logs and metrics,
+// and reports whether the attempt can be retried.
+func retryReason(res *http.Response, err error) (string, bool) {
+	if err != nil {
+		if isConnectError(err) {
+			return "connect_error", true
+		}
+		return "error", false
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return strconv.Itoa(res.StatusCode), true
+	}
+	return strconv.Itoa(res.StatusCode), false
+}
+
+// isConnectError reports whether the request never reached the upstream,
+// in which case it is safe to send it again.
+func isConnectError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryBudget is a token bucket shared by all calls of a RetryPolicy. Every call
+// deposits `ratio` tokens and every retry withdraws one, so in the long run
+// retries are capped at `ratio` times the request rate, with bursts of up to
+// `minRetry` retries.
+type retryBudget struct {
+	mu       sync.Mutex
+	ratio    float64
+	capacity float64
+	tokens   float64
+}
+
+func newRetryBudget(ratio float64, minRetry int) *retryBudget {
+	return &retryBudget{
+		ratio:    ratio,
+		capacity: float64(minRetry),
+		tokens:   float64(minRetry),
+	}
+}
+
+func (budget *retryBudget) deposit() {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	budget.tokens += budget.ratio
+	if budget.tokens > budget.capacity {
+		budget.tokens = budget.capacity
+	}
+}
+
+func (budget *retryBudget) withdraw() bool {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	if budget.tokens < 1 {
+		return false
+	}
+	budget.tokens -= 1
+	return true
+}
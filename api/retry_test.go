@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	testCases := []struct {
+		name          string
+		statuses      []int
+		minRetry      int
+		checkResponse func(res *http.Response, err error, calls int32)
+	}{
+		{
+			name:     "RetryUntilOK",
+			statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK},
+			minRetry: 10,
+			checkResponse: func(res *http.Response, err error, calls int32) {
+				require.NoError(t, err)
+				require.Equal(t, http.StatusOK, res.StatusCode)
+				require.Equal(t, int32(3), calls)
+			},
+		},
+		{
+			name:     "GiveUpAfterMaxAttempts",
+			statuses: []int{http.StatusGatewayTimeout},
+			minRetry: 10,
+			checkResponse: func(res *http.Response, err error, calls int32) {
+				require.NoError(t, err)
+				require.Equal(t, http.StatusGatewayTimeout, res.StatusCode)
+				require.Equal(t, int32(3), calls)
+			},
+		},
+		{
+			name:     "NoRetryOnServerError",
+			statuses: []int{http.StatusInternalServerError},
+			minRetry: 10,
+			checkResponse: func(res *http.Response, err error, calls int32) {
+				require.NoError(t, err)
+				require.Equal(t, http.StatusInternalServerError, res.StatusCode)
+				require.Equal(t, int32(1), calls)
+			},
+		},
+		{
+			name:     "BudgetExhausted",
+			statuses: []int{http.StatusServiceUnavailable},
+			minRetry: 0,
+			checkResponse: func(res *http.Response, err error, calls int32) {
+				require.NoError(t, err)
+				require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+				require.Equal(t, int32(1), calls)
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&calls, 1)
+				index := int(n) - 1
+				if index >= len(tc.statuses) {
+					index = len(tc.statuses) - 1
+				}
+				w.WriteHeader(tc.statuses[index])
+			}))
+			defer upstream.Close()
+
+			policy := NewRetryPolicy(utils.Config{
+				RetryMaxAttempts:    3,
+				RetryInitialBackoff: time.Millisecond,
+				RetryMaxBackoff:     5 * time.Millisecond,
+				RetryBudgetMinRetry: tc.minRetry,
+			})
+			res, err := policy.Do(context.Background(), upstream.Client(), "test",
+				func() (*http.Request, error) {
+					return http.NewRequest(http.MethodGet, upstream.URL, nil)
+				})
+			if res != nil {
+				defer res.Body.Close()
+			}
+			tc.checkResponse(res, err, atomic.LoadInt32(&calls))
+		})
+	}
+}
+
+func TestRetryPolicyConnectError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	address := upstream.URL
+	upstream.Close()
+
+	policy := NewRetryPolicy(utils.Config{
+		RetryMaxAttempts:    2,
+		RetryInitialBackoff: time.Millisecond,
+		RetryBudgetMinRetry: 10,
+	})
+	var attempts int
+	_, err := policy.Do(context.Background(), http.DefaultClient, "test",
+		func() (*http.Request, error) {
+			attempts++
+			return http.NewRequest(http.MethodGet, address, nil)
+		})
+	require.Error(t, err)
+	require.True(t, isConnectError(err))
+	require.Equal(t, 2, attempts)
+}
+
+func TestRetryPicksAnotherEndpoint(t *testing.T) {
+	var downCalls, upCalls int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downCalls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"queue_size": 0}`))
+	}))
+	defer up.Close()
+
+	// The first pick is random, the calls are repeated until one hits the failing endpoint
+	for i := 0; atomic.LoadInt32(&downCalls) == 0 && i < 50; i++ {
+		server, err := NewServer(utils.Config{
+			RetryMaxAttempts:    2,
+			RetryInitialBackoff: time.Millisecond,
+			RetryBudgetMinRetry: 10,
+			Models: map[string]utils.ModelConfig{"test": {
+				Endpoints: []string{down.URL, up.URL},
+				// The failed endpoint is ejected, so that the retry picks the other one
+				HealthCheck: utils.HealthCheckConfig{FailureThreshold: 1, EjectionDuration: time.Minute},
+			}},
+		}, nil)
+		require.NoError(t, err)
+		statusCode, outputs, err := server.forwardToServingAgent(context.Background(), "1", http.MethodGet,
+			"v1/queue_size", "test", nil, "", true)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, statusCode)
+		require.Equal(t, 0.0, outputs["queue_size"])
+		require.NoError(t, server.Close(context.Background()))
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&downCalls))
+	require.Positive(t, atomic.LoadInt32(&upCalls))
+}
@@ -1,69 +1,254 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/HyperGAI/serving-api/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	goredis "github.com/redis/go-redis/v9"
 	"net/http"
+	"time"
 )
 
 type Server struct {
-	config  utils.Config
-	webhook Webhook
-	router  *gin.Engine
+	config      utils.Config
+	webhook     Webhook
+	router      *gin.Engine
+	retryPolicy *RetryPolicy
+	pools       map[string]*EndpointPool
+	admission   map[string]*admissionQueue
+	transforms  map[string]*Transform
+	coalescer   *Coalescer
+	cache       ResponseCache
+	rateLimiter *RateLimiter
+	plans       *PlanResolver
+	concurrency *ConcurrencyLimiter
+	quotas      *QuotaManager
+	credits     *CreditManager
+	overrides   *OverrideStore
+	ipAccess    *IPAccessControl
+	usage       utils.EventSink
+	blobs       utils.BlobStore
+	blobSigner  *utils.BlobSigner
+	blobGC      *utils.BlobCollector
+	moderation  *ModerationChain
+	audit       *AuditLog
+	readiness   *Readiness
+	streams     *streamTracker
+	redis       *goredis.Client
+	redisHealth *utils.RedisHealth
 }
 
 func NewServer(
 	config utils.Config,
 	webhook Webhook,
 ) (*Server, error) {
+	initMetrics(config.MetricsLatencyBuckets)
 	server := Server{
-		config:  config,
-		webhook: webhook,
+		config:      config,
+		webhook:     webhook,
+		retryPolicy: NewRetryPolicy(config),
+		pools:       make(map[string]*EndpointPool),
+		admission:   make(map[string]*admissionQueue),
+		transforms:  make(map[string]*Transform),
+		coalescer:   NewCoalescer(),
+		readiness:   NewReadiness(config.ReadinessTimeout, config.ReadinessCacheTTL),
+		streams:     newStreamTracker(),
 	}
-	server.setupRouter()
+	if internal, ok := webhook.(*InternalWebhook); ok {
+		internal.retryPolicy = server.retryPolicy
+	}
+	for modelName, model := range config.Models {
+		transform, err := NewTransform(model.Transform)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transforms of model %s: %w", modelName, err)
+		}
+		if err := validateCost(model.Cost, transform); err != nil {
+			return nil, fmt.Errorf("invalid cost of model %s: %w", modelName, err)
+		}
+		if transform != nil {
+			server.transforms[modelName] = transform
+		}
+	}
+	if err := server.setupBlobs(); err != nil {
+		return nil, err
+	}
+	moderation, err := NewModerationChain(config)
+	if err != nil {
+		return nil, err
+	}
+	server.moderation = moderation
+	for modelName, model := range config.Models {
+		if len(model.Endpoints) > 0 || model.Discovery.Host != "" {
+			pool := NewEndpointPool(modelName, model)
+			pool.Start()
+			server.pools[modelName] = pool
+		}
+		if model.Admission.MaxQueueSize > 0 {
+			server.admission[modelName] = newAdmissionQueue(modelName, model.Admission)
+		}
+	}
+	server.startQueueSampling()
+
+	if config.RedisAddress != "" {
+		// Commands fail while Redis is down, so each feature handles its unavailability.
+		// The features skip Redis while the shared health check finds it unavailable.
+		server.redis = utils.NewRedisClient(config.RedisAddress)
+		server.redisHealth = utils.NewRedisHealth(server.redis)
+		interval := config.RateLimitCheckInterval
+		if interval <= 0 {
+			interval = 5 * time.Second
+		}
+		server.redisHealth.Start(interval)
+	}
+	cache, err := NewResponseCache(config, server.redis, server.redisHealth)
+	if err != nil {
+		return nil, err
+	}
+	server.cache = cache
+	server.plans = NewPlanResolver(config.RateLimits, server.redis, server.redisHealth)
+	server.overrides = NewOverrideStore(server.redis, config.OverridePollInterval)
+	server.overrides.Start()
+	server.concurrency = NewConcurrencyLimiter(config.RateLimits.Concurrency, server.redis,
+		server.redisHealth, server.plans, server.overrides)
+	server.quotas = NewQuotaManager(config, server.redis, server.redisHealth, server.plans, server.transforms)
+	// Credits never fall back to memory while Redis is down, reservations fail instead
+	if len(config.CreditPlans) > 0 && server.redis == nil {
+		return nil, errors.New("credit plans require REDIS_ADDRESS")
+	}
+	ledger := NewMemoryLedger()
+	if server.redis != nil {
+		ledger = NewRedisLedger(server.redis, server.redisHealth)
+	}
+	server.credits = NewCreditManager(config, ledger, server.plans, server.transforms)
+	if config.UsageSink != "" {
+		server.usage, err = utils.NewEventSink(config.UsageSink, utils.SinkOptions{
+			Dir:           config.UsageDir,
+			Prefix:        "usage",
+			MaxSize:       config.UsageMaxFileSize,
+			URL:           config.UsageHTTPURL,
+			SpoolDir:      config.UsageSpoolDir,
+			FlushInterval: config.UsageFlushInterval,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	server.audit, err = NewAuditLog(config)
+	if err != nil {
+		return nil, err
+	}
+	if server.redis != nil {
+		server.rateLimiter, err = NewRateLimiter(config, server.redis, server.redisHealth, server.plans,
+			server.overrides)
+		if err != nil {
+			return nil, err
+		}
+	}
+	server.ipAccess, err = NewIPAccessControl(config.IPAccessConfigFile, config.GeoIPDatabase,
+		config.IPAccessReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	server.ipAccess.Start()
+	clientIPs, err := utils.NewClientIPResolver(config.TrustedProxies, config.TrustedProxyHops,
+		config.ClientIPHeaders)
+	if err != nil {
+		return nil, err
+	}
+	server.registerReadinessChecks()
+	server.setupRouter(clientIPs)
 	return &server, nil
 }
 
-func (server *Server) setupRouter() {
+func (server *Server) setupRouter(clientIPs *utils.ClientIPResolver) {
 	router := gin.Default()
-
+	// ClientIP returns the IP resolved by setTrueClientIP, or the remote address
+	router.TrustedPlatform = trueClientIPHeader
+	_ = router.SetTrustedProxies(nil)
+	router.Use(assignRequestID())
+	router.Use(limitRequestBody(server.config.MaxRequestBodySize))
+	router.Use(setTrueClientIP(clientIPs))
+	// The probes and the metrics are registered first, so that the IP access rules do not apply to them
 	router.GET("/live", server.checkHealth)
-	router.GET("/ready", server.checkHealth)
+	router.GET("/ready", server.checkReadiness)
 	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
-	router.POST("/pause/:model", server.pauseTaskQueue)
-	router.POST("/unpause/:model", server.unpauseTaskQueue)
+	router.Use(server.ipAccess.Middleware())
+
+	router.POST("/pause/:model", server.rateLimitIP(), server.pauseTaskQueue)
+	router.POST("/unpause/:model", server.rateLimitIP(), server.unpauseTaskQueue)
+	// The signature of the URL authenticates the downloads of the blobs
+	router.GET("/blobs/*key", server.rateLimitIP(), server.downloadBlob)
 
 	syncRoutes := router.Group("/v1")
 	syncRoutes.Use(traceRequest())
-	syncRoutes.Use(authenticateRequest())
-	syncRoutes.Use(rateLimitByUser(server.config, server.config.FormattedRateSync, "sync_predict"))
-	syncRoutes.Use(prometheusMiddleware())
-	syncRoutes.POST("/predict", server.predict)
-	syncRoutes.POST("/generate", server.generate)
+	syncRoutes.Use(authenticateRequest(server.audit))
+	syncRoutes.Use(server.meterUsage())
+	syncRoutes.Use(server.overrides.Middleware())
+	syncRoutes.Use(server.ipAccess.ModelMiddleware())
+	syncRoutes.Use(server.rateLimit(rateLimitGroupSync))
+	syncRoutes.Use(server.concurrency.Middleware(rateLimitGroupSync))
+	syncRoutes.Use(server.prometheusMiddleware())
+	syncRoutes.POST("/predict", server.quotas.Middleware(), server.credits.Middleware(), server.predict)
+	syncRoutes.POST("/generate", server.quotas.Middleware(), server.credits.Middleware(), server.generate)
 
 	asyncRoutes := router.Group("/async/v1")
 	asyncRoutes.Use(traceRequest())
-	asyncRoutes.Use(authenticateRequest())
-	asyncRoutes.Use(rateLimitByUser(server.config, server.config.FormattedRateAsync, "async_predict"))
-	asyncRoutes.Use(prometheusMiddleware())
-	asyncRoutes.POST("/predict", server.asyncPredict)
+	asyncRoutes.Use(authenticateRequest(server.audit))
+	asyncRoutes.Use(server.meterUsage())
+	asyncRoutes.Use(server.overrides.Middleware())
+	asyncRoutes.Use(server.ipAccess.ModelMiddleware())
+	asyncRoutes.Use(server.rateLimit(rateLimitGroupAsync))
+	asyncRoutes.Use(server.concurrency.Middleware(rateLimitGroupAsync))
+	asyncRoutes.Use(server.prometheusMiddleware())
+	asyncRoutes.POST("/predict", server.quotas.Middleware(), server.credits.Middleware(), server.asyncPredict)
 
 	taskRoutes := router.Group("/task")
 	taskRoutes.Use(traceRequest())
-	taskRoutes.Use(authenticateRequest())
-	taskRoutes.Use(rateLimitByUser(server.config, server.config.FormattedRateTask, "task"))
-	taskRoutes.Use(prometheusMiddleware())
+	taskRoutes.Use(authenticateRequest(server.audit))
+	taskRoutes.Use(server.meterUsage())
+	taskRoutes.Use(server.overrides.Middleware())
+	taskRoutes.Use(server.rateLimit(rateLimitGroupTask))
+	taskRoutes.Use(server.concurrency.Middleware(rateLimitGroupTask))
+	taskRoutes.Use(server.prometheusMiddleware())
 	taskRoutes.GET("/:id", server.getTask)
 	taskRoutes.POST("/batch", server.getTasks)
 
 	queueRoutes := router.Group("/queue_size")
 	queueRoutes.Use(traceRequest())
-	queueRoutes.Use(authenticateRequest())
-	queueRoutes.Use(rateLimitByUser(server.config, server.config.FormattedRateTask, "queue"))
-	queueRoutes.Use(prometheusMiddleware())
+	queueRoutes.Use(authenticateRequest(server.audit))
+	queueRoutes.Use(server.meterUsage())
+	queueRoutes.Use(server.overrides.Middleware())
+	queueRoutes.Use(server.ipAccess.ModelMiddleware())
+	queueRoutes.Use(server.rateLimit(rateLimitGroupQueue))
+	queueRoutes.Use(server.concurrency.Middleware(rateLimitGroupQueue))
+	queueRoutes.Use(server.prometheusMiddleware())
 	queueRoutes.GET("/:model", server.getTaskQueueSize)
 
+	usageRoutes := router.Group("/v1")
+	usageRoutes.Use(traceRequest())
+	usageRoutes.Use(authenticateRequest(server.audit))
+	usageRoutes.Use(server.meterUsage())
+	usageRoutes.Use(server.overrides.Middleware())
+	usageRoutes.Use(server.rateLimit(rateLimitGroupTask))
+	usageRoutes.Use(server.prometheusMiddleware())
+	usageRoutes.GET("/usage", server.getUsage)
+	usageRoutes.GET("/credits", server.getCredits)
+	usageRoutes.GET("/credits/transactions", server.getCreditTransactions)
+
+	adminRoutes := router.Group("/admin")
+	adminRoutes.Use(traceRequest())
+	adminRoutes.Use(server.rateLimitIP())
+	adminRoutes.Use(authenticateAdmin(server.config.AdminAPIKey, server.audit))
+	adminRoutes.Use(server.prometheusMiddleware())
+	adminRoutes.POST("/credits/:uid/topup", server.topUpCredits)
+	adminRoutes.GET("/overrides", server.listOverrides)
+	adminRoutes.GET("/overrides/:uid", server.getOverride)
+	adminRoutes.PUT("/overrides/:uid", server.setOverride)
+	adminRoutes.DELETE("/overrides/:uid", server.deleteOverride)
+
 	server.router = router
 }
 
@@ -75,10 +260,41 @@ func (server *Server) Handler() http.Handler {
 	return server.router.Handler()
 }
 
+// Close stops the background jobs, flushes the usage and audit events and closes the Redis client,
+// it is called once the HTTP server is shut down.
+func (server *Server) Close(ctx context.Context) error {
+	server.readiness.SetDraining(true)
+	for _, pool := range server.pools {
+		pool.Stop()
+	}
+	for _, queue := range server.admission {
+		close(queue.done)
+	}
+	server.redisHealth.Stop()
+	server.overrides.Stop()
+	server.ipAccess.Stop()
+	if server.blobGC != nil {
+		server.blobGC.Stop()
+	}
+
+	var err error
+	if sink, ok := server.usage.(*utils.BufferedSink); ok {
+		err = sink.Shutdown(ctx)
+	} else if server.usage != nil {
+		err = server.usage.Close()
+	}
+	err = errors.Join(err, server.audit.Close(ctx))
+	if server.redis != nil {
+		err = errors.Join(err, server.redis.Close())
+	}
+	return err
+}
+
 func errorResponse(err error) gin.H {
 	return gin.H{"error": err.Error()}
 }
 
+// checkHealth only tells that the process is alive, the dependencies are checked by /ready.
 func (server *Server) checkHealth(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"message": "API OK"})
 }
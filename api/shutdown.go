@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errServerShuttingDown = errors.New("server shutting down")
+
+// streamTracker tracks the in-flight streams, so that they can be ended on shutdown.
+type streamTracker struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	stopped bool
+	stop    chan struct{}
+}
+
+func newStreamTracker() *streamTracker {
+	return &streamTracker{stop: make(chan struct{})}
+}
+
+// add registers a stream, it fails once the streams are stopped.
+func (tracker *streamTracker) add() bool {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.stopped {
+		return false
+	}
+	tracker.wg.Add(1)
+	return true
+}
+
+func (tracker *streamTracker) done() {
+	tracker.wg.Done()
+}
+
+// stopAll signals the streams to end, and waits for them until the context is done.
+func (tracker *streamTracker) stopAll(ctx context.Context) error {
+	tracker.mu.Lock()
+	if !tracker.stopped {
+		tracker.stopped = true
+		close(tracker.stop)
+	}
+	tracker.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		tracker.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StartDraining makes /ready fail, so that the load balancer stops sending new requests.
+func (server *Server) StartDraining() {
+	server.readiness.SetDraining(true)
+}
+
+// StopStreams ends the in-flight streams with a final "server shutting down" event, and
+// waits for them until the context is done. New streams are rejected afterwards.
+func (server *Server) StopStreams(ctx context.Context) error {
+	return server.streams.stopAll(ctx)
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"id": 1, "data": "a"}` + "\n"))
+		w.(http.Flusher).Flush()
+		// The stream never completes on its own
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer(utils.Config{ServingAgentAddress: upstream.URL}, nil)
+	require.NoError(t, err)
+	gateway := httptest.NewServer(server.Handler())
+	defer gateway.Close()
+
+	generate := func() *http.Response {
+		request, err := http.NewRequest(http.MethodPost, gateway.URL+"/v1/generate",
+			bytes.NewReader([]byte(`{"model_name": "test", "inputs": {"prompt": "a cat"}}`)))
+		require.NoError(t, err)
+		request.Header.Set("UID", "1")
+		res, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		return res
+	}
+
+	res := generate()
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	reader := bufio.NewReader(res.Body)
+	line, err := reader.ReadBytes('\n')
+	require.NoError(t, err)
+	require.JSONEq(t, `{"id": 1, "data": "a"}`, string(line))
+
+	server.StartDraining()
+	require.False(t, server.readiness.Check(context.Background()).Ready)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.StopStreams(ctx))
+
+	// The client receives a final event before the end of the stream
+	line, err = reader.ReadBytes('\n')
+	require.NoError(t, err)
+	var event map[string]string
+	require.NoError(t, json.Unmarshal(line, &event))
+	require.Equal(t, errServerShuttingDown.Error(), event["error"])
+
+	// New streams are rejected
+	rejected := generate()
+	defer rejected.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, rejected.StatusCode)
+	require.NoError(t, server.Close(ctx))
+}
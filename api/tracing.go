@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+const tracerName = "github.com/HyperGAI/serving-api/api"
+
+// startRequestSpan starts the server span of an inbound request, continuing the trace of
+// the caller if it sent a traceparent header. The span is kept in the request context.
+func startRequestSpan(ctx *gin.Context) trace.Span {
+	parent := otel.GetTextMapPropagator().Extract(ctx.Request.Context(),
+		propagation.HeaderCarrier(ctx.Request.Header))
+	route := ctx.FullPath()
+	if route == "" {
+		route = ctx.Request.URL.Path
+	}
+	spanCtx, span := otel.Tracer(tracerName).Start(parent, ctx.Request.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(ctx.Request.Method),
+			semconv.HTTPRoute(route),
+			semconv.ClientAddress(ctx.ClientIP()),
+		))
+	ctx.Request = ctx.Request.WithContext(spanCtx)
+	return span
+}
+
+// endRequestSpan records the user and the response status of an inbound request.
+func endRequestSpan(ctx *gin.Context, span trace.Span) {
+	status := ctx.Writer.Status()
+	span.SetAttributes(
+		attribute.String("user.id", ctx.Request.Header.Get("UID")),
+		semconv.HTTPResponseStatusCode(status),
+	)
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// startSpan starts an internal span, e.g., of a middleware.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name)
+}
+
+// startUpstreamSpan starts the client span of a call to the serving agent or the webhook.
+func startUpstreamSpan(ctx context.Context, target string, method string, url string) (context.Context, trace.Span) {
+	attributes := []attribute.KeyValue{semconv.HTTPRequestMethodKey.String(method)}
+	// The URL of a retried call is set by each attempt
+	if url != "" {
+		attributes = append(attributes, semconv.URLFull(url))
+	}
+	return otel.Tracer(tracerName).Start(ctx, method+" "+target,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attributes...))
+}
+
+// setUpstreamURL records the URL of an attempt of an upstream call.
+func setUpstreamURL(span trace.Span, url string) {
+	span.SetAttributes(semconv.URLFull(url))
+}
+
+// endUpstreamSpan records the outcome of an upstream call.
+func endUpstreamSpan(span trace.Span, statusCode int, err error) {
+	if statusCode > 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(statusCode))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if statusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+	span.End()
+}
+
+// forwardRequestContext sets the traceparent and X-Request-ID headers of an outbound request.
+func forwardRequestContext(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+	if id := requestIDFrom(ctx); id != "" {
+		header.Set(requestIDHeader, id)
+	}
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"bytes"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	}()
+
+	var upstreamParent trace.SpanContext
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		upstreamParent = trace.SpanContextFromContext(ctx)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"outputs": "test"}`))
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer(utils.Config{ServingAgentAddress: upstream.URL}, nil)
+	require.NoError(t, err)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	response := httptest.NewRecorder()
+	request, err := http.NewRequest(http.MethodPost, "/v1/predict",
+		bytes.NewReader([]byte(`{"model_name": "test", "inputs": {"prompt": "a cat"}}`)))
+	require.NoError(t, err)
+	request.Header.Set("UID", "1")
+	request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	server.router.ServeHTTP(response, request)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	require.Contains(t, spans, "POST /v1/predict")
+	require.Contains(t, spans, "auth")
+	require.Contains(t, spans, "POST v1/predict")
+
+	// The spans continue the trace of the caller, and the serving agent continues the upstream span
+	inbound, upstreamSpan := spans["POST /v1/predict"], spans["POST v1/predict"]
+	require.Equal(t, traceID, inbound.SpanContext().TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", inbound.Parent().SpanID().String())
+	require.Equal(t, inbound.SpanContext().SpanID(), spans["auth"].Parent().SpanID())
+	require.Equal(t, inbound.SpanContext().SpanID(), upstreamSpan.Parent().SpanID())
+	require.Equal(t, traceID, upstreamParent.TraceID().String())
+	require.Equal(t, upstreamSpan.SpanContext().SpanID(), upstreamParent.SpanID())
+}
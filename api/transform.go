@@ -0,0 +1,237 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"sort"
+	"strings"
+)
+
+// Transform applies the declarative payload transforms of a model. The payloads are
+// copied, so that the caller's maps, e.g., shared by coalesced predictions, are unchanged.
+// A nil Transform returns the payloads as is.
+type Transform struct {
+	renames  [][2][]string
+	defaults [][]string
+	values   map[string]interface{}
+	clamps   map[string]utils.ClampRange
+	allowed  [][]string
+	strip    [][]string
+}
+
+// NewTransform validates the transforms of a model, it returns nil if there are none.
+func NewTransform(config utils.TransformConfig) (*Transform, error) {
+	request, response := config.Request, config.Response
+	if len(request.Rename) == 0 && len(request.Defaults) == 0 && len(request.Clamp) == 0 &&
+		len(request.Allowed) == 0 && len(response.Strip) == 0 {
+		return nil, nil
+	}
+	transform := &Transform{values: request.Defaults, clamps: request.Clamp}
+	for _, from := range sortedKeys(request.Rename) {
+		to := request.Rename[from]
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("invalid rename of %q to %q", from, to)
+		}
+		transform.renames = append(transform.renames, [2][]string{splitPath(from), splitPath(to)})
+	}
+	for _, field := range sortedKeys(request.Defaults) {
+		transform.defaults = append(transform.defaults, splitPath(field))
+	}
+	for field, bounds := range request.Clamp {
+		if bounds.Min != nil && bounds.Max != nil && *bounds.Min > *bounds.Max {
+			return nil, fmt.Errorf("invalid clamp of %s, min > max", field)
+		}
+	}
+	for _, field := range request.Allowed {
+		transform.allowed = append(transform.allowed, splitPath(field))
+	}
+	for _, field := range response.Strip {
+		transform.strip = append(transform.strip, splitPath(field))
+	}
+	return transform, nil
+}
+
+// Request returns the inputs sent to the agent: the fields are renamed, the defaults
+// added, the numbers clamped, and the fields which are not allowed removed.
+func (transform *Transform) Request(inputs map[string]interface{}) map[string]interface{} {
+	if transform == nil {
+		return inputs
+	}
+	result := copyValue(inputs).(map[string]interface{})
+	if result == nil {
+		result = make(map[string]interface{})
+	}
+
+	// The renames apply at once, so that fields can be swapped
+	values := make([]interface{}, len(transform.renames))
+	found := make([]bool, len(transform.renames))
+	for i, rename := range transform.renames {
+		values[i], found[i] = getPath(result, rename[0])
+		deletePath(result, rename[0])
+	}
+	for i, rename := range transform.renames {
+		if found[i] {
+			setPath(result, rename[1], values[i])
+		}
+	}
+
+	for _, path := range transform.defaults {
+		if _, ok := getPath(result, path); !ok {
+			setPath(result, path, copyValue(transform.values[strings.Join(path, ".")]))
+		}
+	}
+	for field, bounds := range transform.clamps {
+		path := splitPath(field)
+		value, ok := getPath(result, path)
+		if !ok {
+			continue
+		}
+		number, ok := toFloat(value)
+		if !ok {
+			continue
+		}
+		if bounds.Min != nil && number < *bounds.Min {
+			setPath(result, path, *bounds.Min)
+		} else if bounds.Max != nil && number > *bounds.Max {
+			setPath(result, path, *bounds.Max)
+		}
+	}
+	if len(transform.allowed) > 0 {
+		filtered := make(map[string]interface{})
+		for _, path := range transform.allowed {
+			if value, ok := getPath(result, path); ok {
+				setPath(filtered, path, value)
+			}
+		}
+		result = filtered
+	}
+	return result
+}
+
+// Response returns the response written to the client, without the stripped fields.
+func (transform *Transform) Response(outputs map[string]interface{}) map[string]interface{} {
+	if transform == nil || len(transform.strip) == 0 || outputs == nil {
+		return outputs
+	}
+	result := copyValue(outputs).(map[string]interface{})
+	for _, path := range transform.strip {
+		deletePath(result, path)
+	}
+	return result
+}
+
+// Message strips the fields of a streamed message whose data is a JSON object.
+func (transform *Transform) Message(m StreamingMessage) StreamingMessage {
+	if transform == nil || len(transform.strip) == 0 || len(m.Data) == 0 || m.Data[0] != '{' {
+		return m
+	}
+	var outputs map[string]interface{}
+	if json.Unmarshal([]byte(m.Data), &outputs) != nil {
+		return m
+	}
+	data, err := json.Marshal(transform.Response(outputs))
+	if err != nil {
+		return m
+	}
+	m.Data = string(data)
+	return m
+}
+
+// Task strips the fields of a task result, which holds the response of the agent.
+func (transform *Transform) Task(info interface{}) interface{} {
+	if task, ok := info.(map[string]interface{}); ok {
+		return transform.Response(task)
+	}
+	return info
+}
+
+// transform returns the transforms of a model, nil if it has none.
+func (server *Server) transform(modelName string) *Transform {
+	return server.transforms[modelName]
+}
+
+func splitPath(field string) []string {
+	return strings.Split(field, ".")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func getPath(m map[string]interface{}, path []string) (interface{}, bool) {
+	for _, key := range path[:len(path)-1] {
+		child, ok := m[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		m = child
+	}
+	value, ok := m[path[len(path)-1]]
+	return value, ok
+}
+
+// setPath sets a field, replacing the non-object values on its path by objects.
+func setPath(m map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		child, ok := m[key].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			m[key] = child
+		}
+		m = child
+	}
+	m[path[len(path)-1]] = value
+}
+
+func deletePath(m map[string]interface{}, path []string) {
+	for _, key := range path[:len(path)-1] {
+		child, ok := m[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		m = child
+	}
+	delete(m, path[len(path)-1])
+}
+
+// copyValue deep copies the maps and slices of a decoded JSON value.
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if v == nil {
+			return v
+		}
+		result := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			result[key] = copyValue(child)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, child := range v {
+			result[i] = copyValue(child)
+		}
+		return result
+	default:
+		return value
+	}
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	mockapi "github.com/HyperGAI/serving-api/api/mock"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func TestTransformRequest(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   utils.RequestTransform
+		inputs   string
+		expected string
+	}{
+		{
+			name:     "Rename",
+			config:   utils.RequestTransform{Rename: map[string]string{"prompt": "text"}},
+			inputs:   `{"prompt": "a cat", "steps": 10}`,
+			expected: `{"text": "a cat", "steps": 10}`,
+		},
+		{
+			name:     "Swap",
+			config:   utils.RequestTransform{Rename: map[string]string{"a": "b", "b": "a"}},
+			inputs:   `{"a": 1, "b": 2}`,
+			expected: `{"a": 2, "b": 1}`,
+		},
+		{
+			name:     "NestedRename",
+			config:   utils.RequestTransform{Rename: map[string]string{"prompt": "params.text"}},
+			inputs:   `{"prompt": "a cat", "params": {"steps": 10}}`,
+			expected: `{"params": {"text": "a cat", "steps": 10}}`,
+		},
+		{
+			name:     "Defaults",
+			config:   utils.RequestTransform{Defaults: map[string]interface{}{"steps": 30, "scheduler": "ddim"}},
+			inputs:   `{"steps": 10}`,
+			expected: `{"steps": 10, "scheduler": "ddim"}`,
+		},
+		{
+			name: "Clamp",
+			config: utils.RequestTransform{Clamp: map[string]utils.ClampRange{
+				"steps": {Min: float(1), Max: float(50)},
+				"width": {Max: float(1024)},
+				"seed":  {Min: float(0)},
+			}},
+			inputs:   `{"steps": 100, "width": 512, "seed": -1}`,
+			expected: `{"steps": 50, "width": 512, "seed": 0}`,
+		},
+		{
+			name:     "ClampNotNumber",
+			config:   utils.RequestTransform{Clamp: map[string]utils.ClampRange{"steps": {Max: float(50)}}},
+			inputs:   `{"steps": "many"}`,
+			expected: `{"steps": "many"}`,
+		},
+		{
+			name: "Allowed",
+			config: utils.RequestTransform{
+				Rename:  map[string]string{"prompt": "text"},
+				Allowed: []string{"text", "params.steps"},
+			},
+			inputs:   `{"prompt": "a cat", "secret": 1, "params": {"steps": 10, "debug": true}}`,
+			expected: `{"text": "a cat", "params": {"steps": 10}}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			transform, err := NewTransform(utils.TransformConfig{Request: tc.config})
+			require.NoError(t, err)
+			var inputs map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(tc.inputs), &inputs))
+			original, err := json.Marshal(inputs)
+			require.NoError(t, err)
+
+			result, err := json.Marshal(transform.Request(inputs))
+			require.NoError(t, err)
+			require.JSONEq(t, tc.expected, string(result))
+			// The inputs of the caller are unchanged
+			unchanged, err := json.Marshal(inputs)
+			require.NoError(t, err)
+			require.JSONEq(t, string(original), string(unchanged))
+		})
+	}
+}
+
+func TestTransformConfig(t *testing.T) {
+	transform, err := NewTransform(utils.TransformConfig{})
+	require.NoError(t, err)
+	require.Nil(t, transform)
+	inputs := map[string]interface{}{"prompt": "a cat"}
+	require.Equal(t, inputs, transform.Request(inputs))
+	require.Equal(t, inputs, transform.Response(inputs))
+
+	_, err = NewTransform(utils.TransformConfig{Request: utils.RequestTransform{
+		Clamp: map[string]utils.ClampRange{"steps": {Min: float(10), Max: float(1)}},
+	}})
+	require.Error(t, err)
+
+	var config utils.TransformConfig
+	require.NoError(t, yaml.Unmarshal([]byte(`
+request:
+  rename: {prompt: text}
+  defaults: {steps: 30}
+  clamp:
+    steps: {max: 50}
+response:
+  strip: [debug, outputs.timings]
+`), &config))
+	transform, err = NewTransform(config)
+	require.NoError(t, err)
+	result, err := json.Marshal(transform.Request(map[string]interface{}{"prompt": "a cat"}))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"text": "a cat", "steps": 30}`, string(result))
+
+	outputs := map[string]interface{}{
+		"debug":   "x",
+		"outputs": map[string]interface{}{"image": "y", "timings": 1.0},
+	}
+	require.Equal(t, map[string]interface{}{"outputs": map[string]interface{}{"image": "y"}},
+		transform.Response(outputs))
+	require.Contains(t, outputs, "debug")
+}
+
+func TestPredictTransforms(t *testing.T) {
+	var upstreamInputs map[string]interface{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req InferRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		upstreamInputs = req.Inputs
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"outputs": "test", "debug": {"gpu": 0}}`))
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress: upstream.URL,
+		Models: map[string]utils.ModelConfig{"test": {Transform: utils.TransformConfig{
+			Request:  utils.RequestTransform{Rename: map[string]string{"prompt": "text"}},
+			Response: utils.ResponseTransform{Strip: []string{"debug"}},
+		}}},
+	}, nil)
+	require.NoError(t, err)
+
+	for _, path := range []string{"/v1/predict", "/async/v1/predict"} {
+		data, err := json.Marshal(gin.H{"model_name": "test", "inputs": gin.H{"prompt": "a cat"}})
+		require.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+		require.NoError(t, err)
+		request.Header.Set("UID", "1")
+		server.router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, map[string]interface{}{"text": "a cat"}, upstreamInputs)
+		require.JSONEq(t, `{"outputs": "test"}`, recorder.Body.String())
+	}
+}
+
+func TestTransformMessage(t *testing.T) {
+	transform, err := NewTransform(utils.TransformConfig{
+		Response: utils.ResponseTransform{Strip: []string{"debug"}},
+	})
+	require.NoError(t, err)
+
+	message := transform.Message(StreamingMessage{Id: 1, Data: `{"outputs": "a", "debug": {"gpu": 0}}`})
+	require.Equal(t, 1, message.Id)
+	require.JSONEq(t, `{"outputs": "a"}`, message.Data)
+	// The text messages are unchanged
+	require.Equal(t, StreamingMessage{Id: 2, Data: "a cat"}, transform.Message(StreamingMessage{Id: 2, Data: "a cat"}))
+	require.Equal(t, StreamingMessage{Id: 3, Data: "{a cat"}, transform.Message(StreamingMessage{Id: 3, Data: "{a cat"}))
+	var none *Transform
+	require.Equal(t, StreamingMessage{Id: 4, Data: `{"debug": 1}`}, none.Message(StreamingMessage{Id: 4, Data: `{"debug": 1}`}))
+}
+
+func TestGetTaskTransforms(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	task := map[string]interface{}{
+		"model_name": "test",
+		"status":     "succeeded",
+		"outputs":    "test",
+		"debug":      map[string]interface{}{"gpu": 0},
+	}
+	webhook := mockapi.NewMockWebhook(ctrl)
+	webhook.EXPECT().GetTaskInfo(gomock.Any(), "1234").Times(2).Return(task, nil)
+
+	server, err := NewServer(utils.Config{
+		Models: map[string]utils.ModelConfig{"test": {Transform: utils.TransformConfig{
+			Response: utils.ResponseTransform{Strip: []string{"debug"}},
+		}}},
+	}, webhook)
+	require.NoError(t, err)
+
+	getTask, err := http.NewRequest(http.MethodGet, "/task/1234", nil)
+	require.NoError(t, err)
+	// getTask reads the ID from the request URI, which is set by the servers
+	getTask.RequestURI = "/task/1234"
+	getTasks, err := http.NewRequest(http.MethodPost, "/task/batch", bytes.NewReader([]byte(`{"ids": ["1234"]}`)))
+	require.NoError(t, err)
+	for _, request := range []*http.Request{getTask, getTasks} {
+		recorder := httptest.NewRecorder()
+		request.Header.Set("UID", "1")
+		server.router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.NotContains(t, recorder.Body.String(), "debug")
+		require.Contains(t, recorder.Body.String(), `"outputs":"test"`)
+	}
+	// The task of the webhook is unchanged
+	require.Contains(t, task, "debug")
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const defaultMaxRequestBodySize = 64 << 20
+
+// uploadedFile is a file part of a multipart prediction request.
+type uploadedFile struct {
+	field       string
+	filename    string
+	contentType string
+	data        []byte
+}
+
+// limitRequestBody rejects the request bodies larger than the limit while they are read.
+func limitRequestBody(limit int64) gin.HandlerFunc {
+	if limit <= 0 {
+		limit = defaultMaxRequestBodySize
+	}
+	return func(ctx *gin.Context) {
+		if ctx.Request.Body != nil {
+			ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, limit)
+		}
+		ctx.Next()
+	}
+}
+
+func isMultipart(ctx *gin.Context) bool {
+	return ctx.ContentType() == binding.MIMEMultipartPOSTForm
+}
+
+// parseMultipartRequest reads a multipart prediction request: a "model_name" field, a JSON
+// "inputs" part and the file parts, which are named after the input fields.
+func parseMultipartRequest(contentType string, body []byte) (InferRequest, []uploadedFile, error) {
+	var req InferRequest
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		return req, nil, errors.New("invalid multipart content type")
+	}
+	var files []uploadedFile
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return req, nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return req, nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+		switch {
+		case part.FileName() != "":
+			files = append(files, uploadedFile{
+				field:       part.FormName(),
+				filename:    part.FileName(),
+				contentType: part.Header.Get("Content-Type"),
+				data:        data,
+			})
+		case part.FormName() == "model_name":
+			req.ModelName = string(data)
+		case part.FormName() == "inputs":
+			if err := json.Unmarshal(data, &req.Inputs); err != nil {
+				return req, nil, fmt.Errorf("invalid inputs: %w", err)
+			}
+		default:
+			return req, nil, fmt.Errorf("unexpected part %q", part.FormName())
+		}
+	}
+	if req.ModelName == "" {
+		return req, nil, errors.New("model_name is required")
+	}
+	if req.Inputs == nil {
+		req.Inputs = make(map[string]interface{})
+	}
+	return req, files, nil
+}
+
+// bindInferRequest decodes a prediction request, either JSON or multipart. The files of
+// a multipart request are added to the inputs according to the declared inputs of the model.
+// On error, the returned status code is the one to respond with.
+func (server *Server) bindInferRequest(ctx *gin.Context) (InferRequest, int, error) {
+	var req InferRequest
+	if !isMultipart(ctx) {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			return req, bodyErrorStatus(err), err
+		}
+		return req, http.StatusOK, nil
+	}
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return req, bodyErrorStatus(err), err
+	}
+	req, files, err := parseMultipartRequest(ctx.GetHeader("Content-Type"), body)
+	if err != nil {
+		return req, http.StatusBadRequest, err
+	}
+	for _, file := range files {
+		if status, err := server.attachFile(ctx.Request.Context(), req, file); err != nil {
+			return req, status, err
+		}
+	}
+	return req, http.StatusOK, nil
+}
+
+func bodyErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// attachFile checks an uploaded file against the declared input of the model, and sets
+// the input to the file encoded in base64 or to the signed URL of the file in the blob store.
+func (server *Server) attachFile(ctx context.Context, req InferRequest, file uploadedFile) (int, error) {
+	input, ok := server.config.Model(req.ModelName).Inputs[file.field]
+	if !ok {
+		return http.StatusBadRequest, fmt.Errorf("model %s has no file input %s", req.ModelName, file.field)
+	}
+	if input.MaxSize > 0 && int64(len(file.data)) > input.MaxSize {
+		return http.StatusRequestEntityTooLarge,
+			fmt.Errorf("the file of input %s exceeds %d bytes", file.field, input.MaxSize)
+	}
+	contentType := file.contentType
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(file.data)
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	if !mimeTypeAllowed(contentType, input.MIMETypes) {
+		return http.StatusUnsupportedMediaType,
+			fmt.Errorf("the file of input %s has the unsupported type %s", file.field, contentType)
+	}
+
+	if input.Encoding != utils.InputEncodingURL {
+		req.Inputs[file.field] = base64.StdEncoding.EncodeToString(file.data)
+		return http.StatusOK, nil
+	}
+	key := path.Join("uploads", newLeaseID(), safeFilename(file.filename))
+	now := time.Now()
+	err := server.blobs.Put(ctx, key, bytes.NewReader(file.data), utils.BlobInfo{
+		ContentType: contentType,
+		ExpiresAt:   now.Add(server.blobTTL()),
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	req.Inputs[file.field] = server.blobSigner.URL(key, now.Add(server.blobURLTTL()))
+	return http.StatusOK, nil
+}
+
+// mimeTypeAllowed matches a MIME type with the accepted ones, e.g., "image/png" or "image/*".
+func mimeTypeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, pattern := range allowed {
+		if pattern == contentType ||
+			(strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+func safeFilename(filename string) string {
+	name := unsafeFilenameChars.ReplaceAllString(path.Base(strings.ReplaceAll(filename, "\\", "/")), "_")
+	if name == "" || name == "." || name == ".." || strings.HasSuffix(name, ".meta") {
+		return "file"
+	}
+	return name
+}
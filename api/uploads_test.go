@@ -0,0 +1,188 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/stretchr/testify/require"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type testFile struct {
+	field       string
+	contentType string
+	data        []byte
+}
+
+func newMultipartRequest(t *testing.T, path string, model string, inputs string, files ...testFile) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	require.NoError(t, writer.WriteField("model_name", model))
+	require.NoError(t, writer.WriteField("inputs", inputs))
+	for _, file := range files {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", `form-data; name="`+file.field+`"; filename="../my image.png"`)
+		header.Set("Content-Type", file.contentType)
+		part, err := writer.CreatePart(header)
+		require.NoError(t, err)
+		_, err = part.Write(file.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	request, err := http.NewRequest(http.MethodPost, path, &body)
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	request.Header.Set("UID", "1")
+	return request
+}
+
+func TestMultipartPredict(t *testing.T) {
+	var upstreamInputs map[string]interface{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req InferRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		upstreamInputs = req.Inputs
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"outputs": "test"}`))
+	}))
+	defer upstream.Close()
+
+	image := []byte("\x89PNG\r\n\x1a\n0000")
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress: upstream.URL,
+		MaxRequestBodySize:  1024,
+		BlobStore:           utils.BlobStoreFile,
+		BlobDir:             t.TempDir(),
+		BlobSigningKey:      "key",
+		BlobBaseURL:         "http://localhost/blobs",
+		Models: map[string]utils.ModelConfig{"test": {Inputs: map[string]utils.InputConfig{
+			"image": {Type: utils.InputImage, MaxSize: 64, MIMETypes: []string{"image/*"}},
+			"mask":  {Type: utils.InputImage, Encoding: utils.InputEncodingURL},
+		}}},
+	}, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		files  []testFile
+		status int
+	}{
+		{
+			name:   "Base64",
+			files:  []testFile{{field: "image", contentType: "image/png", data: image}},
+			status: http.StatusOK,
+		},
+		{
+			name:   "DetectedType",
+			files:  []testFile{{field: "image", contentType: "application/octet-stream", data: image}},
+			status: http.StatusOK,
+		},
+		{
+			name:   "UnsupportedType",
+			files:  []testFile{{field: "image", contentType: "text/plain", data: image}},
+			status: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:   "FileTooLarge",
+			files:  []testFile{{field: "image", contentType: "image/png", data: bytes.Repeat([]byte("0"), 65)}},
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "BodyTooLarge",
+			files:  []testFile{{field: "mask", contentType: "image/png", data: bytes.Repeat([]byte("0"), 1025)}},
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "UndeclaredInput",
+			files:  []testFile{{field: "audio", contentType: "audio/wav", data: image}},
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			upstreamInputs = nil
+			recorder := httptest.NewRecorder()
+			server.router.ServeHTTP(recorder,
+				newMultipartRequest(t, "/v1/predict", "test", `{"prompt": "a cat"}`, tc.files...))
+			require.Equal(t, tc.status, recorder.Code, recorder.Body.String())
+			if tc.status != http.StatusOK {
+				require.Nil(t, upstreamInputs)
+				return
+			}
+			require.Equal(t, map[string]interface{}{
+				"prompt": "a cat",
+				"image":  base64.StdEncoding.EncodeToString(image),
+			}, upstreamInputs)
+		})
+	}
+
+	t.Run("URL", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		server.router.ServeHTTP(recorder, newMultipartRequest(t, "/async/v1/predict", "test", `{}`,
+			testFile{field: "mask", contentType: "image/png", data: image}))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		signed, ok := upstreamInputs["mask"].(string)
+		require.True(t, ok)
+		require.True(t, strings.HasPrefix(signed, "http://localhost/blobs/uploads/"))
+		require.True(t, strings.Contains(signed, "/my_image.png?"))
+
+		blobURL, err := url.Parse(signed)
+		require.NoError(t, err)
+		recorder = httptest.NewRecorder()
+		request, err := http.NewRequest(http.MethodGet, blobURL.RequestURI(), nil)
+		require.NoError(t, err)
+		server.router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, "image/png", recorder.Header().Get("Content-Type"))
+		require.Equal(t, image, recorder.Body.Bytes())
+
+		query := blobURL.Query()
+		query.Set("signature", strings.Repeat("0", 64))
+		blobURL.RawQuery = query.Encode()
+		recorder = httptest.NewRecorder()
+		request, err = http.NewRequest(http.MethodGet, blobURL.RequestURI(), nil)
+		require.NoError(t, err)
+		server.router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+}
+
+func TestSetupBlobs(t *testing.T) {
+	inputs := map[string]utils.ModelConfig{"test": {Inputs: map[string]utils.InputConfig{
+		"mask": {Type: utils.InputImage, Encoding: utils.InputEncodingURL},
+	}}}
+	// The url encoding needs the blob store
+	_, err := NewServer(utils.Config{Models: inputs}, nil)
+	require.Error(t, err)
+	_, err = NewServer(utils.Config{BlobStore: utils.BlobStoreFile, BlobDir: t.TempDir(), Models: inputs}, nil)
+	require.Error(t, err)
+	_, err = NewServer(utils.Config{Models: map[string]utils.ModelConfig{"test": {Inputs: map[string]utils.InputConfig{
+		"mask": {Type: "pdf"},
+	}}}}, nil)
+	require.Error(t, err)
+}
+
+func TestBlobDisposition(t *testing.T) {
+	testCases := []struct {
+		contentType string
+		expected    string
+	}{
+		{contentType: "image/png", expected: "inline"},
+		{contentType: "video/mp4; codecs=avc1", expected: "inline"},
+		{contentType: "text/html; charset=utf-8", expected: "attachment"},
+		{contentType: "image/svg+xml", expected: "attachment"},
+		{contentType: "", expected: "attachment"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.contentType, func(t *testing.T) {
+			require.Equal(t, tc.expected, blobDisposition(tc.contentType))
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	reportedCostKey = "reportedCost"
+	streamChunksKey = "streamChunks"
+	taskIDKey       = "taskID"
+)
+
+// UsageEvent is the record of a completed request, which billing is computed from.
+type UsageEvent struct {
+	Time         time.Time `json:"time"`
+	UserID       string    `json:"uid"`
+	ClientIP     string    `json:"client_ip"`
+	Model        string    `json:"model,omitempty"`
+	Route        string    `json:"route"`
+	Method       string    `json:"method"`
+	Status       int       `json:"status"`
+	LatencyMs    float64   `json:"latency_ms"`
+	InputBytes   int64     `json:"input_bytes"`
+	OutputBytes  int64     `json:"output_bytes"`
+	StreamChunks int       `json:"stream_chunks,omitempty"`
+	TaskID       string    `json:"task_id,omitempty"`
+	Cost         float64   `json:"cost,omitempty"`
+}
+
+// recordUsage keeps the cost reported by the serving agent in the "usage" field of its
+// outputs, and the ID of the task created by an async prediction.
+func recordUsage(ctx *gin.Context, outputs map[string]interface{}) {
+	if usage, ok := outputs["usage"].(map[string]interface{}); ok {
+		if cost, ok := usage["cost"].(float64); ok {
+			ctx.Set(reportedCostKey, cost)
+		}
+	}
+	for _, field := range []string{"task_id", "id"} {
+		if taskID, ok := outputs[field].(string); ok {
+			ctx.Set(taskIDKey, taskID)
+			break
+		}
+	}
+}
+
+// recordStreamUsage counts the streamed messages, and keeps the cost reported by a message whose
+// data is a JSON object with a "usage" field, which serving agents send at the end of a stream.
+func recordStreamUsage(ctx *gin.Context, m *StreamingMessage) {
+	ctx.Set(streamChunksKey, ctx.GetInt(streamChunksKey)+1)
+	if len(m.Data) == 0 || m.Data[0] != '{' {
+		return
+	}
+	var outputs map[string]interface{}
+	if json.Unmarshal([]byte(m.Data), &outputs) == nil {
+		if usage, ok := outputs["usage"].(map[string]interface{}); ok {
+			if cost, ok := usage["cost"].(float64); ok {
+				ctx.Set(reportedCostKey, cost)
+			}
+		}
+	}
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	reader.n += int64(n)
+	return n, err
+}
+
+// meterUsage emits a usage event for every completed request, if a usage sink is configured.
+func (server *Server) meterUsage() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if server.usage == nil {
+			ctx.Next()
+			return
+		}
+		start := time.Now()
+		body := &countingReader{ReadCloser: ctx.Request.Body}
+		if ctx.Request.Body != nil {
+			ctx.Request.Body = body
+		}
+
+		ctx.Next()
+
+		event := UsageEvent{
+			Time:         start.UTC(),
+			UserID:       ctx.Request.Header.Get("UID"),
+			ClientIP:     ctx.ClientIP(),
+			Model:        requestModelName(ctx),
+			Route:        ctx.FullPath(),
+			Method:       ctx.Request.Method,
+			Status:       ctx.Writer.Status(),
+			LatencyMs:    float64(time.Since(start).Microseconds()) / 1000,
+			InputBytes:   body.n,
+			OutputBytes:  int64(ctx.Writer.Size()),
+			StreamChunks: ctx.GetInt(streamChunksKey),
+			TaskID:       ctx.GetString(taskIDKey),
+		}
+		if event.OutputBytes < 0 {
+			event.OutputBytes = 0
+		}
+		if event.TaskID == "" {
+			event.TaskID = ctx.Param("id")
+		}
+		if cost, ok := ctx.Get(reportedCostKey); ok {
+			event.Cost = cost.(float64)
+		} else if cost, ok := ctx.Get(requestCostKey); ok {
+			event.Cost = cost.(float64)
+		}
+		record, err := json.Marshal(event)
+		if err == nil {
+			err = server.usage.Write([][]byte{record})
+		}
+		if err != nil {
+			requestLogger(ctx.Request.Context()).Error().Err(err).Msg("failed to record usage")
+		}
+	}
+}
+
+// UsageSummary aggregates the usage events of a user and a model.
+// The totals of a user over all models have the model "*".
+type UsageSummary struct {
+	UserID       string  `json:"uid"`
+	Model        string  `json:"model"`
+	Requests     int     `json:"requests"`
+	Errors       int     `json:"errors"`
+	InputBytes   int64   `json:"input_bytes"`
+	OutputBytes  int64   `json:"output_bytes"`
+	StreamChunks int64   `json:"stream_chunks"`
+	Cost         float64 `json:"cost"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+func (summary *UsageSummary) add(event *UsageEvent) {
+	// The average is accumulated as a total until the summaries are complete
+	summary.Requests++
+	if event.Status >= 400 {
+		summary.Errors++
+	}
+	summary.InputBytes += event.InputBytes
+	summary.OutputBytes += event.OutputBytes
+	summary.StreamChunks += int64(event.StreamChunks)
+	summary.Cost += event.Cost
+	summary.AvgLatencyMs += event.LatencyMs
+}
+
+// SummarizeUsage aggregates the usage events of JSONL files per user and model. The events
+// outside [since, until) are skipped, a zero time leaves that side of the range open.
+func SummarizeUsage(paths []string, since time.Time, until time.Time) ([]UsageSummary, error) {
+	summaries := make(map[[2]string]*UsageSummary)
+	aggregate := func(userID string, model string, event *UsageEvent) {
+		key := [2]string{userID, model}
+		summary, ok := summaries[key]
+		if !ok {
+			summary = &UsageSummary{UserID: userID, Model: model}
+			summaries[key] = summary
+		}
+		summary.add(event)
+	}
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var event UsageEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				log.Warn().Err(err).Str("path", path).Msg("skipped an invalid usage event")
+				continue
+			}
+			if (!since.IsZero() && event.Time.Before(since)) || (!until.IsZero() && !event.Time.Before(until)) {
+				continue
+			}
+			aggregate(event.UserID, event.Model, &event)
+			aggregate(event.UserID, "*", &event)
+		}
+		err = scanner.Err()
+		_ = file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]UsageSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		summary.AvgLatencyMs /= float64(summary.Requests)
+		results = append(results, *summary)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].UserID != results[j].UserID {
+			return results[i].UserID < results[j].UserID
+		}
+		return results[i].Model < results[j].Model
+	})
+	return results, nil
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/HyperGAI/serving-api/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageMetering(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"outputs": "test", "usage": {"cost": 2}}`))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	server, err := NewServer(utils.Config{
+		ServingAgentAddress: upstream.URL,
+		UsageSink:           utils.SinkFile,
+		UsageDir:            dir,
+	}, nil)
+	require.NoError(t, err)
+
+	for _, req := range []struct {
+		userID    string
+		modelName string
+	}{
+		{userID: "1", modelName: "a"},
+		{userID: "1", modelName: "a"},
+		{userID: "1", modelName: "b"},
+		{userID: "2", modelName: "a"},
+	} {
+		data, err := json.Marshal(gin.H{"model_name": req.modelName, "inputs": gin.H{"prompt": "a cat"}})
+		require.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(http.MethodPost, "/v1/predict", bytes.NewReader(data))
+		require.NoError(t, err)
+		request.Header.Set("UID", req.userID)
+		server.router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+	}
+	require.NoError(t, server.Close(context.Background()))
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+
+	summaries, err := SummarizeUsage(paths, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, summaries, 5)
+	require.Equal(t, "1", summaries[0].UserID)
+	require.Equal(t, "*", summaries[0].Model)
+	require.Equal(t, 3, summaries[0].Requests)
+	require.Equal(t, 6.0, summaries[0].Cost)
+	require.Equal(t, "a", summaries[1].Model)
+	require.Equal(t, 2, summaries[1].Requests)
+	require.Equal(t, int64(2*len(`{"outputs":"test","usage":{"cost":2}}`)), summaries[1].OutputBytes)
+	require.Positive(t, summaries[1].InputBytes)
+
+	summaries, err = SummarizeUsage(paths, time.Now().Add(time.Hour), time.Time{})
+	require.NoError(t, err)
+	require.Empty(t, summaries)
+}
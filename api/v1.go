@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/rs/zerolog/log"
 	"io"
 	"net/http"
 	"net/url"
@@ -16,6 +15,10 @@ import (
 	"time"
 )
 
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+)
+
 type InferRequest struct {
 	ModelName string                 `json:"model_name" binding:"required"`
 	Inputs    map[string]interface{} `json:"inputs" binding:"required"`
@@ -34,22 +37,134 @@ type StreamingMessage struct {
 	Data string `json:"data"`
 }
 
+// The reasons of the streams ended before completion
+const (
+	streamAbortClient         = "client"
+	streamAbortUpstream       = "upstream"
+	streamAbortUpstreamStatus = "upstream_status"
+	streamAbortShutdown       = "shutdown"
+	streamAbortPolicy         = "policy"
+	streamAbortOther          = "other"
+)
+
+// streamError is an error ending a stream, with the reason reported in the metrics.
+type streamError struct {
+	reason string
+	err    error
+}
+
+func (e *streamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *streamError) Unwrap() error {
+	return e.err
+}
+
+func streamAbortReason(err error) string {
+	var streamErr *streamError
+	if errors.As(err, &streamErr) {
+		return streamErr.reason
+	}
+	return streamAbortOther
+}
+
+// streamEndpointError returns the error of a stream to report to the endpoint pool. Only the
+// failures of the serving agent count against its endpoint, not the client disconnections,
+// the shutdown or the moderation blocks.
+func streamEndpointError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	switch streamAbortReason(err) {
+	case streamAbortUpstream, streamAbortUpstreamStatus:
+		return err
+	}
+	return nil
+}
+
+// errAttemptFailed reports a retried attempt to the endpoint pool, only the failed attempts are retried.
+var errAttemptFailed = errors.New("the upstream attempt failed")
+
+// sendRequest sends a request to the serving agent of a model. Each attempt picks an endpoint,
+// so that a retry can go to another replica, and reports its outcome to the endpoint pool.
+// It returns the URL of the last attempt.
 func (server *Server) sendRequest(
+	ctx context.Context,
 	userID string,
 	method string,
-	url string,
-	body io.Reader,
-) (*http.Response, error) {
-	req, err := http.NewRequest(method, url, body)
-	if err != nil {
-		return nil, errors.New("failed to build request")
+	modelName string,
+	path string,
+	data []byte,
+	idempotencyKey string,
+	retryable bool,
+) (res *http.Response, requestURL string, err error) {
+	ctx, span := startUpstreamSpan(ctx, path, method, "")
+	var release func(err error, statusCode int)
+	defer func() {
+		statusCode := 0
+		if res != nil {
+			statusCode = res.StatusCode
+		}
+		switch {
+		case release == nil:
+		case err != nil && ctx.Err() != nil:
+			// The client is gone, the endpoint did not fail
+			release(nil, 0)
+		default:
+			release(err, statusCode)
+		}
+		endUpstreamSpan(span, statusCode, err)
+	}()
+	newRequest := func() (*http.Request, error) {
+		if release != nil {
+			release(errAttemptFailed, 0)
+			release = nil
+		}
+		agentURL, pick, err := server.agentURL(modelName)
+		if err != nil {
+			return nil, err
+		}
+		requestURL, err = url.JoinPath(agentURL, path)
+		if err != nil {
+			pick(nil, 0)
+			return nil, err
+		}
+		release = pick
+		setUpstreamURL(span, requestURL)
+
+		var body io.Reader = nil
+		if data != nil {
+			body = bytes.NewReader(data)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, requestURL, body)
+		if err != nil {
+			return nil, errors.New("failed to build request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("UID", userID)
+		if idempotencyKey != "" {
+			req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+		}
+		forwardRequestContext(ctx, req.Header)
+		return req, nil
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("UID", userID)
 	client := http.Client{Timeout: 60 * time.Second}
-	return client.Do(req)
+	if !retryable {
+		req, err := newRequest()
+		if err != nil {
+			return nil, requestURL, err
+		}
+		res, err = client.Do(req)
+		return res, requestURL, err
+	}
+	res, err = server.retryPolicy.Do(ctx, &client, path, newRequest)
+	return res, requestURL, err
 }
 
+// sendStreamingRequest relays the messages of a stream. onMessage returns the messages to send
+// for each message received, so that it can hold some back, and onEnd the ones still held at
+// the end of the stream.
 func (server *Server) sendStreamingRequest(
 	ctx context.Context,
 	userID string,
@@ -58,93 +173,172 @@ func (server *Server) sendStreamingRequest(
 	body io.Reader,
 	encoder *json.Encoder,
 	flusher http.Flusher,
-) error {
-	req, err := http.NewRequest(method, url, body)
+	onMessage func(m *StreamingMessage) ([]StreamingMessage, error),
+	onEnd func() ([]StreamingMessage, error),
+	model string,
+) (err error) {
+	spanCtx, span := startUpstreamSpan(ctx, "generate", method, url)
+	statusCode := 0
+	defer func() {
+		endUpstreamSpan(span, statusCode, err)
+	}()
+	req, err := http.NewRequestWithContext(spanCtx, method, url, body)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("UID", userID)
+	forwardRequestContext(spanCtx, req.Header)
 
+	inFlight := upstreamInFlight.WithLabelValues(model)
+	inFlight.Inc()
+	defer inFlight.Dec()
+	start := time.Now()
 	client := http.Client{Timeout: 60 * time.Second}
 	res, err := client.Do(req)
+	upstreamDuration.WithLabelValues(model, "generate").Observe(time.Since(start).Seconds())
 	if err != nil {
-		return err
+		return &streamError{reason: streamAbortUpstream, err: err}
 	}
 	defer res.Body.Close()
+	statusCode = res.StatusCode
 
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("status-code: %d", res.StatusCode)
+		return &streamError{reason: streamAbortUpstreamStatus, err: fmt.Errorf("status-code: %d", res.StatusCode)}
 	}
 	decoder := json.NewDecoder(res.Body)
+	send := func(messages []StreamingMessage) error {
+		for _, m := range messages {
+			if err := encoder.Encode(m); err != nil {
+				return &streamError{reason: streamAbortClient, err: fmt.Errorf("failed to encode request: %v", err)}
+			}
+		}
+		if len(messages) > 0 {
+			flusher.Flush()
+		}
+		return nil
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			return fmt.Errorf("client stopped listening")
+			return &streamError{reason: streamAbortClient, err: fmt.Errorf("client stopped listening")}
 		default:
 			var m StreamingMessage
 			if err := decoder.Decode(&m); err != nil {
-				if err == io.EOF {
-					return nil
+				if err != io.EOF {
+					return &streamError{reason: streamAbortUpstream, err: fmt.Errorf("failed to decode request: %v", err)}
 				}
-				return fmt.Errorf("failed to decode request: %v", err)
+				messages, err := onEnd()
+				if err != nil {
+					return err
+				}
+				return send(messages)
 			}
-			if err := encoder.Encode(m); err != nil {
-				return fmt.Errorf("failed to encode request: %v", err)
+			messages, err := onMessage(&m)
+			if err != nil {
+				return err
+			}
+			if err := send(messages); err != nil {
+				return err
 			}
-			flusher.Flush()
 		}
 	}
 }
 
+// agentURL returns the serving agent URL of a model and a function to report the
+// outcome of the call. Models without an endpoint pool use SERVING_AGENT_ADDRESS.
+func (server *Server) agentURL(modelName string) (string, func(err error, statusCode int), error) {
+	if pool, ok := server.pools[modelName]; ok {
+		return pool.Pick()
+	}
+	agentURL := strings.Replace(server.config.ServingAgentAddress, "{MODEL-NAME}", modelName, 1)
+	return agentURL, func(error, int) {}, nil
+}
+
+// callServingAgent forwards a request to the serving agent of the model. When retryable
+// is true, the call is safe to repeat and is retried on transient upstream failures.
+// The response is rewritten by the transform, if any, screened by the moderation and its
+// large outputs are offloaded.
 func (server *Server) callServingAgent(
 	userID string,
 	method string,
 	path string,
 	modelName string,
 	data []byte,
+	retryable bool,
+	transform *Transform,
 	ctx *gin.Context,
 ) {
-	agentURL := strings.Replace(server.config.ServingAgentAddress, "{MODEL-NAME}", modelName, 1)
-	requestURL, err := url.JoinPath(agentURL, path)
+	statusCode, outputs, err := server.forwardToServingAgent(ctx.Request.Context(), userID, method,
+		path, modelName, data, ctx.GetHeader(idempotencyKeyHeader), retryable)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		ctx.JSON(statusCode, errorResponse(err))
 		return
 	}
-	var requestBody io.Reader = nil
-	if data != nil {
-		requestBody = bytes.NewReader(data)
+	recordUsage(ctx, outputs)
+	response := transform.Response(outputs)
+	if statusCode >= 300 {
+		ctx.JSON(statusCode, response)
+		return
 	}
-	res, err := server.sendRequest(userID, method, requestURL, requestBody)
-	if err != nil {
-		log.Error().Msgf("failed to call %s, user-id: %s, model-name: %s, error: %v",
-			requestURL, userID, modelName, err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+	if status, err := server.moderate(ctx.Request.Context(), modelName, moderationOutput, response); err != nil {
+		ctx.JSON(status, errorResponse(err))
 		return
 	}
+	ctx.JSON(statusCode, server.offloadOutputs(ctx.Request.Context(), modelName, response))
+}
+
+// forwardToServingAgent calls the serving agent of the model and decodes its response.
+// On error, the returned status code is the one to respond with.
+func (server *Server) forwardToServingAgent(
+	ctx context.Context,
+	userID string,
+	method string,
+	path string,
+	modelName string,
+	data []byte,
+	idempotencyKey string,
+	retryable bool,
+) (int, map[string]interface{}, error) {
+	model := server.modelLabel(modelName)
+	inFlight := upstreamInFlight.WithLabelValues(model)
+	inFlight.Inc()
+	defer inFlight.Dec()
+	start := time.Now()
+	defer func() {
+		upstreamDuration.WithLabelValues(model, path).Observe(time.Since(start).Seconds())
+	}()
+	res, requestURL, err := server.sendRequest(ctx, userID, method, modelName, path, data, idempotencyKey, retryable)
+	if errors.Is(err, errNoEndpoint) {
+		return http.StatusServiceUnavailable, nil, err
+	}
+	logger := requestLogger(ctx).With().
+		Str("model", modelName).
+		Str("upstream_url", requestURL).
+		Logger()
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to call the serving agent")
+		return http.StatusInternalServerError, nil, err
+	}
 
 	defer res.Body.Close()
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Error().Msgf("failed to call %s, user-id: %s, model-name: %s, error: %v",
-			requestURL, userID, modelName, err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
-		return
+		logger.Error().Err(err).Int("status", res.StatusCode).Msg("failed to read the serving agent response")
+		return http.StatusInternalServerError, nil, err
 	}
 	var outputs map[string]interface{}
 	err = json.Unmarshal(body, &outputs)
 	if err != nil {
-		log.Error().Msgf("failed to call %s, user-id: %s, model-name: %s, error: %v",
-			requestURL, userID, modelName, err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
-		return
+		logger.Error().Err(err).Int("status", res.StatusCode).Msg("failed to decode the serving agent response")
+		return http.StatusInternalServerError, nil, err
 	}
 	if res.StatusCode >= 300 {
-		log.Error().Msgf("failed to call %s, user-id: %s, model-name: %s, outputs: %v",
-			requestURL, userID, modelName, outputs)
+		logger.Error().Int("status", res.StatusCode).Interface("outputs", outputs).
+			Msg("the serving agent returned an error")
 	}
-	ctx.JSON(res.StatusCode, outputs)
+	return res.StatusCode, outputs, nil
 }
 
 func (server *Server) callServingAgentStreaming(
@@ -155,9 +349,19 @@ func (server *Server) callServingAgentStreaming(
 	data []byte,
 	ctx *gin.Context,
 ) {
-	agentURL := strings.Replace(server.config.ServingAgentAddress, "{MODEL-NAME}", modelName, 1)
+	if !server.streams.add() {
+		ctx.JSON(http.StatusServiceUnavailable, errorResponse(errServerShuttingDown))
+		return
+	}
+	defer server.streams.done()
+	agentURL, release, err := server.agentURL(modelName)
+	if err != nil {
+		ctx.JSON(http.StatusServiceUnavailable, errorResponse(err))
+		return
+	}
 	requestURL, err := url.JoinPath(agentURL, path)
 	if err != nil {
+		release(nil, 0)
 		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
 		return
 	}
@@ -169,6 +373,7 @@ func (server *Server) callServingAgentStreaming(
 	w, r := ctx.Writer, ctx.Request
 	flusher, ok := w.(http.Flusher)
 	if !ok {
+		release(nil, 0)
 		http.NotFound(w, r)
 		return
 	}
@@ -178,43 +383,219 @@ func (server *Server) callServingAgentStreaming(
 	w.Header().Set("Connection", "keep-alive")
 	encoder := json.NewEncoder(w)
 
-	err = server.sendStreamingRequest(r.Context(), userID, method, requestURL, requestBody, encoder, flusher)
+	model := server.modelLabel(modelName)
+	start := time.Now()
+	chunks := 0
+	moderator := server.newStreamModerator(modelName)
+	transform := server.transform(modelName)
+	onMessage := func(m *StreamingMessage) ([]StreamingMessage, error) {
+		if chunks == 0 {
+			streamTimeToFirstChunk.WithLabelValues(model).Observe(time.Since(start).Seconds())
+		}
+		chunks++
+		recordStreamUsage(ctx, m)
+		message := transform.Message(*m)
+		// The messages are held until the moderation checked their text
+		return moderator.add(r.Context(), &message)
+	}
+	onEnd := func() ([]StreamingMessage, error) {
+		return moderator.flush(r.Context())
+	}
+	// The stream is cancelled when the server stops the streams on shutdown
+	streamCtx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-server.streams.stop:
+			cancel()
+		case <-streamCtx.Done():
+		}
+	}()
+	err = server.sendStreamingRequest(streamCtx, userID, method, requestURL, requestBody,
+		encoder, flusher, onMessage, onEnd, model)
+	release(streamEndpointError(streamCtx, err), 0)
+	streamDuration.WithLabelValues(model).Observe(time.Since(start).Seconds())
+	streamChunks.WithLabelValues(model).Observe(float64(chunks))
+	if err != nil && r.Context().Err() == nil && streamCtx.Err() != nil {
+		streamAborts.WithLabelValues(model, streamAbortShutdown).Inc()
+		requestLogger(r.Context()).Warn().Str("model", modelName).Int("chunks", chunks).
+			Msg("stopped the stream on shutdown")
+		_ = encoder.Encode(errorResponse(errServerShuttingDown))
+		flusher.Flush()
+		return
+	}
+	if err != nil {
+		streamAborts.WithLabelValues(model, streamAbortReason(err)).Inc()
+	}
+	if streamAbortReason(err) == streamAbortPolicy {
+		// The stream ends with an error event, the block is logged by the moderation
+		_ = encoder.Encode(errorResponse(err))
+		flusher.Flush()
+		return
+	}
 	if err != nil {
-		log.Error().Msgf("failed to call %s, user-id: %s, model-name: %s, error: %v",
-			requestURL, userID, modelName, err)
+		requestLogger(r.Context()).Error().Err(err).
+			Str("model", modelName).
+			Str("upstream_url", requestURL).
+			Msg("failed to stream from the serving agent")
+		_ = ctx.Error(err)
 		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
 		return
 	}
 }
 
 func (server *Server) predict(ctx *gin.Context) {
-	var req InferRequest
-	if err := ctx.ShouldBindJSON(&req); err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+	req, status, err := server.bindInferRequest(ctx)
+	if err != nil {
+		ctx.JSON(status, errorResponse(err))
+		return
+	}
+	if status, err := server.moderate(ctx.Request.Context(), req.ModelName, moderationInput, req.Inputs); err != nil {
+		ctx.JSON(status, errorResponse(err))
 		return
 	}
+	transform := server.transform(req.ModelName)
+	req.Inputs = transform.Request(req.Inputs)
 	data, err := json.Marshal(req)
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, errorResponse(err))
 		return
 	}
 	userID := ctx.Request.Header.Get("UID")
-	server.callServingAgent(userID, "POST", "v1/predict", req.ModelName, data, ctx)
+	model := server.config.Model(req.ModelName)
+	if !model.Deterministic && !model.Cache.Enabled {
+		// Predictions can only be retried safely when the agent can deduplicate them
+		retryable := ctx.GetHeader(idempotencyKeyHeader) != ""
+		server.callServingAgent(userID, "POST", "v1/predict", req.ModelName, data, retryable, transform, ctx)
+		return
+	}
+
+	key, err := inferRequestKey(req)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	cacheKey := ""
+	if model.Cache.Enabled {
+		cacheKey = predictionCacheKey(req.ModelName, userID, model.Cache.Private, key)
+		if !strings.Contains(strings.ToLower(ctx.GetHeader("Cache-Control")), "no-cache") {
+			value, found, err := server.cache.Get(ctx.Request.Context(), cacheKey)
+			if err != nil {
+				requestLogger(ctx.Request.Context()).Error().Err(err).Str("model", req.ModelName).
+					Msg("failed to read the prediction cache")
+			}
+			if found {
+				ctx.Header("X-Cache", "HIT")
+				server.writeCachedPrediction(ctx, req.ModelName, value)
+				return
+			}
+		}
+		ctx.Header("X-Cache", "MISS")
+	}
+
+	coalesceKey := key
+	if model.Cache.Private {
+		// The outputs of a private model are only shared between the requests of its user
+		coalesceKey = userID + ":" + key
+	}
+	statusCode, outputs, err := server.runPrediction(ctx, userID, req.ModelName, data, coalesceKey,
+		model.Deterministic)
+	if err != nil {
+		ctx.JSON(statusCode, errorResponse(err))
+		return
+	}
+	response := transform.Response(outputs)
+	if statusCode == http.StatusOK {
+		status, err := server.moderate(ctx.Request.Context(), req.ModelName, moderationOutput, response)
+		if err != nil {
+			// The blocked outputs are not cached, but their usage is recorded
+			recordUsage(ctx, outputs)
+			ctx.JSON(status, errorResponse(err))
+			return
+		}
+	}
+	if cacheKey != "" && statusCode == http.StatusOK {
+		if value, err := json.Marshal(response); err == nil {
+			if err = server.cache.Set(ctx.Request.Context(), cacheKey, value, model.Cache.TTL); err != nil {
+				requestLogger(ctx.Request.Context()).Error().Err(err).Str("model", req.ModelName).
+					Msg("failed to write the prediction cache")
+			}
+		}
+	}
+	recordUsage(ctx, outputs)
+	if statusCode == http.StatusOK {
+		ctx.JSON(statusCode, server.offloadOutputs(ctx.Request.Context(), req.ModelName, response))
+		return
+	}
+	ctx.JSON(statusCode, response)
+}
+
+// writeCachedPrediction writes a cached response. The cache keeps the outputs inline,
+// as the signed URLs of the offloaded outputs may expire before the cache entries.
+func (server *Server) writeCachedPrediction(ctx *gin.Context, modelName string, value []byte) {
+	if _, ok := server.offloadPolicy(modelName); ok {
+		var response interface{}
+		if err := json.Unmarshal(value, &response); err == nil {
+			ctx.JSON(http.StatusOK, server.offloadOutputs(ctx.Request.Context(), modelName, response))
+			return
+		}
+	}
+	ctx.Data(http.StatusOK, "application/json; charset=utf-8", value)
+}
+
+// runPrediction calls v1/predict of the serving agent. Identical concurrent predictions
+// of a deterministic model share one upstream call, in which case the returned outputs
+// must not be modified. The shared call is sent with the UID of the first caller, unless
+// the cache of the model is private, in which case the key holds the UID. The predictions
+// with an Idempotency-Key are not shared, so that each key reaches the agent.
+func (server *Server) runPrediction(
+	ctx *gin.Context,
+	userID string,
+	modelName string,
+	data []byte,
+	key string,
+	deterministic bool,
+) (int, map[string]interface{}, error) {
+	idempotencyKey := ctx.GetHeader(idempotencyKeyHeader)
+	// Predictions can only be retried safely when the agent can deduplicate them
+	retryable := idempotencyKey != ""
+	if !deterministic || idempotencyKey != "" {
+		return server.forwardToServingAgent(ctx.Request.Context(), userID, "POST",
+			"v1/predict", modelName, data, idempotencyKey, retryable)
+	}
+	result := server.coalescer.Do(modelName, key, func() coalescedResult {
+		// The call outlives the request that started it, but keeps its request ID and trace
+		statusCode, outputs, err := server.forwardToServingAgent(context.WithoutCancel(ctx.Request.Context()),
+			userID, "POST", "v1/predict", modelName, data, idempotencyKey, retryable)
+		return coalescedResult{statusCode: statusCode, outputs: outputs, err: err}
+	})
+	return result.statusCode, result.outputs, result.err
 }
 
 func (server *Server) asyncPredict(ctx *gin.Context) {
-	var req InferRequest
-	if err := ctx.ShouldBindJSON(&req); err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+	req, status, err := server.bindInferRequest(ctx)
+	if err != nil {
+		ctx.JSON(status, errorResponse(err))
+		return
+	}
+	if status, err := server.moderate(ctx.Request.Context(), req.ModelName, moderationInput, req.Inputs); err != nil {
+		ctx.JSON(status, errorResponse(err))
 		return
 	}
+	transform := server.transform(req.ModelName)
+	req.Inputs = transform.Request(req.Inputs)
 	data, err := json.Marshal(req)
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, errorResponse(err))
 		return
 	}
+	release := server.admit(ctx, req.ModelName)
+	if release == nil {
+		return
+	}
 	userID := ctx.Request.Header.Get("UID")
-	server.callServingAgent(userID, "POST", "async/v1/predict", req.ModelName, data, ctx)
+	server.callServingAgent(userID, "POST", "async/v1/predict", req.ModelName, data, false, transform, ctx)
+	release(ctx.Writer.Status() < 300)
 }
 
 func (server *Server) generate(ctx *gin.Context) {
@@ -223,6 +604,12 @@ func (server *Server) generate(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, errorResponse(err))
 		return
 	}
+	if status, err := server.moderate(ctx.Request.Context(), req.ModelName, moderationInput, req.Inputs); err != nil {
+		ctx.JSON(status, errorResponse(err))
+		return
+	}
+	transform := server.transform(req.ModelName)
+	req.Inputs = transform.Request(req.Inputs)
 	data, err := json.Marshal(req)
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, errorResponse(err))
@@ -234,12 +621,41 @@ func (server *Server) generate(ctx *gin.Context) {
 
 func (server *Server) getTask(ctx *gin.Context) {
 	taskID := path.Base(ctx.Request.RequestURI)
-	outputs, err := server.webhook.GetTaskInfo(taskID)
+	outputs, err := server.webhook.GetTaskInfo(ctx.Request.Context(), taskID)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
 		return
 	}
-	ctx.JSON(http.StatusOK, outputs)
+	// The tasks of other users are reported as missing, so that their IDs cannot be probed
+	if !server.ownsTask(ctx, taskID, outputs) {
+		ctx.JSON(http.StatusNotFound, errorResponse(errTaskNotFound))
+		return
+	}
+	modelName := taskModelName(outputs)
+	// The model of a task is only known from its result
+	if !server.ipAccess.AllowModel(ctx, modelName) {
+		return
+	}
+	outputs = server.transform(modelName).Task(outputs)
+	if status, err := server.moderate(ctx.Request.Context(), modelName, moderationOutput, outputs); err != nil {
+		ctx.JSON(status, errorResponse(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, server.offloadOutputs(ctx.Request.Context(), modelName, outputs))
+}
+
+var errTaskNotFound = errors.New("task not found")
+
+// ownsTask checks that a task was submitted by the user of the request, the violations are
+// audited. The tasks without an owner, e.g., of a webhook server which does not record it,
+// are served to any user.
+func (server *Server) ownsTask(ctx *gin.Context, taskID string, info interface{}) bool {
+	owner := taskOwner(info)
+	if owner == "" || owner == ctx.Request.Header.Get("UID") {
+		return true
+	}
+	server.audit.Record(ctx, auditTaskAccess, taskID, auditDenied, "the task belongs to another user")
+	return false
 }
 
 func (server *Server) getTasks(ctx *gin.Context) {
@@ -255,11 +671,22 @@ func (server *Server) getTasks(ctx *gin.Context) {
 	}
 	outputs := make([]interface{}, 0)
 	for _, taskID := range req.IDs {
-		result, err := server.webhook.GetTaskInfo(taskID)
-		if err != nil {
+		result, err := server.webhook.GetTaskInfo(ctx.Request.Context(), taskID)
+		if err != nil || !server.ownsTask(ctx, taskID, result) {
+			continue
+		}
+		// The tasks with blocked outputs, or of models denied to the client IP, are skipped
+		// like the failed ones
+		modelName := taskModelName(result)
+		if reason := server.ipAccess.modelDenial(ctx, modelName); reason != "" {
+			ipAccessDenials.WithLabelValues("model", reason).Inc()
+			continue
+		}
+		result = server.transform(modelName).Task(result)
+		if _, err := server.moderate(ctx.Request.Context(), modelName, moderationOutput, result); err != nil {
 			continue
 		}
-		outputs = append(outputs, result)
+		outputs = append(outputs, server.offloadOutputs(ctx.Request.Context(), modelName, result))
 	}
 	ctx.JSON(http.StatusOK, outputs)
 }
@@ -271,23 +698,25 @@ func (server *Server) getTaskQueueSize(ctx *gin.Context) {
 		return
 	}
 	userID := ctx.Request.Header.Get("UID")
-	server.callServingAgent(userID, "GET", "v1/queue_size", req.ModelName, nil, ctx)
+	server.callServingAgent(userID, "GET", "v1/queue_size", req.ModelName, nil, true, nil, ctx)
 }
 
 func (server *Server) pauseTaskQueue(ctx *gin.Context) {
+	defer server.audit.recordOutcome(ctx, auditQueuePause, ctx.Param("model"))
 	var req QueueRequest
 	if err := ctx.ShouldBindUri(&req); err != nil {
 		ctx.JSON(http.StatusBadRequest, errorResponse(err))
 		return
 	}
-	server.callServingAgent("", "POST", "pause", req.ModelName, nil, ctx)
+	server.callServingAgent("", "POST", "pause", req.ModelName, nil, false, nil, ctx)
 }
 
 func (server *Server) unpauseTaskQueue(ctx *gin.Context) {
+	defer server.audit.recordOutcome(ctx, auditQueueUnpause, ctx.Param("model"))
 	var req QueueRequest
 	if err := ctx.ShouldBindUri(&req); err != nil {
 		ctx.JSON(http.StatusBadRequest, errorResponse(err))
 		return
 	}
-	server.callServingAgent("", "POST", "unpause", req.ModelName, nil, ctx)
+	server.callServingAgent("", "POST", "unpause", req.ModelName, nil, false, nil, ctx)
 }
@@ -28,7 +28,7 @@ func TestGetTasks(t *testing.T) {
 			},
 			buildStubs: func(webhook *mockapi.MockWebhook) {
 				webhook.EXPECT().
-					GetTaskInfo(gomock.Any()).
+					GetTaskInfo(gomock.Any(), gomock.Any()).
 					Times(2).
 					Return(map[string]string{"outputs": "test"}, nil)
 			},
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,12 +12,15 @@ import (
 )
 
 type Webhook interface {
-	GetTaskInfo(taskID string) (interface{}, error)
+	GetTaskInfo(ctx context.Context, taskID string) (interface{}, error)
 }
 
+// InternalWebhook gets the task info from the webhook server. Its calls are retried with
+// the retry policy of the server it is passed to, so that they draw from the shared budget.
 type InternalWebhook struct {
-	config utils.Config
-	url    string
+	config      utils.Config
+	url         string
+	retryPolicy *RetryPolicy
 }
 
 func NewInternalWebhook(config utils.Config) Webhook {
@@ -27,20 +31,30 @@ func NewInternalWebhook(config utils.Config) Webhook {
 	return &webhook
 }
 
-func (webhook *InternalWebhook) GetTaskInfo(taskID string) (interface{}, error) {
+func (webhook *InternalWebhook) GetTaskInfo(ctx context.Context, taskID string) (outputs interface{}, err error) {
 	url := fmt.Sprintf("%s/%s", webhook.url, taskID)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, errors.New("failed to build request")
+	ctx, span := startUpstreamSpan(ctx, "task", "GET", url)
+	statusCode := 0
+	defer func() {
+		endUpstreamSpan(span, statusCode, err)
+	}()
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, errors.New("failed to build request")
+		}
+		req.Header.Set("apikey", webhook.config.WebhookAPIKey)
+		forwardRequestContext(ctx, req.Header)
+		return req, nil
 	}
-	req.Header.Set("apikey", webhook.config.WebhookAPIKey)
 
 	client := http.Client{Timeout: 10 * time.Second}
-	res, err := client.Do(req)
+	res, err := webhook.retryPolicy.Do(ctx, &client, "task", newRequest)
 	if err != nil {
 		return nil, errors.New("failed to get task info")
 	}
 	defer res.Body.Close()
+	statusCode = res.StatusCode
 
 	if res.StatusCode != 200 {
 		return nil, errors.New("failed to get task info")
@@ -49,7 +63,6 @@ func (webhook *InternalWebhook) GetTaskInfo(taskID string) (interface{}, error)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
-	var outputs interface{}
 	err = json.Unmarshal(body, &outputs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal data: %w", err)
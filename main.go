@@ -2,28 +2,141 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"github.com/HyperGAI/serving-api/api"
 	"github.com/HyperGAI/serving-api/utils"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
+const (
+	defaultDrainTimeout = 30 * time.Second
+	// How long the streams have to send their final event once the drain deadline passed
+	finalEventTimeout = 5 * time.Second
+	// How long the usage events have to be flushed
+	closeTimeout = 10 * time.Second
+)
+
 func main() {
 	utils.InitZerolog()
+	if len(os.Args) > 1 && os.Args[1] == "usage" {
+		runUsageReport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		runAuditVerification(os.Args[2:])
+		return
+	}
 	config, err := utils.LoadConfig(".")
 	if err != nil {
 		log.Fatal().Err(err).Msg("cannot load config")
 	}
+	var output io.Writer = os.Stderr
 	if config.Environment == "development" {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		output = zerolog.ConsoleWriter{Out: os.Stderr}
+	}
+	neverLog := make(map[string][]string)
+	for modelName, model := range config.Models {
+		neverLog[modelName] = model.NeverLog
+	}
+	redactor := utils.NewRedactor(utils.RedactionOptions{
+		Enabled:        config.LogRedactionEnabled(),
+		Paths:          config.LogRedactPaths,
+		MaxValueLength: config.LogMaxValueLength,
+		ModelFields:    neverLog,
+	})
+	if redactor.Active() {
+		output = utils.NewRedactingWriter(output, redactor)
+	}
+	log.Logger = log.Output(output)
+	shutdownTracing, err := utils.InitTracing(config)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot initialize tracing")
 	}
 	webhook := api.NewInternalWebhook(config)
 	runGinServer(config, webhook)
+	if err := shutdownTracing(context.Background()); err != nil {
+		log.Error().Err(err).Msg("cannot flush the spans")
+	}
+}
+
+// runUsageReport prints the per-user and per-model summaries of the usage JSONL files.
+func runUsageReport(args []string) {
+	flags := flag.NewFlagSet("usage", flag.ExitOnError)
+	dir := flags.String("dir", "usage", "the directory of the usage files, if no file is given")
+	format := flags.String("format", "table", "the output format: table or json")
+	since := flags.String("since", "", "skip the events before this date (2006-01-02 or RFC 3339)")
+	until := flags.String("until", "", "skip the events from this date (2006-01-02 or RFC 3339)")
+	_ = flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths, _ = filepath.Glob(filepath.Join(*dir, "*.jsonl"))
+	}
+	sinceTime, err := parseReportTime(*since)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid since")
+	}
+	untilTime, err := parseReportTime(*until)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid until")
+	}
+	summaries, err := api.SummarizeUsage(paths, sinceTime, untilTime)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot summarize usage")
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(summaries)
+		return
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "UID\tMODEL\tREQUESTS\tERRORS\tINPUT BYTES\tOUTPUT BYTES\tCHUNKS\tCOST\tAVG LATENCY (MS)")
+	for _, s := range summaries {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%g\t%.1f\n", s.UserID, s.Model, s.Requests,
+			s.Errors, s.InputBytes, s.OutputBytes, s.StreamChunks, s.Cost, s.AvgLatencyMs)
+	}
+	_ = writer.Flush()
+}
+
+// runAuditVerification checks the hash chain of the audit files, it exits with 1 if the chain is broken.
+func runAuditVerification(args []string) {
+	flags := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	dir := flags.String("dir", "audit", "the directory of the audit files, if no file is given")
+	key := flags.String("key", os.Getenv("AUDIT_HASH_KEY"), "the hash key of the audit log")
+	_ = flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths, _ = filepath.Glob(filepath.Join(*dir, "*.jsonl"))
+	}
+	n, err := api.VerifyAuditLog(*key, paths)
+	if err != nil {
+		log.Fatal().Err(err).Int("verified", n).Msg("the audit log was tampered with")
+	}
+	fmt.Printf("verified %d audit events\n", n)
+}
+
+func parseReportTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
 }
 
 func runGinServer(
@@ -51,20 +164,43 @@ func runGinServer(
 	}()
 
 	// https://gin-gonic.com/docs/examples/graceful-restart-or-stop/
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
-	log.Info().Msg("Shutdown Server ...")
+	drainServer(config, server, httpServer)
+	log.Info().Msg("server exiting")
+}
+
+// drainServer shuts the server down without cutting the in-flight requests: /ready fails
+// so that the load balancer deregisters the pod, then the server stops accepting requests
+// and waits for the in-flight ones. The streams still running at the deadline are ended
+// with a final event.
+func drainServer(config utils.Config, server *api.Server, httpServer *http.Server) {
+	log.Info().Dur("deregister_delay", config.ShutdownDeregisterDelay).
+		Dur("drain_timeout", config.ShutdownDrainTimeout).Msg("draining the server")
+	server.StartDraining()
+	httpServer.SetKeepAlivesEnabled(false)
+	time.Sleep(config.ShutdownDeregisterDelay)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	drainTimeout := config.ShutdownDrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
 	defer cancel()
 	if err := httpServer.Shutdown(ctx); err != nil {
-		log.Fatal().Err(err).Msg("server shutdown")
+		log.Warn().Err(err).Msg("in-flight requests remain after the drain deadline")
+		streamCtx, cancelStreams := context.WithTimeout(context.Background(), finalEventTimeout)
+		if err := server.StopStreams(streamCtx); err != nil {
+			log.Error().Err(err).Msg("cannot end the in-flight streams")
+		}
+		cancelStreams()
+		_ = httpServer.Close()
 	}
-	// catching ctx.Done(). timeout of 5 seconds.
-	select {
-	case <-ctx.Done():
-		log.Info().Msg("timeout of 5 seconds")
+
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancelClose()
+	if err := server.Close(closeCtx); err != nil {
+		log.Error().Err(err).Msg("cannot close the server")
 	}
-	log.Info().Msg("server exiting")
 }
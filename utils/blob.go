@@ -0,0 +1,342 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const BlobStoreFile = "file"
+
+var (
+	ErrBlobNotFound     = errors.New("blob not found")
+	ErrInvalidBlobKey   = errors.New("invalid blob key")
+	ErrInvalidSignature = errors.New("invalid or expired signature")
+)
+
+// BlobInfo describes a stored object.
+type BlobInfo struct {
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+	// The object may be deleted after this time
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// BlobStore stores the files of the requests and the responses, e.g., images.
+// Keys are slash-separated paths.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data io.Reader, info BlobInfo) error
+	Get(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error)
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	// Extend moves the expiry of an object, without rewriting its data
+	Extend(ctx context.Context, key string, expiresAt time.Time) error
+	Delete(ctx context.Context, key string) error
+	// Walk calls fn with every object, until fn returns an error
+	Walk(ctx context.Context, fn func(key string, info BlobInfo) error) error
+}
+
+// NewBlobStore creates a blob store of a kind.
+func NewBlobStore(kind string, dir string) (BlobStore, error) {
+	switch kind {
+	case BlobStoreFile:
+		return NewFileBlobStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown blob store %q", kind)
+	}
+}
+
+// FileBlobStore stores the objects in a directory, with their info in a ".meta" file.
+type FileBlobStore struct {
+	dir string
+}
+
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+// path returns the file of a key, the keys cannot escape the directory.
+func (store *FileBlobStore) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if key == "" || cleaned == "/" || cleaned != "/"+key || strings.HasSuffix(key, ".meta") {
+		return "", ErrInvalidBlobKey
+	}
+	return filepath.Join(store.dir, filepath.FromSlash(cleaned)), nil
+}
+
+func (store *FileBlobStore) Put(ctx context.Context, key string, data io.Reader, info BlobInfo) error {
+	filePath, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that readers never see a partial object
+	file, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	info.Size, err = io.Copy(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if info.CreatedAt.IsZero() {
+		info.CreatedAt = time.Now().UTC()
+	}
+	meta, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filePath+".meta", meta, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filePath)
+}
+
+func (store *FileBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error) {
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		return nil, info, err
+	}
+	filePath, err := store.path(key)
+	if err != nil {
+		return nil, info, err
+	}
+	file, err := os.Open(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, info, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, info, err
+	}
+	return file, info, nil
+}
+
+func (store *FileBlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	var info BlobInfo
+	filePath, err := store.path(key)
+	if err != nil {
+		return info, err
+	}
+	meta, err := os.ReadFile(filePath + ".meta")
+	if errors.Is(err, os.ErrNotExist) {
+		return info, ErrBlobNotFound
+	}
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(meta, &info)
+	return info, err
+}
+
+func (store *FileBlobStore) Extend(ctx context.Context, key string, expiresAt time.Time) error {
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	filePath, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	info.ExpiresAt = expiresAt
+	meta, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	// Replace the info at once, so that the collector never reads a partial one
+	file, err := os.CreateTemp(filepath.Dir(filePath), ".meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(meta)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filePath+".meta")
+}
+
+func (store *FileBlobStore) Delete(ctx context.Context, key string) error {
+	filePath, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filePath)
+	if metaErr := os.Remove(filePath + ".meta"); err == nil || errors.Is(err, os.ErrNotExist) {
+		err = metaErr
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	// Remove the directories left empty, it fails on the others
+	for dir := filepath.Dir(filePath); dir != filepath.Clean(store.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (store *FileBlobStore) Walk(ctx context.Context, fn func(key string, info BlobInfo) error) error {
+	return filepath.WalkDir(store.dir, func(filePath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(filePath, ".meta") {
+			return nil
+		}
+		meta, err := os.ReadFile(filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			// Deleted during the walk
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var info BlobInfo
+		if err := json.Unmarshal(meta, &info); err != nil {
+			return fmt.Errorf("invalid blob info %s: %w", filePath, err)
+		}
+		rel, err := filepath.Rel(store.dir, strings.TrimSuffix(filePath, ".meta"))
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), info)
+	})
+}
+
+// CollectExpiredBlobs deletes the objects which expired before now, it returns their number.
+func CollectExpiredBlobs(ctx context.Context, store BlobStore, now time.Time) (int, error) {
+	var expired []string
+	err := store.Walk(ctx, func(key string, info BlobInfo) error {
+		if !info.ExpiresAt.IsZero() && info.ExpiresAt.Before(now) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	deleted := 0
+	for _, key := range expired {
+		if deleteErr := store.Delete(ctx, key); deleteErr != nil {
+			err = errors.Join(err, deleteErr)
+			continue
+		}
+		deleted++
+	}
+	return deleted, err
+}
+
+// BlobCollector deletes the expired objects of a blob store on an interval.
+type BlobCollector struct {
+	store    BlobStore
+	interval time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewBlobCollector(store BlobStore, interval time.Duration) *BlobCollector {
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	return &BlobCollector{store: store, interval: interval, stop: make(chan struct{})}
+}
+
+func (collector *BlobCollector) Start() {
+	go func() {
+		ticker := time.NewTicker(collector.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-collector.stop:
+				return
+			case <-ticker.C:
+				collector.collect()
+			}
+		}
+	}()
+}
+
+func (collector *BlobCollector) Stop() {
+	collector.stopOnce.Do(func() {
+		close(collector.stop)
+	})
+}
+
+func (collector *BlobCollector) collect() {
+	deleted, err := CollectExpiredBlobs(context.Background(), collector.store, time.Now())
+	if err != nil {
+		log.Error().Err(err).Int("deleted", deleted).Msg("failed to collect the expired blobs")
+		return
+	}
+	if deleted > 0 {
+		log.Info().Int("deleted", deleted).Msg("collected the expired blobs")
+	}
+}
+
+// BlobSigner builds the time-limited download URLs of the blobs served by the gateway.
+type BlobSigner struct {
+	key     []byte
+	baseURL string
+}
+
+// NewBlobSigner creates a signer of the URLs under a base URL, e.g., "https://api.example.com/blobs".
+func NewBlobSigner(key string, baseURL string) *BlobSigner {
+	return &BlobSigner{key: []byte(key), baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func (signer *BlobSigner) signature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, signer.key)
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns the download URL of a blob, valid until the expiration time.
+func (signer *BlobSigner) URL(key string, expiresAt time.Time) string {
+	expires := expiresAt.Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", signer.signature(key, expires))
+	return signer.baseURL + "/" + key + "?" + query.Encode()
+}
+
+// Verify checks the signature and the expiration time of a download URL.
+func (signer *BlobSigner) Verify(key string, expires string, signature string, now time.Time) error {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > expiresAt {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(signer.signature(key, expiresAt))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
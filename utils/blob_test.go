@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	store, err := NewFileBlobStore(t.TempDir())
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, store.Put(ctx, "uploads/1/image.png", strings.NewReader("data"),
+		BlobInfo{ContentType: "image/png"}))
+	reader, info, err := store.Get(ctx, "uploads/1/image.png")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, "data", string(data))
+	require.Equal(t, "image/png", info.ContentType)
+	require.Equal(t, int64(4), info.Size)
+	require.False(t, info.CreatedAt.IsZero())
+
+	expiresAt := time.Now().Add(time.Hour).UTC()
+	require.NoError(t, store.Extend(ctx, "uploads/1/image.png", expiresAt))
+	extended, err := store.Stat(ctx, "uploads/1/image.png")
+	require.NoError(t, err)
+	require.True(t, expiresAt.Equal(extended.ExpiresAt))
+	require.Equal(t, info.CreatedAt, extended.CreatedAt)
+	require.Equal(t, int64(4), extended.Size)
+	require.ErrorIs(t, store.Extend(ctx, "uploads/2/image.png", expiresAt), ErrBlobNotFound)
+
+	require.NoError(t, store.Delete(ctx, "uploads/1/image.png"))
+	_, _, err = store.Get(ctx, "uploads/1/image.png")
+	require.ErrorIs(t, err, ErrBlobNotFound)
+	require.NoError(t, store.Delete(ctx, "uploads/1/image.png"))
+
+	for _, key := range []string{"", "/", "../secret", "uploads/../../secret", "/uploads/1", "uploads//1", "a.meta"} {
+		_, _, err = store.Get(ctx, key)
+		require.ErrorIs(t, err, ErrInvalidBlobKey, key)
+	}
+}
+
+func TestBlobSigner(t *testing.T) {
+	signer := NewBlobSigner("key", "https://api.example.com/blobs/")
+	now := time.Now()
+	signed, err := url.Parse(signer.URL("uploads/1/image.png", now.Add(time.Minute)))
+	require.NoError(t, err)
+	require.Equal(t, "/blobs/uploads/1/image.png", signed.Path)
+	expires, signature := signed.Query().Get("expires"), signed.Query().Get("signature")
+
+	require.NoError(t, signer.Verify("uploads/1/image.png", expires, signature, now))
+	require.ErrorIs(t, signer.Verify("uploads/1/image.png", expires, signature, now.Add(2*time.Minute)),
+		ErrInvalidSignature)
+	require.ErrorIs(t, signer.Verify("uploads/2/image.png", expires, signature, now), ErrInvalidSignature)
+	require.ErrorIs(t, NewBlobSigner("other", "").Verify("uploads/1/image.png", expires, signature, now),
+		ErrInvalidSignature)
+	require.ErrorIs(t, signer.Verify("uploads/1/image.png", "soon", signature, now), ErrInvalidSignature)
+}
+
+func TestCollectExpiredBlobs(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileBlobStore(dir)
+	require.NoError(t, err)
+	ctx := context.Background()
+	now := time.Now()
+	blobs := map[string]time.Time{
+		"outputs/expired":   now.Add(-time.Minute),
+		"uploads/1/expired": now.Add(-time.Second),
+		"uploads/2/live":    now.Add(time.Minute),
+		"forever":           {},
+	}
+	for key, expiresAt := range blobs {
+		require.NoError(t, store.Put(ctx, key, strings.NewReader(key), BlobInfo{ExpiresAt: expiresAt}))
+	}
+
+	deleted, err := CollectExpiredBlobs(ctx, store, now)
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+	var keys []string
+	require.NoError(t, store.Walk(ctx, func(key string, info BlobInfo) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	require.ElementsMatch(t, []string{"uploads/2/live", "forever"}, keys)
+	// The directories left empty are removed
+	_, err = os.Stat(filepath.Join(dir, "uploads", "1"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIPResolver finds the IP of a client behind reverse proxies. The forwarding headers
+// are only trusted if the request comes from a trusted proxy, so that clients cannot spoof them.
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+	// The number of proxies in front of the gateway, the client is that many entries before the
+	// end of the X-Forwarded-For chain followed by the remote address. If 0, the trusted IPs are
+	// skipped from the end of the chain instead.
+	hops    int
+	headers []string
+}
+
+func NewClientIPResolver(trustedProxies []string, hops int, headers []string) (*ClientIPResolver, error) {
+	resolver := &ClientIPResolver{hops: hops}
+	trusted, err := ParseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	resolver.trusted = trusted
+	for _, header := range headers {
+		if header = strings.TrimSpace(header); header != "" {
+			resolver.headers = append(resolver.headers, http.CanonicalHeaderKey(header))
+		}
+	}
+	return resolver, nil
+}
+
+// ParseCIDRs parses a list of CIDRs, where a single IP is a network of one address.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ContainsIP returns if any of the networks contains an IP.
+func ContainsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (resolver *ClientIPResolver) isTrusted(ip net.IP) bool {
+	return ContainsIP(resolver.trusted, ip)
+}
+
+// Resolve returns the IP of the client of a request, from the first configured header set by
+// a trusted proxy, or the remote address of the connection.
+func (resolver *ClientIPResolver) Resolve(remoteAddr string, header http.Header) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	remoteIP := net.ParseIP(host)
+	if remoteIP == nil || !resolver.isTrusted(remoteIP) {
+		return host
+	}
+	for _, name := range resolver.headers {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		if name == "X-Forwarded-For" {
+			if ip := resolver.forwardedFor(remoteIP, header.Values(name)); ip != nil {
+				return ip.String()
+			}
+			continue
+		}
+		if ip := net.ParseIP(strings.TrimSpace(value)); ip != nil {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+// forwardedFor walks the X-Forwarded-For chain from the right, where the proxies append the
+// address they received the request from.
+func (resolver *ClientIPResolver) forwardedFor(remoteIP net.IP, values []string) net.IP {
+	var chain []net.IP
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			ip := net.ParseIP(strings.TrimSpace(entry))
+			if ip == nil {
+				// An invalid entry ends the chain that can be trusted
+				chain = nil
+				continue
+			}
+			chain = append(chain, ip)
+		}
+	}
+	chain = append(chain, remoteIP)
+
+	if resolver.hops > 0 {
+		// The client is the entry before the addresses appended by the trusted proxies
+		if resolver.hops >= len(chain) {
+			return nil
+		}
+		return chain[len(chain)-1-resolver.hops]
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !resolver.isTrusted(chain[i]) {
+			return chain[i]
+		}
+	}
+	return chain[0]
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	headers := []string{"X-Forwarded-For", "X-Real-IP", "CF-Connecting-IP"}
+
+	testCases := []struct {
+		name       string
+		trusted    []string
+		hops       int
+		headers    []string
+		remoteAddr string
+		header     map[string]string
+		expectedIP string
+	}{
+		{
+			name:       "UntrustedRemote",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "1.2.3.4:1234",
+			header:     map[string]string{"X-Forwarded-For": "5.6.7.8"},
+			expectedIP: "1.2.3.4",
+		},
+		{
+			name:       "SkipTrustedProxies",
+			trusted:    []string{"10.0.0.0/8", "35.1.1.1"},
+			remoteAddr: "10.0.0.2:1234",
+			header:     map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 35.1.1.1"},
+			expectedIP: "5.6.7.8",
+		},
+		{
+			name:       "Hops",
+			trusted:    []string{"10.0.0.0/8"},
+			hops:       2,
+			remoteAddr: "10.0.0.2:1234",
+			header:     map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 35.1.1.1"},
+			expectedIP: "5.6.7.8",
+		},
+		{
+			name:       "TooManyHops",
+			trusted:    []string{"10.0.0.0/8"},
+			hops:       3,
+			remoteAddr: "10.0.0.2:1234",
+			header:     map[string]string{"X-Forwarded-For": "5.6.7.8"},
+			expectedIP: "10.0.0.2",
+		},
+		{
+			name:       "RealIP",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.2:1234",
+			header:     map[string]string{"X-Real-IP": "5.6.7.8"},
+			expectedIP: "5.6.7.8",
+		},
+		{
+			name:       "HeaderPrecedence",
+			trusted:    []string{"10.0.0.0/8"},
+			headers:    []string{"CF-Connecting-IP", "X-Forwarded-For"},
+			remoteAddr: "10.0.0.2:1234",
+			header:     map[string]string{"X-Forwarded-For": "5.6.7.8", "CF-Connecting-IP": "2001:db8::1"},
+			expectedIP: "2001:db8::1",
+		},
+		{
+			name:       "InvalidHeader",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.2:1234",
+			header:     map[string]string{"X-Real-IP": "unknown"},
+			expectedIP: "10.0.0.2",
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.headers == nil {
+				tc.headers = headers
+			}
+			resolver, err := NewClientIPResolver(tc.trusted, tc.hops, tc.headers)
+			require.NoError(t, err)
+			header := http.Header{}
+			for name, value := range tc.header {
+				header.Set(name, value)
+			}
+			require.Equal(t, tc.expectedIP, resolver.Resolve(tc.remoteAddr, header))
+		})
+	}
+
+	_, err := NewClientIPResolver([]string{"10.0.0.0/33"}, 0, headers)
+	require.Error(t, err)
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"github.com/spf13/viper"
+	"time"
 )
 
 // Config stores all configuration of the application.
@@ -12,11 +13,132 @@ type Config struct {
 	ServingAgentAddress  string `mapstructure:"SERVING_AGENT_ADDRESS"`
 	WebhookServerAddress string `mapstructure:"WEBHOOK_SERVER_ADDRESS"`
 	WebhookAPIKey        string `mapstructure:"WEBHOOK_APIKEY"`
+	// The CIDRs of the trusted proxies, the headers they set the client IP in, in order of
+	// precedence, and the number of proxies in front of the gateway (0 to skip the trusted IPs)
+	TrustedProxies   []string `mapstructure:"TRUSTED_PROXIES"`
+	ClientIPHeaders  []string `mapstructure:"CLIENT_IP_HEADERS"`
+	TrustedProxyHops int      `mapstructure:"TRUSTED_PROXY_HOPS"`
+	// The IP allow and deny lists, reloaded when the file changes, and the MaxMind database of the country rules
+	IPAccessConfigFile     string        `mapstructure:"IP_ACCESS_CONFIG_FILE"`
+	GeoIPDatabase          string        `mapstructure:"GEOIP_DATABASE"`
+	IPAccessReloadInterval time.Duration `mapstructure:"IP_ACCESS_RELOAD_INTERVAL"`
 	// For rate limiter
 	RedisAddress       string `mapstructure:"REDIS_ADDRESS"`
 	FormattedRateSync  string `mapstructure:"FORMATTED_RATE_SYNC"`
 	FormattedRateAsync string `mapstructure:"FORMATTED_RATE_ASYNC"`
 	FormattedRateTask  string `mapstructure:"FORMATTED_RATE_TASK"`
+	// The limit by client IP of the unauthenticated routes
+	FormattedRateIP string `mapstructure:"FORMATTED_RATE_IP"`
+	// Behavior while Redis is unavailable: "memory", "open" or "closed". The check
+	// interval applies to the availability of Redis for all the features using it.
+	RateLimitFailureMode   string        `mapstructure:"RATE_LIMIT_FAILURE_MODE"`
+	RateLimitReplicas      int           `mapstructure:"RATE_LIMIT_REPLICAS"`
+	RateLimitCheckInterval time.Duration `mapstructure:"RATE_LIMIT_CHECK_INTERVAL"`
+	// How often the replicas reload the overrides of the users set by the admin API
+	OverridePollInterval time.Duration `mapstructure:"OVERRIDE_POLL_INTERVAL"`
+	// Per-plan and per-model rate limits, the rates above are the defaults
+	RateLimitConfigFile string          `mapstructure:"RATE_LIMIT_CONFIG_FILE"`
+	RateLimits          RateLimitConfig `mapstructure:"-"`
+	// For retrying idempotent upstream calls
+	RetryMaxAttempts    int           `mapstructure:"RETRY_MAX_ATTEMPTS"`
+	RetryInitialBackoff time.Duration `mapstructure:"RETRY_INITIAL_BACKOFF"`
+	RetryMaxBackoff     time.Duration `mapstructure:"RETRY_MAX_BACKOFF"`
+	RetryBudgetRatio    float64       `mapstructure:"RETRY_BUDGET_RATIO"`
+	RetryBudgetMinRetry int           `mapstructure:"RETRY_BUDGET_MIN_RETRY"`
+	// For the prediction cache
+	CacheBackend    string `mapstructure:"CACHE_BACKEND"`
+	CacheMemorySize int    `mapstructure:"CACHE_MEMORY_SIZE"`
+	// Plans whose users pay with prepaid credits, separated by commas
+	CreditPlans []string `mapstructure:"CREDIT_PLANS"`
+	// For the admin endpoints, which are disabled if empty
+	AdminAPIKey string `mapstructure:"ADMIN_API_KEY"`
+	// For usage metering, disabled if the sink is empty: "file", "stdout" or "http"
+	UsageSink          string        `mapstructure:"USAGE_SINK"`
+	UsageDir           string        `mapstructure:"USAGE_DIR"`
+	UsageMaxFileSize   int64         `mapstructure:"USAGE_MAX_FILE_SIZE"`
+	UsageHTTPURL       string        `mapstructure:"USAGE_HTTP_URL"`
+	UsageSpoolDir      string        `mapstructure:"USAGE_SPOOL_DIR"`
+	UsageFlushInterval time.Duration `mapstructure:"USAGE_FLUSH_INTERVAL"`
+	// For the audit log, disabled if the sink is empty: "file", "stdout" or "http". The events
+	// are written synchronously, and their hash chain is keyed with the secret hash key
+	AuditSink        string `mapstructure:"AUDIT_SINK"`
+	AuditDir         string `mapstructure:"AUDIT_DIR"`
+	AuditMaxFileSize int64  `mapstructure:"AUDIT_MAX_FILE_SIZE"`
+	AuditHTTPURL     string `mapstructure:"AUDIT_HTTP_URL"`
+	AuditHashKey     string `mapstructure:"AUDIT_HASH_KEY"`
+	// Redaction of the logs: "on", "off" or "auto", which is on unless in development. The
+	// fields at the paths, e.g., "outputs.token", are masked and the long values truncated
+	LogRedaction      string   `mapstructure:"LOG_REDACTION"`
+	LogRedactPaths    []string `mapstructure:"LOG_REDACT_PATHS"`
+	LogMaxValueLength int      `mapstructure:"LOG_MAX_VALUE_LENGTH"`
+	// The maximum size of the request bodies, including the uploaded files
+	MaxRequestBodySize int64 `mapstructure:"MAX_REQUEST_BODY_SIZE"`
+	// For the blob store of the files, disabled if empty: "file". The blobs are downloaded
+	// from the gateway with URLs under the base URL, signed with the key and valid for the URL TTL.
+	// The blobs may be deleted after the blob TTL.
+	BlobStore      string        `mapstructure:"BLOB_STORE"`
+	BlobDir        string        `mapstructure:"BLOB_DIR"`
+	BlobSigningKey string        `mapstructure:"BLOB_SIGNING_KEY"`
+	BlobBaseURL    string        `mapstructure:"BLOB_BASE_URL"`
+	BlobURLTTL     time.Duration `mapstructure:"BLOB_URL_TTL"`
+	BlobTTL        time.Duration `mapstructure:"BLOB_TTL"`
+	// How often the expired blobs are deleted
+	BlobGCInterval time.Duration `mapstructure:"BLOB_GC_INTERVAL"`
+	// The string outputs longer than this are moved to the blob store, disabled if 0
+	OutputOffloadThreshold int `mapstructure:"OUTPUT_OFFLOAD_THRESHOLD"`
+	// For the moderation, disabled if empty: the plugins run in this order, "keywords",
+	// "patterns" or "classifier". The plugins not set in the policy of a model take the
+	// default action, and the requests fail with 503 when a plugin fails unless it fails open.
+	ModerationPlugins       []string `mapstructure:"MODERATION_PLUGINS"`
+	ModerationDefaultAction string   `mapstructure:"MODERATION_DEFAULT_ACTION"`
+	ModerationFailOpen      bool     `mapstructure:"MODERATION_FAIL_OPEN"`
+	// The words of the keywords plugin, and the file of the regular expressions of the
+	// patterns plugin, one per line
+	ModerationKeywords     []string `mapstructure:"MODERATION_KEYWORDS"`
+	ModerationPatternsFile string   `mapstructure:"MODERATION_PATTERNS_FILE"`
+	// The endpoint of the classifier plugin
+	ModerationClassifierURL     string        `mapstructure:"MODERATION_CLASSIFIER_URL"`
+	ModerationClassifierTimeout time.Duration `mapstructure:"MODERATION_CLASSIFIER_TIMEOUT"`
+	// The streamed outputs are checked every this number of characters, every message if 0.
+	// The messages are held until checked.
+	ModerationStreamInterval int `mapstructure:"MODERATION_STREAM_INTERVAL"`
+	// For tracing, disabled if the exporter is empty: "otlp" or "stdout"
+	TracingExporter     string  `mapstructure:"TRACING_EXPORTER"`
+	TracingOTLPEndpoint string  `mapstructure:"TRACING_OTLP_ENDPOINT"`
+	TracingOTLPInsecure bool    `mapstructure:"TRACING_OTLP_INSECURE"`
+	TracingServiceName  string  `mapstructure:"TRACING_SERVICE_NAME"`
+	TracingSampleRatio  float64 `mapstructure:"TRACING_SAMPLE_RATIO"`
+	// For /ready, the timeout of the dependency checks, how long their report is cached,
+	// and whether each model with a health check needs a healthy serving agent
+	ReadinessTimeout     time.Duration `mapstructure:"READINESS_TIMEOUT"`
+	ReadinessCacheTTL    time.Duration `mapstructure:"READINESS_CACHE_TTL"`
+	ReadinessCheckAgents bool          `mapstructure:"READINESS_CHECK_AGENTS"`
+	// On shutdown, how long /ready fails before the server stops accepting requests, so that
+	// the load balancer deregisters it, and how long the in-flight requests and streams have to finish
+	ShutdownDeregisterDelay time.Duration `mapstructure:"SHUTDOWN_DEREGISTER_DELAY"`
+	ShutdownDrainTimeout    time.Duration `mapstructure:"SHUTDOWN_DRAIN_TIMEOUT"`
+	// The buckets of the latency histograms in seconds, separated by commas
+	MetricsLatencyBuckets []float64 `mapstructure:"METRICS_LATENCY_BUCKETS"`
+	// Per-model settings
+	ModelConfigFile string                 `mapstructure:"MODEL_CONFIG_FILE"`
+	Models          map[string]ModelConfig `mapstructure:"-"`
+}
+
+// LogRedactionEnabled tells whether the logs are redacted.
+func (config Config) LogRedactionEnabled() bool {
+	switch config.LogRedaction {
+	case LogRedactionOn:
+		return true
+	case LogRedactionOff:
+		return false
+	default:
+		return config.Environment != "development"
+	}
+}
+
+// Model returns the settings of a model, or the zero value if it has none.
+func (config Config) Model(modelName string) ModelConfig {
+	return config.Models[modelName]
 }
 
 // LoadConfig reads configuration from file or environment variables.
@@ -32,5 +154,17 @@ func LoadConfig(path string) (config Config, err error) {
 	}
 
 	err = viper.Unmarshal(&config)
+	if err != nil {
+		return
+	}
+	if config.ModelConfigFile != "" {
+		config.Models, err = LoadModelConfig(config.ModelConfigFile)
+		if err != nil {
+			return
+		}
+	}
+	if config.RateLimitConfigFile != "" {
+		config.RateLimits, err = LoadRateLimitConfig(config.RateLimitConfigFile)
+	}
 	return
 }
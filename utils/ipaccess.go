@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"gopkg.in/yaml.v3"
+	"os"
+)
+
+// IPAccessConfig stores the IP allow and deny lists, globally and per model.
+// The values are read from the YAML file given by IP_ACCESS_CONFIG_FILE,
+// see ipaccess.example.yaml for a documented example.
+type IPAccessConfig struct {
+	IPRules `yaml:",inline"`
+	Models  map[string]IPRules `yaml:"models"`
+}
+
+// IPRules are the CIDRs and the countries (ISO 3166-1 alpha-2 codes) allowed or denied.
+// A deny rule wins over an allow rule, and a non-empty allow list denies everything else.
+type IPRules struct {
+	Allow          []string `yaml:"allow"`
+	Deny           []string `yaml:"deny"`
+	AllowCountries []string `yaml:"allow_countries"`
+	DenyCountries  []string `yaml:"deny_countries"`
+}
+
+// LoadIPAccessConfig reads the IP allow and deny lists from a YAML file.
+func LoadIPAccessConfig(path string) (IPAccessConfig, error) {
+	var config IPAccessConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = yaml.Unmarshal(data, &config)
+	return config, err
+}
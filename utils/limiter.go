@@ -2,44 +2,39 @@ package utils
 
 import (
 	"github.com/gin-gonic/gin"
-	"github.com/rs/zerolog/log"
 	"github.com/ulule/limiter/v3"
 	mgin "github.com/ulule/limiter/v3/drivers/middleware/gin"
-	sredis "github.com/ulule/limiter/v3/drivers/store/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"strconv"
-	"strings"
 )
 
+const tracerName = "github.com/HyperGAI/serving-api/utils"
+
 type Middleware struct {
-	Limiter        *limiter.Limiter
+	Limiter *limiter.Limiter
+	// LimiterGetter selects the limiter of a request, it overrides Limiter if set
+	LimiterGetter  func(c *gin.Context) *limiter.Limiter
 	OnError        mgin.ErrorHandler
 	OnLimitReached mgin.LimitReachedHandler
 	KeyGetter      mgin.KeyGetter
-	ExcludedKey    func(string) bool
-}
-
-func NewMiddleware(limiter *limiter.Limiter) gin.HandlerFunc {
-	middleware := &Middleware{
-		Limiter:        limiter,
-		OnError:        mgin.DefaultErrorHandler,
-		OnLimitReached: mgin.DefaultLimitReachedHandler,
-		KeyGetter:      DefaultKeyGetter(limiter),
-		ExcludedKey:    nil,
-	}
-	return func(ctx *gin.Context) {
-		middleware.Handle(ctx)
-	}
 }
 
 // Handle gin request.
 func (middleware *Middleware) Handle(c *gin.Context) {
 	key := middleware.KeyGetter(c)
-	if middleware.ExcludedKey != nil && middleware.ExcludedKey(key) {
-		c.Next()
-		return
+	rateLimiter := middleware.Limiter
+	if middleware.LimiterGetter != nil {
+		rateLimiter = middleware.LimiterGetter(c)
 	}
-
-	context, err := middleware.Limiter.Get(c, key)
+	_, span := otel.Tracer(tracerName).Start(c.Request.Context(), "rate_limit")
+	context, err := rateLimiter.Get(c, key)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.SetAttributes(attribute.Bool("rate_limit.reached", err == nil && context.Reached))
+	span.End()
 	if err != nil {
 		middleware.OnError(c, err)
 		c.Abort()
@@ -57,88 +52,3 @@ func (middleware *Middleware) Handle(c *gin.Context) {
 	}
 	c.Next()
 }
-
-// DefaultKeyGetter is the default KeyGetter used by a new Middleware.
-// It returns the Client IP address.
-func DefaultKeyGetter(limiter *limiter.Limiter) func(c *gin.Context) string {
-	return func(c *gin.Context) string {
-		key := c.GetHeader(limiter.Options.ClientIPHeader)
-		if key != "" {
-			return key
-		}
-		return c.ClientIP()
-	}
-}
-
-func NewRateLimiterMiddleware(
-	formattedRate string,
-	redisAddress string,
-	prefix string,
-	clientHeader string,
-) (gin.HandlerFunc, error) {
-	// See: https://github.com/ulule/limiter-examples/blob/master/gin/main.go
-	// Use the simplified format "<limit>-<period>"", with the given
-	// periods:
-	// * "S": second
-	// * "M": minute
-	// * "H": hour
-	// * "D": day
-	//
-	// Examples:
-	// * 5 reqs/second: "5-S"
-	// * 10 reqs/minute: "10-M"
-	// * 1000 reqs/hour: "1000-H"
-	// * 2000 reqs/day: "2000-D"
-	//
-	// Usage:
-	// router := gin.Default()
-	// router.ForwardedByClientIP = true
-	// router.Use(middleware)
-	// router.GET("/", index)
-
-	// Define a limit rate
-	rate, err := limiter.NewRateFromFormatted(formattedRate)
-	if err != nil {
-		return nil, err
-	}
-
-	// Create a redis client
-	client, err := NewRedisClient(redisAddress)
-	if err != nil {
-		return nil, err
-	}
-
-	// Create a store with the redis client.
-	store, err := sredis.NewStoreWithOptions(client, limiter.StoreOptions{
-		Prefix: prefix,
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	// Create a new middleware with the limiter instance.
-	if clientHeader == "" {
-		middleware := NewMiddleware(limiter.New(store, rate))
-		return middleware, nil
-	} else {
-		middleware := NewMiddleware(limiter.New(store, rate, limiter.WithClientIPHeader(clientHeader)))
-		return middleware, nil
-	}
-}
-
-func GetTrueClientIP(c *gin.Context) string {
-	// Get client IP from X-Forwarded-For
-	// https://cloud.google.com/load-balancing/docs/https#x-forwarded-for_header
-	forwardedFor := c.GetHeader("X-Forwarded-For")
-	if forwardedFor == "" {
-		return c.ClientIP()
-	}
-	IPs := strings.Split(forwardedFor, ",")
-	numIPs := len(IPs)
-	if numIPs < 2 {
-		log.Warn().Msgf("less than two IPs in X-Forwarded-For: %v", IPs)
-		return c.ClientIP()
-	}
-	clientIP := strings.TrimSpace(IPs[numIPs-2])
-	return clientIP
-}
@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"github.com/ulule/limiter/v3"
+	smemory "github.com/ulule/limiter/v3/drivers/store/memory"
+	sredis "github.com/ulule/limiter/v3/drivers/store/redis"
+	"sync"
+	"time"
+)
+
+const (
+	// RateLimitModeRedis means that the counters are shared by all replicas in Redis.
+	RateLimitModeRedis = "redis"
+	// RateLimitModeMemory counts per instance while Redis is unavailable.
+	RateLimitModeMemory = "memory"
+	// RateLimitModeOpen allows every request while Redis is unavailable.
+	RateLimitModeOpen = "open"
+	// RateLimitModeClosed rejects every request while Redis is unavailable.
+	RateLimitModeClosed = "closed"
+)
+
+// ErrRateLimiterUnavailable is returned in the closed mode while Redis is unavailable.
+var ErrRateLimiterUnavailable = errors.New("rate limiter is unavailable")
+
+// FallbackStore is a limiter store backed by Redis. While Redis is unavailable,
+// it falls back to the failure mode: per-instance memory counters, whose limits
+// are divided by the number of replicas, or failing open or closed. Redis is used
+// again as soon as the shared health check finds it reachable.
+type FallbackStore struct {
+	client       *goredis.Client
+	health       *RedisHealth
+	prefix       string
+	failureMode  string
+	replicas     int64
+	memory       limiter.Store
+	mu           sync.RWMutex
+	redis        limiter.Store
+	OnModeChange func(mode string)
+}
+
+func NewFallbackStore(
+	client *goredis.Client,
+	health *RedisHealth,
+	prefix string,
+	failureMode string,
+	replicas int,
+) *FallbackStore {
+	if failureMode == "" {
+		failureMode = RateLimitModeMemory
+	}
+	if replicas < 1 {
+		replicas = 1
+	}
+	return &FallbackStore{
+		client:      client,
+		health:      health,
+		prefix:      prefix,
+		failureMode: failureMode,
+		replicas:    int64(replicas),
+		memory: smemory.NewStoreWithOptions(limiter.StoreOptions{
+			Prefix:          prefix,
+			CleanUpInterval: limiter.DefaultCleanUpInterval,
+		}),
+	}
+}
+
+// Start connects to Redis if it is available, and follows its availability.
+func (store *FallbackStore) Start() {
+	store.health.OnChange(store.update)
+	store.update(store.health.Available())
+	store.modeChanged()
+}
+
+// Mode returns the current mode of the store.
+func (store *FallbackStore) Mode() string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if store.redis != nil {
+		return RateLimitModeRedis
+	}
+	return store.failureMode
+}
+
+func (store *FallbackStore) update(available bool) {
+	store.mu.RLock()
+	connected := store.redis != nil
+	store.mu.RUnlock()
+	if !available {
+		if connected {
+			store.disconnect()
+		}
+		return
+	}
+	if connected {
+		return
+	}
+	// The Lua scripts of the Redis store are loaded on creation
+	redisStore, err := sredis.NewStoreWithOptions(store.client, limiter.StoreOptions{
+		Prefix: store.prefix,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("cannot create the rate limiter redis store")
+		return
+	}
+	store.mu.Lock()
+	store.redis = redisStore
+	store.mu.Unlock()
+	log.Info().Msg("rate limiter connected to redis")
+	store.modeChanged()
+}
+
+func (store *FallbackStore) disconnect() {
+	store.mu.Lock()
+	wasConnected := store.redis != nil
+	store.redis = nil
+	store.mu.Unlock()
+	if wasConnected {
+		log.Error().Str("mode", store.failureMode).Msg("rate limiter lost redis, switching to the failure mode")
+		store.modeChanged()
+	}
+}
+
+func (store *FallbackStore) modeChanged() {
+	if store.OnModeChange != nil {
+		store.OnModeChange(store.Mode())
+	}
+}
+
+// do runs an operation on Redis, or on the fallback if Redis is unavailable.
+func (store *FallbackStore) do(
+	ctx context.Context,
+	rate limiter.Rate,
+	f func(s limiter.Store, rate limiter.Rate) (limiter.Context, error),
+) (limiter.Context, error) {
+	store.mu.RLock()
+	redisStore := store.redis
+	store.mu.RUnlock()
+	if redisStore != nil {
+		result, err := f(redisStore, rate)
+		if err == nil || ctx.Err() != nil {
+			return result, err
+		}
+		store.health.Fail(err)
+		store.disconnect()
+	}
+
+	switch store.failureMode {
+	case RateLimitModeOpen:
+		return limiter.Context{
+			Limit:     rate.Limit,
+			Remaining: rate.Limit,
+			Reset:     time.Now().Add(rate.Period).Unix(),
+		}, nil
+	case RateLimitModeClosed:
+		return limiter.Context{}, ErrRateLimiterUnavailable
+	default:
+		// Each replica gets its share of the limit
+		scaled := rate
+		scaled.Limit = rate.Limit / store.replicas
+		if scaled.Limit < 1 {
+			scaled.Limit = 1
+		}
+		return f(store.memory, scaled)
+	}
+}
+
+func (store *FallbackStore) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return store.do(ctx, rate, func(s limiter.Store, rate limiter.Rate) (limiter.Context, error) {
+		return s.Get(ctx, key, rate)
+	})
+}
+
+func (store *FallbackStore) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return store.do(ctx, rate, func(s limiter.Store, rate limiter.Rate) (limiter.Context, error) {
+		return s.Peek(ctx, key, rate)
+	})
+}
+
+func (store *FallbackStore) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return store.do(ctx, rate, func(s limiter.Store, rate limiter.Rate) (limiter.Context, error) {
+		return s.Reset(ctx, key, rate)
+	})
+}
+
+func (store *FallbackStore) Increment(ctx context.Context, key string, count int64, rate limiter.Rate) (limiter.Context, error) {
+	return store.do(ctx, rate, func(s limiter.Store, rate limiter.Rate) (limiter.Context, error) {
+		return s.Increment(ctx, key, count, rate)
+	})
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+	"github.com/ulule/limiter/v3"
+	"testing"
+	"time"
+)
+
+func TestFallbackStore(t *testing.T) {
+	rate := limiter.Rate{Period: time.Minute, Limit: 4}
+
+	testCases := []struct {
+		name          string
+		failureMode   string
+		checkResponse func(results []limiter.Context, err error)
+	}{
+		{
+			name:        "Memory",
+			failureMode: RateLimitModeMemory,
+			checkResponse: func(results []limiter.Context, err error) {
+				require.NoError(t, err)
+				// The limit is shared by two replicas
+				require.Equal(t, int64(2), results[0].Limit)
+				require.False(t, results[1].Reached)
+				require.True(t, results[2].Reached)
+			},
+		},
+		{
+			name:        "Open",
+			failureMode: RateLimitModeOpen,
+			checkResponse: func(results []limiter.Context, err error) {
+				require.NoError(t, err)
+				require.False(t, results[2].Reached)
+			},
+		},
+		{
+			name:        "Closed",
+			failureMode: RateLimitModeClosed,
+			checkResponse: func(results []limiter.Context, err error) {
+				require.ErrorIs(t, err, ErrRateLimiterUnavailable)
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			// Nothing listens on this address
+			client := NewRedisClient("127.0.0.1:1")
+			health := NewRedisHealth(client)
+			health.Start(time.Hour)
+			defer health.Stop()
+			store := NewFallbackStore(client, health, "test", tc.failureMode, 2)
+			var mode string
+			store.OnModeChange = func(m string) {
+				mode = m
+			}
+			store.Start()
+			require.Equal(t, tc.failureMode, mode)
+
+			results := make([]limiter.Context, 0)
+			var err error
+			for n := 0; n < 3 && err == nil; n++ {
+				var result limiter.Context
+				result, err = store.Get(context.Background(), "key", rate)
+				results = append(results, result)
+			}
+			tc.checkResponse(results, err)
+		})
+	}
+}
+
+func TestRedisHealth(t *testing.T) {
+	var health *RedisHealth
+	require.False(t, health.Available())
+	health.Fail(errors.New("connection refused"))
+
+	health = NewRedisHealth(NewRedisClient("127.0.0.1:1"))
+	var changes []bool
+	health.OnChange(func(available bool) {
+		changes = append(changes, available)
+	})
+	health.Start(time.Hour)
+	defer health.Stop()
+	require.False(t, health.Available())
+
+	// The availability is only reported when it changes
+	health.set(true, nil)
+	health.set(true, nil)
+	require.True(t, health.Available())
+	// The missing keys and the cancelled requests are not failures
+	health.Fail(goredis.Nil)
+	health.Fail(context.Canceled)
+	require.True(t, health.Available())
+	health.Fail(errors.New("connection refused"))
+	require.False(t, health.Available())
+	require.Equal(t, []bool{true, false}, changes)
+
+	health.check()
+	require.False(t, health.Available())
+	health.Stop()
+}
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"gopkg.in/yaml.v3"
+	"os"
+	"time"
+)
+
+// ModelConfig stores the per-model settings of the gateway.
+// The values are read from the YAML file given by MODEL_CONFIG_FILE,
+// see models.example.yaml for a documented example.
+type ModelConfig struct {
+	// Static list of serving agent URLs. When empty and no discovery is set,
+	// SERVING_AGENT_ADDRESS is used.
+	Endpoints   []string          `yaml:"endpoints"`
+	Discovery   DiscoveryConfig   `yaml:"discovery"`
+	Balancer    string            `yaml:"balancer"`
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+	Admission   AdmissionConfig   `yaml:"admission"`
+	// Whether equal inputs always give equal outputs, in which case
+	// identical concurrent predictions are coalesced
+	Deterministic bool        `yaml:"deterministic"`
+	Cache         CacheConfig `yaml:"cache"`
+	Cost          CostConfig  `yaml:"cost"`
+	// Input fields never written to the logs, e.g., prompts, at any depth of the log lines of the model
+	NeverLog  []string        `yaml:"never_log"`
+	Transform TransformConfig `yaml:"transform"`
+	// The file inputs, uploaded as parts of multipart requests named after the input fields
+	Inputs map[string]InputConfig `yaml:"inputs"`
+	// The outputs moved to the blob store
+	Offload    OffloadConfig    `yaml:"offload"`
+	Moderation ModerationConfig `yaml:"moderation"`
+}
+
+// The actions of the moderation plugins
+const (
+	ModerationAllow = "allow"
+	ModerationFlag  = "flag"
+	ModerationBlock = "block"
+)
+
+// ModerationConfig sets the action of each moderation plugin, by name, on the inputs
+// and on the outputs of a model: "allow", "flag" or "block".
+type ModerationConfig struct {
+	Input  map[string]string `yaml:"input"`
+	Output map[string]string `yaml:"output"`
+}
+
+// OffloadConfig replaces the large outputs of a model by signed URLs of the blob store.
+type OffloadConfig struct {
+	// The string outputs longer than this are offloaded, OUTPUT_OFFLOAD_THRESHOLD if 0
+	Threshold int `yaml:"threshold"`
+	// The names of the fields, at any depth, which hold binary data in base64 or in data URLs.
+	// They are always offloaded, decoded.
+	Binary []string `yaml:"binary"`
+}
+
+// The types of the file inputs
+const (
+	InputImage = "image"
+	InputAudio = "audio"
+	InputVideo = "video"
+	InputFile  = "file"
+)
+
+// The encodings of the uploaded files in the inputs
+const (
+	InputEncodingBase64 = "base64"
+	InputEncodingURL    = "url"
+)
+
+// InputConfig declares a file input of a model.
+type InputConfig struct {
+	// "image", "audio", "video" or "file"
+	Type string `yaml:"type"`
+	// "base64" (default) inlines the file, "url" stores it in the blob store and passes a signed URL
+	Encoding string `yaml:"encoding"`
+	// Maximum size of the file in bytes, unlimited if 0 (the request body size is still limited)
+	MaxSize int64 `yaml:"max_size"`
+	// Accepted MIME types, e.g., "image/png" or "image/*", all if empty
+	MIMETypes []string `yaml:"mime_types"`
+}
+
+// TransformConfig adapts the payloads of a model to its serving agent.
+type TransformConfig struct {
+	Request  RequestTransform  `yaml:"request"`
+	Response ResponseTransform `yaml:"response"`
+}
+
+// RequestTransform rewrites the inputs of a request, in the order of the fields. The fields
+// are dot-separated paths in the inputs, the steps after the renames use the new names.
+type RequestTransform struct {
+	// Renamed fields, from the name of the clients to the name of the agent
+	Rename map[string]string `yaml:"rename"`
+	// Values of the missing fields
+	Defaults map[string]interface{} `yaml:"defaults"`
+	// Bounds of numeric fields
+	Clamp map[string]ClampRange `yaml:"clamp"`
+	// The fields sent to the agent, all if empty
+	Allowed []string `yaml:"allowed"`
+}
+
+// ClampRange bounds a numeric field, a nil bound is unbounded.
+type ClampRange struct {
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+}
+
+// ResponseTransform rewrites the response of the agent before it is written.
+type ResponseTransform struct {
+	// Dot-separated paths of the fields removed from the response, the task results and
+	// the streamed JSON messages
+	Strip []string `yaml:"strip"`
+}
+
+// DiscoveryConfig resolves the serving agent endpoints of a model from DNS.
+type DiscoveryConfig struct {
+	// DNS name to resolve, e.g. "agent-service-sdxl.default.svc.cluster.local"
+	// or "_http._tcp.agent-service-sdxl.default.svc.cluster.local" for SRV records.
+	Host string `yaml:"host"`
+	// "a" (default) or "srv"
+	Type string `yaml:"type"`
+	// Port of the endpoints, ignored for SRV records
+	Port     int           `yaml:"port"`
+	Scheme   string        `yaml:"scheme"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// HealthCheckConfig configures active health probes and passive error tracking.
+type HealthCheckConfig struct {
+	// Path of the active probe, disabled if empty
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// Number of consecutive failed calls after which an endpoint is ejected
+	FailureThreshold int           `yaml:"failure_threshold"`
+	EjectionDuration time.Duration `yaml:"ejection_duration"`
+}
+
+// AdmissionConfig bounds the task queue of a model. Async submissions are
+// rejected with 429 when the queue depth reaches MaxQueueSize.
+type AdmissionConfig struct {
+	// Disabled if 0
+	MaxQueueSize   int           `yaml:"max_queue_size"`
+	SampleInterval time.Duration `yaml:"sample_interval"`
+	// Average processing time of a task, used to estimate the wait
+	TaskDuration time.Duration `yaml:"task_duration"`
+	// How long a submission may wait for room in the queue before being rejected
+	MaxDefer time.Duration `yaml:"max_defer"`
+}
+
+// CacheConfig enables the prediction cache of a model.
+type CacheConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	TTL     time.Duration `yaml:"ttl"`
+	// Whether cached and coalesced outputs are only returned to the user who requested them
+	Private bool `yaml:"private"`
+}
+
+// CostConfig declares the cost of a request in cost units, as
+// base + scale * the product of the factors. Requests cost 1 if unset.
+type CostConfig struct {
+	Base    float64      `yaml:"base"`
+	Scale   float64      `yaml:"scale"`
+	Factors []CostFactor `yaml:"factors"`
+}
+
+// CostFactor is a numeric input field of a request.
+type CostFactor struct {
+	Field string `yaml:"field"`
+	// Value used when the field is missing or not a number
+	Default float64 `yaml:"default"`
+}
+
+type modelConfigFile struct {
+	Models map[string]ModelConfig `yaml:"models"`
+}
+
+// LoadModelConfig reads the per-model settings from a YAML file.
+func LoadModelConfig(path string) (map[string]ModelConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file modelConfigFile
+	if err = yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return file.Models, nil
+}
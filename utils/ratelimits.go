@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"gopkg.in/yaml.v3"
+	"os"
+	"time"
+)
+
+// RateLimitConfig stores the rate-limit policies and the plans of the users.
+// The values are read from the YAML file given by RATE_LIMIT_CONFIG_FILE,
+// see ratelimits.example.yaml for a documented example.
+type RateLimitConfig struct {
+	// Plan of the users that have no plan
+	DefaultPlan string `yaml:"default_plan"`
+	// Plans of the users by UID
+	Users map[string]string `yaml:"users"`
+	// Whether to look up the plan of a user in Redis, at key "plan:<UID>"
+	RedisLookup bool                `yaml:"redis_lookup"`
+	Policies    []RateLimitPolicy   `yaml:"policies"`
+	Concurrency []ConcurrencyPolicy `yaml:"concurrency"`
+	Quotas      []QuotaPolicy       `yaml:"quotas"`
+}
+
+// RateLimitPolicy is the rate of a (plan, model, route group). An empty
+// field or "*" matches anything, and the most specific policy applies.
+type RateLimitPolicy struct {
+	Plan  string `yaml:"plan"`
+	Model string `yaml:"model"`
+	// One of "sync_predict", "async_predict", "task" or "queue"
+	Group string `yaml:"group"`
+	// Formatted rate "<limit>-<period>", e.g. "10-M"
+	Rate string `yaml:"rate"`
+}
+
+// ConcurrencyPolicy caps the in-flight requests of each user of a plan in a
+// route group. An empty field or "*" matches anything, and the most specific
+// policy applies. A policy matching any group caps all groups together.
+type ConcurrencyPolicy struct {
+	Plan  string `yaml:"plan"`
+	Group string `yaml:"group"`
+	Limit int    `yaml:"limit"`
+	// How long a request may wait for a slot, it is rejected immediately if 0
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	// Maximum number of requests of a user waiting for a slot on an instance
+	QueueSize int `yaml:"queue_size"`
+}
+
+// QuotaPolicy is the usage budget of each user of a plan, in the cost units
+// of the models. A plan "*" or empty applies to the plans without a policy,
+// and a zero budget is unlimited.
+type QuotaPolicy struct {
+	Plan    string  `yaml:"plan"`
+	Daily   float64 `yaml:"daily"`
+	Monthly float64 `yaml:"monthly"`
+}
+
+// LoadRateLimitConfig reads the rate-limit policies from a YAML file.
+func LoadRateLimitConfig(path string) (RateLimitConfig, error) {
+	var config RateLimitConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = yaml.Unmarshal(data, &config)
+	return config, err
+}
@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const (
+	LogRedactionAuto = "auto"
+	LogRedactionOn   = "on"
+	LogRedactionOff  = "off"
+)
+
+const (
+	redactedValue         = "[REDACTED]"
+	defaultMaxValueLength = 1024
+)
+
+// The fields whose values are always masked, whatever their path
+var sensitiveKeys = map[string]bool{
+	"apikey":        true,
+	"api_key":       true,
+	"authorization": true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+}
+
+// The secrets and the personal data found in free text
+var secretPatterns = []struct {
+	re          *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`(?i)\bbearer\s+[a-z0-9\-._~+/]+=*`), "Bearer " + redactedValue},
+	{regexp.MustCompile(`\beyJ[a-zA-Z0-9_-]+\.[a-zA-Z0-9_-]+\.[a-zA-Z0-9_-]+`), redactedValue},
+	{regexp.MustCompile(`\b(sk|pk|rk)[-_][a-zA-Z0-9_-]{16,}`), redactedValue},
+	{regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`), redactedValue},
+	{regexp.MustCompile(`(?i)\b(api[_-]?key|token|secret|password)(["']?\s*[:=]\s*["']?)[^\s"',;&]+`), "${1}${2}" + redactedValue},
+	{regexp.MustCompile(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`), "[EMAIL]"},
+}
+
+// RedactionOptions configures a Redactor.
+type RedactionOptions struct {
+	// Whether the secret patterns, the sensitive keys, the paths and the truncation apply
+	Enabled bool
+	// Dot-separated paths of the masked fields from the root of a log line, "*" matches any key
+	Paths []string
+	// Strings longer than this are truncated, 0 for the default
+	MaxValueLength int
+	// The input fields of each model which are never logged, they are masked at any depth
+	// in the lines of the model, even if redaction is disabled
+	ModelFields map[string][]string
+}
+
+// Redactor masks the secrets and the personal data of JSON log lines.
+type Redactor struct {
+	enabled        bool
+	paths          [][]string
+	maxValueLength int
+	modelFields    map[string]map[string]bool
+}
+
+func NewRedactor(options RedactionOptions) *Redactor {
+	redactor := &Redactor{
+		enabled:        options.Enabled,
+		maxValueLength: options.MaxValueLength,
+		modelFields:    make(map[string]map[string]bool),
+	}
+	if redactor.maxValueLength <= 0 {
+		redactor.maxValueLength = defaultMaxValueLength
+	}
+	for _, path := range options.Paths {
+		if path = strings.TrimSpace(path); path != "" {
+			redactor.paths = append(redactor.paths, strings.Split(path, "."))
+		}
+	}
+	for model, fields := range options.ModelFields {
+		if len(fields) == 0 {
+			continue
+		}
+		redactor.modelFields[model] = make(map[string]bool)
+		for _, field := range fields {
+			redactor.modelFields[model][field] = true
+		}
+	}
+	return redactor
+}
+
+// Active tells whether the redactor changes anything.
+func (redactor *Redactor) Active() bool {
+	return redactor.enabled || len(redactor.modelFields) > 0
+}
+
+// Redact returns a log line with the sensitive values masked. The order of the fields is kept.
+func (redactor *Redactor) Redact(line []byte) []byte {
+	var fields map[string]bool
+	if len(redactor.modelFields) > 0 {
+		var model struct {
+			Model string `json:"model"`
+		}
+		_ = json.Unmarshal(line, &model)
+		fields = redactor.modelFields[model.Model]
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	var out bytes.Buffer
+	if err := redactor.rewrite(decoder, &out, nil, fields); err != nil {
+		// Not a JSON line, e.g., from the console writer
+		if redactor.enabled {
+			return []byte(redactor.redactString(string(line)))
+		}
+		return line
+	}
+	if bytes.HasSuffix(line, []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+func (redactor *Redactor) rewrite(decoder *json.Decoder, out *bytes.Buffer, path []string, fields map[string]bool) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	switch value := token.(type) {
+	case json.Delim:
+		if value == '[' {
+			out.WriteByte('[')
+			for i := 0; decoder.More(); i++ {
+				if i > 0 {
+					out.WriteByte(',')
+				}
+				if err := redactor.rewrite(decoder, out, path, fields); err != nil {
+					return err
+				}
+			}
+			out.WriteByte(']')
+		} else {
+			out.WriteByte('{')
+			for i := 0; decoder.More(); i++ {
+				keyToken, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				key, _ := keyToken.(string)
+				if i > 0 {
+					out.WriteByte(',')
+				}
+				writeJSONString(out, key)
+				out.WriteByte(':')
+				keyPath := append(path[:len(path):len(path)], key)
+				if fields[key] || (redactor.enabled && redactor.masked(keyPath)) {
+					var skipped json.RawMessage
+					if err := decoder.Decode(&skipped); err != nil {
+						return err
+					}
+					writeJSONString(out, redactedValue)
+					continue
+				}
+				if err := redactor.rewrite(decoder, out, keyPath, fields); err != nil {
+					return err
+				}
+			}
+			out.WriteByte('}')
+		}
+		// The closing delimiter
+		_, err = decoder.Token()
+		return err
+	case string:
+		if redactor.enabled {
+			value = redactor.redactString(value)
+		}
+		writeJSONString(out, value)
+	case json.Number:
+		out.WriteString(value.String())
+	default:
+		data, _ := json.Marshal(value)
+		out.Write(data)
+	}
+	return nil
+}
+
+// masked tells whether a field is sensitive, by its name or by its path.
+func (redactor *Redactor) masked(path []string) bool {
+	if sensitiveKeys[strings.ToLower(path[len(path)-1])] {
+		return true
+	}
+	for _, pattern := range redactor.paths {
+		if len(pattern) != len(path) {
+			continue
+		}
+		matched := true
+		for i := range pattern {
+			if pattern[i] != "*" && pattern[i] != path[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (redactor *Redactor) redactString(value string) string {
+	for _, pattern := range secretPatterns {
+		value = pattern.re.ReplaceAllString(value, pattern.replacement)
+	}
+	if len(value) > redactor.maxValueLength {
+		value = fmt.Sprintf("%s...(truncated %d bytes)", value[:redactor.maxValueLength],
+			len(value)-redactor.maxValueLength)
+	}
+	return value
+}
+
+func writeJSONString(out *bytes.Buffer, value string) {
+	encoder := json.NewEncoder(out)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(value)
+	// Encode appends a newline
+	out.Truncate(out.Len() - 1)
+}
+
+// RedactingWriter redacts the log lines written by zerolog before passing them on.
+type RedactingWriter struct {
+	out      io.Writer
+	redactor *Redactor
+}
+
+func NewRedactingWriter(out io.Writer, redactor *Redactor) *RedactingWriter {
+	return &RedactingWriter{out: out, redactor: redactor}
+}
+
+// Write receives one log line per call, as zerolog writes each event at once.
+func (writer *RedactingWriter) Write(p []byte) (int, error) {
+	if _, err := writer.out.Write(writer.redactor.Redact(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
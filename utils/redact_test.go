@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"bytes"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	redactor := NewRedactor(RedactionOptions{
+		Enabled:        true,
+		Paths:          []string{"outputs.debug", "outputs.*.seed"},
+		MaxValueLength: 32,
+		ModelFields:    map[string][]string{"sdxl": {"prompt"}},
+	})
+
+	testCases := []struct {
+		name     string
+		line     string
+		expected string
+	}{
+		{
+			name:     "Unchanged",
+			line:     `{"severity":"INFO","status":200,"ok":true,"v":null,"message":"<done>"}`,
+			expected: `{"severity":"INFO","status":200,"ok":true,"v":null,"message":"<done>"}`,
+		},
+		{
+			name:     "SensitiveKeys",
+			line:     `{"headers":{"Authorization":"abc","apikey":"def"},"token":{"a":1}}`,
+			expected: `{"headers":{"Authorization":"[REDACTED]","apikey":"[REDACTED]"},"token":"[REDACTED]"}`,
+		},
+		{
+			name:     "Paths",
+			line:     `{"outputs":{"debug":{"a":1},"image":{"seed":42,"url":"x"}},"debug":1}`,
+			expected: `{"outputs":{"debug":"[REDACTED]","image":{"seed":"[REDACTED]","url":"x"}},"debug":1}`,
+		},
+		{
+			name:     "Bearer",
+			line:     `{"error":"Bearer abc.def-123"}`,
+			expected: `{"error":"Bearer [REDACTED]"}`,
+		},
+		{
+			name:     "APIKey",
+			line:     `{"error":"key sk-abcdefghijklmnop1234"}`,
+			expected: `{"error":"key [REDACTED]"}`,
+		},
+		{
+			name:     "Assignment",
+			line:     `{"error":"api_key=abc123 failed"}`,
+			expected: `{"error":"api_key=[REDACTED] failed"}`,
+		},
+		{
+			name:     "Email",
+			line:     `{"error":["mail john.doe@example.com"]}`,
+			expected: `{"error":["mail [EMAIL]"]}`,
+		},
+		{
+			name:     "Truncated",
+			line:     `{"outputs":"` + strings.Repeat("a", 40) + `"}`,
+			expected: `{"outputs":"` + strings.Repeat("a", 32) + `...(truncated 8 bytes)"}`,
+		},
+		{
+			name:     "ModelFields",
+			line:     `{"outputs":{"inputs":{"prompt":"a cat"}},"model":"sdxl"}`,
+			expected: `{"outputs":{"inputs":{"prompt":"[REDACTED]"}},"model":"sdxl"}`,
+		},
+		{
+			name:     "OtherModel",
+			line:     `{"outputs":{"inputs":{"prompt":"a cat"}},"model":"other"}`,
+			expected: `{"outputs":{"inputs":{"prompt":"a cat"}},"model":"other"}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected+"\n", string(redactor.Redact([]byte(tc.line+"\n"))))
+		})
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	var out bytes.Buffer
+	// Without redaction, only the fields of the models are masked
+	redactor := NewRedactor(RedactionOptions{ModelFields: map[string][]string{"sdxl": {"prompt"}}})
+	require.True(t, redactor.Active())
+	logger := zerolog.New(NewRedactingWriter(&out, redactor))
+	logger.Error().Str("model", "sdxl").Interface("outputs", map[string]string{"prompt": "a cat"}).
+		Str("token", "abc").Msg("failed")
+	require.JSONEq(t, `{"level":"error","model":"sdxl","outputs":{"prompt":"[REDACTED]"},"token":"abc","message":"failed"}`,
+		out.String())
+
+	require.False(t, NewRedactor(RedactionOptions{}).Active())
+}
@@ -2,18 +2,109 @@ package utils
 
 import (
 	"context"
+	"errors"
 	goredis "github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func NewRedisClient(redisAddress string) (*goredis.Client, error) {
-	client := goredis.NewClient(&goredis.Options{
+// NewRedisClient creates a client without checking the connection,
+// its commands fail until Redis is reachable.
+func NewRedisClient(redisAddress string) *goredis.Client {
+	return goredis.NewClient(&goredis.Options{
 		Addr:     redisAddress,
 		Password: "",
 		DB:       0, // use default DB
 	})
-	_, err := client.Ping(context.TODO()).Result()
-	if err != nil {
-		return nil, err
+}
+
+// RedisHealth is the circuit breaker shared by the Redis callers. Redis is marked
+// unavailable as soon as a command fails, and available again once it answers the
+// background checks, so that the callers use their fallback without waiting for
+// each command to time out.
+type RedisHealth struct {
+	client    *goredis.Client
+	available atomic.Bool
+	mu        sync.Mutex
+	listeners []func(available bool)
+	done      chan struct{}
+	stopOnce  sync.Once
+}
+
+func NewRedisHealth(client *goredis.Client) *RedisHealth {
+	return &RedisHealth{client: client, done: make(chan struct{})}
+}
+
+// Start checks Redis, then keeps checking it on an interval.
+func (health *RedisHealth) Start(checkInterval time.Duration) {
+	health.check()
+	go func() {
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-health.done:
+				return
+			case <-ticker.C:
+				health.check()
+			}
+		}
+	}()
+}
+
+// Stop terminates the background checks.
+func (health *RedisHealth) Stop() {
+	if health == nil {
+		return
+	}
+	health.stopOnce.Do(func() {
+		close(health.done)
+	})
+}
+
+// Available tells whether Redis can be used, it is false when Redis is not configured.
+func (health *RedisHealth) Available() bool {
+	return health != nil && health.available.Load()
+}
+
+// Fail reports the error of a command. Redis is skipped until the next successful check,
+// unless the error is a missing key or a cancelled request.
+func (health *RedisHealth) Fail(err error) {
+	if health == nil || err == nil || errors.Is(err, goredis.Nil) || errors.Is(err, context.Canceled) {
+		return
+	}
+	health.set(false, err)
+}
+
+// OnChange registers a function called with the availability of Redis when it changes.
+func (health *RedisHealth) OnChange(f func(available bool)) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.listeners = append(health.listeners, f)
+}
+
+func (health *RedisHealth) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := health.client.Ping(ctx).Err()
+	health.set(err == nil, err)
+}
+
+func (health *RedisHealth) set(available bool, err error) {
+	if health.available.Swap(available) == available {
+		return
+	}
+	if available {
+		log.Info().Msg("redis is available")
+	} else {
+		log.Error().Err(err).Msg("redis is unavailable")
+	}
+	health.mu.Lock()
+	listeners := append([]func(bool){}, health.listeners...)
+	health.mu.Unlock()
+	for _, f := range listeners {
+		f(available)
 	}
-	return client, nil
 }
@@ -0,0 +1,393 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	SinkFile   = "file"
+	SinkStdout = "stdout"
+	SinkHTTP   = "http"
+)
+
+const (
+	defaultSinkBatchSize     = 100
+	defaultSinkBufferSize    = 10000
+	defaultSinkFlushInterval = time.Second
+	maxSpoolRecordSize       = 1 << 20
+)
+
+// EventSink exports records, e.g., usage events. Each record is a JSON object on a single line.
+type EventSink interface {
+	Write(records [][]byte) error
+	Close() error
+}
+
+// SinkOptions configures an event sink.
+type SinkOptions struct {
+	// The directory and the file name prefix of the file sink
+	Dir    string
+	Prefix string
+	// The file sink rotates its file daily or when it reaches this size in bytes
+	MaxSize int64
+	// The collector of the HTTP sink
+	URL string
+	// Records are buffered in this directory while the sink fails, no buffering if empty
+	SpoolDir      string
+	FlushInterval time.Duration
+}
+
+// NewEventSink creates a sink of a kind, wrapped in a BufferedSink so that writes never block requests.
+func NewEventSink(kind string, options SinkOptions) (EventSink, error) {
+	sink, err := NewSink(kind, options)
+	if err != nil {
+		return nil, err
+	}
+	return NewBufferedSink(sink, options.SpoolDir, options.FlushInterval)
+}
+
+// NewSink creates a sink of a kind, whose writes return once the records are written.
+func NewSink(kind string, options SinkOptions) (EventSink, error) {
+	switch kind {
+	case SinkFile:
+		return NewFileSink(options.Dir, options.Prefix, options.MaxSize)
+	case SinkStdout:
+		return NewWriterSink(os.Stdout), nil
+	case SinkHTTP:
+		if options.URL == "" {
+			return nil, fmt.Errorf("the http sink of %s has no url", options.Prefix)
+		}
+		return NewHTTPSink(options.URL), nil
+	default:
+		return nil, fmt.Errorf("unknown sink %q", kind)
+	}
+}
+
+// FileSink appends the records to JSONL files named <prefix>-<time>.jsonl.
+type FileSink struct {
+	mu       sync.Mutex
+	dir      string
+	prefix   string
+	maxSize  int64
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func NewFileSink(dir string, prefix string, maxSize int64) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileSink{dir: dir, prefix: prefix, maxSize: maxSize}, nil
+}
+
+func (sink *FileSink) rotate(now time.Time) error {
+	if sink.file != nil {
+		if err := sink.file.Close(); err != nil {
+			return err
+		}
+	}
+	name := fmt.Sprintf("%s-%s.jsonl", sink.prefix, now.UTC().Format("20060102T150405.000"))
+	file, err := os.OpenFile(filepath.Join(sink.dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		sink.file = nil
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		sink.file = nil
+		return err
+	}
+	sink.file, sink.size, sink.openedAt = file, info.Size(), now
+	return nil
+}
+
+func (sink *FileSink) Write(records [][]byte) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	now := time.Now()
+	if sink.file == nil || now.UTC().Format("20060102") != sink.openedAt.UTC().Format("20060102") ||
+		(sink.maxSize > 0 && sink.size >= sink.maxSize) {
+		if err := sink.rotate(now); err != nil {
+			return err
+		}
+	}
+	n, err := sink.file.Write(joinRecords(records))
+	sink.size += int64(n)
+	return err
+}
+
+func (sink *FileSink) Close() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.file == nil {
+		return nil
+	}
+	err := sink.file.Close()
+	sink.file = nil
+	return err
+}
+
+// WriterSink writes the records to a writer, e.g., stdout.
+type WriterSink struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func NewWriterSink(writer io.Writer) *WriterSink {
+	return &WriterSink{writer: writer}
+}
+
+func (sink *WriterSink) Write(records [][]byte) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	_, err := sink.writer.Write(joinRecords(records))
+	return err
+}
+
+func (sink *WriterSink) Close() error {
+	return nil
+}
+
+// HTTPSink posts the records to a collector as newline-delimited JSON.
+type HTTPSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPSink(url string) *HTTPSink {
+	return &HTTPSink{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (sink *HTTPSink) Write(records [][]byte) error {
+	req, err := http.NewRequest(http.MethodPost, sink.url, bytes.NewReader(joinRecords(records)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	res, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("the collector responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (sink *HTTPSink) Close() error {
+	return nil
+}
+
+func joinRecords(records [][]byte) []byte {
+	var buffer bytes.Buffer
+	for _, record := range records {
+		buffer.Write(record)
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes()
+}
+
+// BufferedSink writes the records to a sink in batches from a background goroutine.
+// While the sink fails, or the buffer is full, the records are appended to a spool
+// file on disk and replayed once the sink recovers.
+type BufferedSink struct {
+	sink          EventSink
+	records       chan []byte
+	flushInterval time.Duration
+	spoolPath     string
+	spoolMu       sync.Mutex
+	mu            sync.RWMutex
+	closed        bool
+	done          chan struct{}
+}
+
+func NewBufferedSink(sink EventSink, spoolDir string, flushInterval time.Duration) (*BufferedSink, error) {
+	if flushInterval <= 0 {
+		flushInterval = defaultSinkFlushInterval
+	}
+	buffered := &BufferedSink{
+		sink:          sink,
+		records:       make(chan []byte, defaultSinkBufferSize),
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+	if spoolDir != "" {
+		if err := os.MkdirAll(spoolDir, 0o755); err != nil {
+			return nil, err
+		}
+		buffered.spoolPath = filepath.Join(spoolDir, "spool.jsonl")
+	}
+	go buffered.run()
+	return buffered, nil
+}
+
+// Write queues the records, it does not block.
+func (buffered *BufferedSink) Write(records [][]byte) error {
+	buffered.mu.RLock()
+	defer buffered.mu.RUnlock()
+	if buffered.closed {
+		return buffered.spool(records)
+	}
+	for i, record := range records {
+		select {
+		case buffered.records <- record:
+		default:
+			log.Warn().Int("records", len(records)-i).Msg("event sink buffer is full, spooling the records")
+			return buffered.spool(records[i:])
+		}
+	}
+	return nil
+}
+
+func (buffered *BufferedSink) run() {
+	defer close(buffered.done)
+	ticker := time.NewTicker(buffered.flushInterval)
+	defer ticker.Stop()
+	batch := make([][]byte, 0, defaultSinkBatchSize)
+	for {
+		select {
+		case record, ok := <-buffered.records:
+			if !ok {
+				buffered.flush(batch)
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) >= defaultSinkBatchSize {
+				buffered.flush(batch)
+				batch = make([][]byte, 0, defaultSinkBatchSize)
+			}
+		case <-ticker.C:
+			buffered.flush(batch)
+			batch = make([][]byte, 0, defaultSinkBatchSize)
+			buffered.replay()
+		}
+	}
+}
+
+func (buffered *BufferedSink) flush(batch [][]byte) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := buffered.sink.Write(batch); err != nil {
+		log.Error().Err(err).Int("records", len(batch)).Msg("failed to write the records to the event sink")
+		if err = buffered.spool(batch); err != nil {
+			log.Error().Err(err).Int("records", len(batch)).Msg("failed to spool the records")
+		}
+	}
+}
+
+func (buffered *BufferedSink) spool(records [][]byte) error {
+	if buffered.spoolPath == "" {
+		return fmt.Errorf("dropped %d records, no spool directory is set", len(records))
+	}
+	buffered.spoolMu.Lock()
+	defer buffered.spoolMu.Unlock()
+	file, err := os.OpenFile(buffered.spoolPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Write(joinRecords(records)); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// replay writes the spooled records to the sink. The spool file is moved aside under the lock,
+// so that the records spooled meanwhile are not blocked by the writes to the sink. The records
+// not written yet stay in the replay file, which is retried before the next spool file.
+func (buffered *BufferedSink) replay() {
+	if buffered.spoolPath == "" {
+		return
+	}
+	replayPath := buffered.spoolPath + ".replay"
+	buffered.spoolMu.Lock()
+	if _, err := os.Stat(replayPath); os.IsNotExist(err) {
+		err = os.Rename(buffered.spoolPath, replayPath)
+		if err != nil && !os.IsNotExist(err) {
+			log.Error().Err(err).Str("path", buffered.spoolPath).Msg("failed to move the spool file")
+		}
+	}
+	buffered.spoolMu.Unlock()
+
+	file, err := os.Open(replayPath)
+	if err != nil {
+		return
+	}
+	var records [][]byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxSpoolRecordSize)
+	for scanner.Scan() {
+		records = append(records, append([]byte(nil), scanner.Bytes()...))
+	}
+	err = scanner.Err()
+	_ = file.Close()
+	if err != nil {
+		log.Error().Err(err).Str("path", replayPath).Msg("failed to read the spool file")
+		return
+	}
+	for start := 0; start < len(records); start += defaultSinkBatchSize {
+		end := start + defaultSinkBatchSize
+		if end > len(records) {
+			end = len(records)
+		}
+		if err = buffered.sink.Write(records[start:end]); err != nil {
+			// Keep the records not written yet, the sink retries the others later
+			if start > 0 {
+				rewriteSpool(replayPath, records[start:])
+			}
+			return
+		}
+	}
+	if len(records) > 0 {
+		log.Info().Int("records", len(records)).Msg("replayed the spooled records")
+	}
+	_ = os.Remove(replayPath)
+}
+
+func rewriteSpool(spoolPath string, records [][]byte) {
+	tmpPath := spoolPath + ".tmp"
+	if err := os.WriteFile(tmpPath, joinRecords(records), 0o644); err != nil {
+		log.Error().Err(err).Str("path", spoolPath).Msg("failed to rewrite the spool file")
+		return
+	}
+	if err := os.Rename(tmpPath, spoolPath); err != nil {
+		log.Error().Err(err).Str("path", spoolPath).Msg("failed to rewrite the spool file")
+	}
+}
+
+// Close flushes the buffered records, then closes the sink.
+func (buffered *BufferedSink) Close() error {
+	return buffered.Shutdown(context.Background())
+}
+
+// Shutdown flushes the buffered records until the context is done, then closes the sink.
+// The records written afterwards are spooled.
+func (buffered *BufferedSink) Shutdown(ctx context.Context) error {
+	buffered.mu.Lock()
+	if !buffered.closed {
+		buffered.closed = true
+		close(buffered.records)
+	}
+	buffered.mu.Unlock()
+	select {
+	case <-buffered.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return buffered.sink.Close()
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakySink fails its writes while down.
+type flakySink struct {
+	mu      sync.Mutex
+	down    bool
+	records []string
+	// The writes wait on it, if set
+	blocked chan struct{}
+}
+
+func (sink *flakySink) Write(records [][]byte) error {
+	if sink.blocked != nil {
+		<-sink.blocked
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.down {
+		return errors.New("sink is down")
+	}
+	for _, record := range records {
+		sink.records = append(sink.records, string(record))
+	}
+	return nil
+}
+
+func (sink *flakySink) Close() error {
+	return nil
+}
+
+func (sink *flakySink) setDown(down bool) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.down = down
+}
+
+func (sink *flakySink) written() []string {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return append([]string(nil), sink.records...)
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewFileSink(dir, "usage", 10)
+	require.NoError(t, err)
+
+	require.NoError(t, sink.Write([][]byte{[]byte(`{"n":1}`), []byte(`{"n":2}`)}))
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, sink.Write([][]byte{[]byte(`{"n":3}`)}))
+	require.NoError(t, sink.Close())
+
+	paths, err := filepath.Glob(filepath.Join(dir, "usage-*.jsonl"))
+	require.NoError(t, err)
+	require.Len(t, paths, 2)
+	data, err := os.ReadFile(paths[0])
+	require.NoError(t, err)
+	require.Equal(t, "{\"n\":1}\n{\"n\":2}\n", string(data))
+}
+
+func TestBufferedSinkSpool(t *testing.T) {
+	inner := &flakySink{down: true}
+	spoolDir := t.TempDir()
+	sink, err := NewBufferedSink(inner, spoolDir, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	require.NoError(t, sink.Write([][]byte{[]byte(`{"n":1}`), []byte(`{"n":2}`)}))
+	spoolFiles := func() []string {
+		paths, err := filepath.Glob(filepath.Join(spoolDir, "spool.jsonl*"))
+		require.NoError(t, err)
+		return paths
+	}
+	require.Eventually(t, func() bool {
+		return len(spoolFiles()) > 0
+	}, time.Second, 5*time.Millisecond)
+	require.Empty(t, inner.written())
+
+	// The spooled records are replayed once the sink recovers
+	inner.setDown(false)
+	require.Eventually(t, func() bool {
+		return len(inner.written()) == 2
+	}, time.Second, 5*time.Millisecond)
+	require.NoError(t, sink.Write([][]byte{[]byte(`{"n":3}`)}))
+	require.NoError(t, sink.Close())
+	require.Equal(t, []string{`{"n":1}`, `{"n":2}`, `{"n":3}`}, inner.written())
+	require.Empty(t, spoolFiles())
+}
+
+func TestBufferedSinkReplayDoesNotBlockSpool(t *testing.T) {
+	spoolDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(spoolDir, "spool.jsonl"), []byte("{\"n\":1}\n"), 0o644))
+	inner := &flakySink{blocked: make(chan struct{})}
+	sink, err := NewBufferedSink(inner, spoolDir, time.Millisecond)
+	require.NoError(t, err)
+
+	// The replay waits on the sink, the records are still spooled meanwhile
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(spoolDir, "spool.jsonl.replay"))
+		return err == nil
+	}, time.Second, time.Millisecond)
+	spooled := make(chan error)
+	go func() {
+		spooled <- sink.spool([][]byte{[]byte(`{"n":2}`)})
+	}()
+	select {
+	case err := <-spooled:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the spool is blocked by the replay")
+	}
+
+	close(inner.blocked)
+	require.Eventually(t, func() bool {
+		return len(inner.written()) == 2
+	}, time.Second, time.Millisecond)
+	require.NoError(t, sink.Close())
+	require.Equal(t, []string{`{"n":1}`, `{"n":2}`}, inner.written())
+}
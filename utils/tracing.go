@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+const (
+	TracingOTLP   = "otlp"
+	TracingStdout = "stdout"
+)
+
+// InitTracing sets up the global tracer provider with the configured exporter, and the
+// W3C trace-context propagator. It returns a function flushing the spans on shutdown.
+// Without an exporter, the spans are not recorded but the trace context is still propagated.
+func InitTracing(config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.TracingExporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case TracingOTLP:
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.TracingOTLPEndpoint)}
+		if config.TracingOTLPInsecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case TracingStdout:
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", config.TracingExporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := config.TracingServiceName
+	if serviceName == "" {
+		serviceName = "serving-api"
+	}
+	ratio := config.TracingSampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}